@@ -0,0 +1,264 @@
+package aggregate
+
+import (
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/cjduffett/stork/db"
+	"github.com/cjduffett/stork/logger"
+	"github.com/cjduffett/stork/storage"
+)
+
+// Every shard of a task writes its own files, so a table or resource type
+// is split across as many files as there are shards. Aggregate merges them
+// into a single dataset, under storage.MergedPrefix:
+//
+//     merged/csv/<table>.csv           every shard's rows, under one header
+//     merged/fhir/<resource>.ndjson    every shard's bulk FHIR resources
+//     merged/dataset.zip               the merged files, and every other
+//                                      file generated by any shard
+//
+// Merged files are built in temporary files rather than memory, since a
+// dataset may be larger than memory.
+
+// Aggregate merges the output of every shard in a namespace, and archives
+// the whole dataset. Running it again replaces what was merged before.
+func Aggregate(store storage.Storage, name string) error {
+	logger.Debug("Aggregating the output in namespace " + name)
+
+	objects, err := store.ListObjects(name)
+	if err != nil {
+		return err
+	}
+	merges, others := plan(objects)
+
+	archive, err := ioutil.TempFile("", "stork-archive")
+	if err != nil {
+		return err
+	}
+	defer remove(archive)
+	zipWriter := zip.NewWriter(archive)
+
+	keys := []string{}
+	for key := range merges {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		err = merge(store, name, key, merges[key], zipWriter)
+		if err != nil {
+			return fmt.Errorf("failed to merge %s: %s", key, err)
+		}
+	}
+
+	for _, key := range others {
+		err = archiveObject(store, name, key, zipWriter)
+		if err != nil {
+			return fmt.Errorf("failed to archive %s: %s", key, err)
+		}
+	}
+
+	err = zipWriter.Close()
+	if err != nil {
+		return err
+	}
+	_, err = archive.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return store.PutObject(name, storage.ArchiveKey, archive)
+}
+
+// source is a single shard's part of a merged file.
+type source struct {
+	shard int
+	key   string
+}
+
+// plan returns which objects are merged into which merged keys, in shard
+// order, and the keys of every other object generated by a shard. Objects
+// that weren't generated by a shard, like custom modules or earlier merged
+// output, are left out.
+func plan(objects []storage.Object) (merges map[string][]source, others []string) {
+	merges = make(map[string][]source)
+	others = []string{}
+
+	for _, object := range objects {
+		shard, format, ok := storage.ParseKey(object.Key)
+		if !ok {
+			continue
+		}
+
+		mergedKey := mergedKeyFor(object.Key, format)
+		if mergedKey == "" {
+			others = append(others, object.Key)
+			continue
+		}
+		merges[mergedKey] = append(merges[mergedKey], source{shard: shard, key: object.Key})
+	}
+
+	for _, sources := range merges {
+		sort.Slice(sources, func(i, j int) bool {
+			return sources[i].shard < sources[j].shard
+		})
+	}
+	sort.Strings(others)
+	return merges, others
+}
+
+// mergedKeyFor returns the merged key a shard's file is merged into, or an
+// empty string if the file isn't merged. Only CSV tables and bulk FHIR
+// files at the top of their format's directory are merged.
+func mergedKeyFor(key, format string) string {
+	file := strings.SplitN(key, "/", 3)[2]
+	if strings.Contains(file, "/") {
+		return ""
+	}
+
+	switch {
+	case format == db.FormatCSV && path.Ext(file) == ".csv":
+		return storage.MergedPrefix + "csv/" + file
+	case format == db.FormatFHIR && path.Ext(file) == ".ndjson":
+		return storage.MergedPrefix + "fhir/" + file
+	}
+	return ""
+}
+
+// merge concatenates the sources of a merged file, uploads it, and adds it
+// to the archive. CSV files are merged under the header of the first one,
+// and every other file must have the same header.
+func merge(store storage.Storage, name, key string, sources []source, zipWriter *zip.Writer) error {
+	merged, err := ioutil.TempFile("", "stork-merged")
+	if err != nil {
+		return err
+	}
+	defer remove(merged)
+
+	out := &lineWriter{w: merged}
+	csv := path.Ext(key) == ".csv"
+	header := ""
+	for _, src := range sources {
+		body, err := store.GetObject(name, src.key)
+		if err != nil {
+			return err
+		}
+		if csv {
+			header, err = appendCSV(out, body, header, src.key)
+		} else {
+			err = appendLines(out, body)
+		}
+		body.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = merged.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	err = store.PutObject(name, key, merged)
+	if err != nil {
+		return err
+	}
+
+	_, err = merged.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return addToArchive(zipWriter, strings.TrimPrefix(key, storage.MergedPrefix), merged)
+}
+
+// appendCSV appends the rows of a CSV file. The header is only written if
+// it's the first one, which is returned for the next file to match.
+func appendCSV(out *lineWriter, body io.Reader, header, key string) (string, error) {
+	reader := bufio.NewReader(body)
+	first, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return header, err
+	}
+	first = strings.TrimRight(first, "\r\n")
+
+	// An empty file has no rows to add
+	if first == "" {
+		return header, nil
+	}
+
+	if header == "" {
+		header = first
+		err = appendLines(out, strings.NewReader(header))
+		if err != nil {
+			return header, err
+		}
+	} else if first != header {
+		return header, fmt.Errorf("%s has different columns than the shards before it", key)
+	}
+	return header, appendLines(out, reader)
+}
+
+// appendLines appends a file, ending its last line if it isn't already.
+func appendLines(out *lineWriter, body io.Reader) error {
+	_, err := io.Copy(out, body)
+	if err != nil {
+		return err
+	}
+	return out.endLine()
+}
+
+// archiveObject adds a shard's file to the archive, under its own key.
+func archiveObject(store storage.Storage, name, key string, zipWriter *zip.Writer) error {
+	body, err := store.GetObject(name, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return addToArchive(zipWriter, key, body)
+}
+
+// addToArchive adds a file to the archive.
+func addToArchive(zipWriter *zip.Writer, name string, body io.Reader) error {
+	w, err := zipWriter.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, body)
+	return err
+}
+
+// remove closes and deletes a temporary file.
+func remove(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
+
+// lineWriter remembers the last byte written, so a line that wasn't ended
+// can be ended before the next file is appended.
+type lineWriter struct {
+	w    io.Writer
+	last byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		l.last = p[len(p)-1]
+	}
+	return l.w.Write(p)
+}
+
+// endLine writes a newline, unless nothing was written yet or the last
+// line was already ended.
+func (l *lineWriter) endLine() error {
+	if l.last == 0 || l.last == '\n' {
+		return nil
+	}
+	_, err := l.Write([]byte("\n"))
+	return err
+}
@@ -0,0 +1,88 @@
+package aggregate
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cjduffett/stork/storage"
+	"github.com/stretchr/testify/suite"
+)
+
+type AggregateTestSuite struct {
+	suite.Suite
+	root    string
+	storage *storage.FileStorage
+}
+
+func TestAggregateTestSuite(t *testing.T) {
+	suite.Run(t, new(AggregateTestSuite))
+}
+
+func (a *AggregateTestSuite) SetupTest() {
+	var err error
+	a.root, err = ioutil.TempDir("", "storktest")
+	a.Require().NoError(err)
+	a.storage = storage.NewFileStorage(a.root, "http://localhost:8080", []byte("secret"))
+	a.Require().NoError(a.storage.CreateNamespace("test-bucket"))
+}
+
+func (a *AggregateTestSuite) TearDownTest() {
+	os.RemoveAll(a.root)
+}
+
+func (a *AggregateTestSuite) TestAggregate() {
+	// Shard 10 sorts before shard 2 by key, but is merged after it
+	a.putObject("shard-0/csv/patients.csv", "Id,NAME\n1,Ann\n")
+	a.putObject("shard-2/csv/patients.csv", "Id,NAME\r\n2,Bob")
+	a.putObject("shard-10/csv/patients.csv", "Id,NAME\n3,Cy\n")
+	a.putObject("shard-1/csv/patients.csv", "")
+	a.putObject("shard-0/fhir/Patient.ndjson", "{\"id\":\"1\"}")
+	a.putObject("shard-1/fhir/Patient.ndjson", "{\"id\":\"2\"}\n")
+	a.putObject("shard-0/fhir/bundle.json", "{}")
+	a.putObject("shard-0/html/1.html", "<html></html>")
+	a.putObject("modules/custom.json", "{}")
+
+	a.Require().NoError(Aggregate(a.storage, "test-bucket"))
+	a.Equal("Id,NAME\n1,Ann\n2,Bob\n3,Cy\n", a.getObject(storage.MergedPrefix+"csv/patients.csv"))
+	a.Equal("{\"id\":\"1\"}\n{\"id\":\"2\"}\n", a.getObject(storage.MergedPrefix+"fhir/Patient.ndjson"))
+
+	// The archive has the merged files and every other file of every shard
+	archive, err := zip.OpenReader(filepath.Join(a.root, "test-bucket", filepath.FromSlash(storage.ArchiveKey)))
+	a.Require().NoError(err)
+	defer archive.Close()
+	names := []string{}
+	for _, file := range archive.File {
+		names = append(names, file.Name)
+	}
+	a.Equal([]string{"csv/patients.csv", "fhir/Patient.ndjson", "shard-0/fhir/bundle.json", "shard-0/html/1.html"}, names)
+
+	// Aggregating again replaces the merged files, rather than merging them
+	a.Require().NoError(Aggregate(a.storage, "test-bucket"))
+	a.Equal("Id,NAME\n1,Ann\n2,Bob\n3,Cy\n", a.getObject(storage.MergedPrefix+"csv/patients.csv"))
+}
+
+func (a *AggregateTestSuite) TestAggregateMismatchedColumns() {
+	a.putObject("shard-0/csv/patients.csv", "Id,NAME\n1,Ann\n")
+	a.putObject("shard-1/csv/patients.csv", "Id,SSN\n2,123\n")
+
+	err := Aggregate(a.storage, "test-bucket")
+	a.Error(err)
+	a.Contains(err.Error(), "shard-1/csv/patients.csv")
+}
+
+func (a *AggregateTestSuite) putObject(key, contents string) {
+	a.Require().NoError(a.storage.PutObject("test-bucket", key, strings.NewReader(contents)))
+}
+
+func (a *AggregateTestSuite) getObject(key string) string {
+	body, err := a.storage.GetObject("test-bucket", key)
+	a.Require().NoError(err)
+	defer body.Close()
+	contents, err := ioutil.ReadAll(body)
+	a.Require().NoError(err)
+	return string(contents)
+}
@@ -1,22 +1,54 @@
 package api
 
 import (
-	"github.com/cjduffett/stork/awsutil"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cjduffett/stork/auth"
+	"github.com/cjduffett/stork/config"
 	"github.com/cjduffett/stork/db"
+	"github.com/cjduffett/stork/events"
+	"github.com/cjduffett/stork/lifecycle"
+	"github.com/cjduffett/stork/logger"
+	"github.com/cjduffett/stork/planner"
+	"github.com/cjduffett/stork/quota"
+	"github.com/cjduffett/stork/runner"
+	"github.com/cjduffett/stork/storage"
 	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
+// How often an idle event stream is sent a comment, to keep it open.
+const eventKeepAlive = 15 * time.Second
+
 // APIController implements all Stork API endpoints
 type APIController struct {
 	DAL       *db.DataAccessLayer
-	AWSClient *awsutil.AWSClient
+	Config    *config.StorkConfig
+	Runner    runner.Runner
+	Storage   storage.Storage
+	Lifecycle *lifecycle.Manager
 }
 
 // NewAPIController returns a pointer to an initialized APIController
-func NewAPIController(dal *db.DataAccessLayer, awsClient *awsutil.AWSClient) *APIController {
+func NewAPIController(manager *lifecycle.Manager) *APIController {
 	return &APIController{
-		DAL:       dal,
-		AWSClient: awsClient,
+		DAL:       manager.DAL,
+		Config:    manager.Config,
+		Runner:    manager.Runner,
+		Storage:   manager.Storage,
+		Lifecycle: manager,
 	}
 }
 
@@ -24,76 +56,1000 @@ func NewAPIController(dal *db.DataAccessLayer, awsClient *awsutil.AWSClient) *AP
 // patients to generate, number of instances to use, the instance
 // type to use, and what formats to export.
 func (a *APIController) CreateTask(c *gin.Context) {
-	// Read config options:
+	var err error
+
+	// Read config options. The task is owned by the authenticated user.
 	// - population
 	// - number of instances
-	// - instance type (?)
-	// - formats to export
+	// - instance type
+	// - formats to export, and their options
+	// - Synthea options: geography, demographics, modules, history and seed
+	// - custom Synthea modules to load
+	// - who to email when the task ends
+	// - where to POST status changes
+	// - how to retry failed shards
+	// - its priority in the queue
+	req, ok := a.taskRequest(c)
+	if !ok {
+		return
+	}
 
-	// Create bucket
+	// Split the population across the instances, so each one
+	// generates a distinct slice of the dataset
+	instanceType, _ := a.Config.GetInstanceType(req.InstanceType)
+	shards, err := planner.Plan(req.Population, req.Instances, instanceType, a.Config)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
 
-	// Create EC2 instances
+	// The task ID is needed before anything is created, since both
+	// the bucket and the instances are named after it.
+	p := principal(c)
+	task := &db.Task{
+		ID:           bson.NewObjectId().Hex(),
+		Status:       db.TaskStatusActive,
+		Population:   req.Population,
+		InstanceType: instanceType.Name,
+		User:         p.User,
+		Formats:      exportSpecs(req.Formats),
+		Synthea:      req.Synthea,
+		Modules:      customModules(req.CustomModules),
+		Notify:       req.Notify,
+		Spot:         a.Config.SyntheaSpot,
+		Priority:     req.Priority,
+		Retry: db.RetryPolicy{
+			MaxAttempts:    a.Config.DefaultMaxAttempts,
+			BackoffSeconds: int(a.Config.DefaultRetryBackoff / time.Second),
+		},
+	}
+	if task.Synthea.Seed == 0 {
+		task.Synthea.Seed, err = planner.NewSeed()
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if req.Retry != nil {
+		task.Retry = *req.Retry
+	}
+	if req.Spot != nil {
+		task.Spot = *req.Spot
+	}
+	if req.CallbackURL != "" {
+		task.Webhook = &db.Webhook{
+			URL:    req.CallbackURL,
+			Secret: req.CallbackSecret,
+		}
+	}
+	task.BucketName = bucketName(task.ID)
 
-	// Save state
+	// Without explicit recipients, the owner is emailed
+	if len(task.Notify) == 0 && p.Email != "" {
+		task.Notify = []string{p.Email}
+	}
 
-	// Return status
+	// Record everything needed to generate the same data again
+	task.Recipe = planner.NewRecipe(task, shards, "", a.Config)
+
+	a.submitTask(c, task, shards, req.CustomModules)
 }
 
-// GetTasks returns a list of all Stork tasks and their statuses.
+// RerunTask creates a new task from the recipe of an existing one, which
+// generates the same data again as long as the Synthea image is unchanged.
+// The new task is owned by the authenticated user, and links back to the
+// original with RerunOf.
+func (a *APIController) RerunTask(c *gin.Context) {
+	original, ok := a.getTask(c)
+	if !ok {
+		return
+	}
+
+	recipe := original.Recipe
+	if recipe == nil {
+		abortWithError(c, http.StatusConflict, errors.New("Task "+original.ID+" has no recipe to rerun"))
+		return
+	}
+	if recipe.Runner != a.Config.Runner {
+		abortWithError(c, http.StatusConflict, fmt.Errorf("Task %s was generated by the %s runner, this server uses the %s runner", original.ID, recipe.Runner, a.Config.Runner))
+		return
+	}
+	if _, ok := a.Config.GetInstanceType(recipe.InstanceType); !ok {
+		abortWithError(c, http.StatusConflict, fmt.Errorf("Task %s was generated on instance type %s, which is no longer allowed", original.ID, recipe.InstanceType))
+		return
+	}
+
+	p := principal(c)
+	task := &db.Task{
+		ID:           bson.NewObjectId().Hex(),
+		Status:       db.TaskStatusActive,
+		Population:   recipe.Population,
+		InstanceType: recipe.InstanceType,
+		User:         p.User,
+		Formats:      recipe.Formats,
+		Synthea:      recipe.Synthea,
+		Modules:      original.Modules,
+		Spot:         original.Spot,
+		Priority:     original.Priority,
+		Retry:        original.Retry,
+		RerunOf:      original.ID,
+	}
+	task.BucketName = bucketName(task.ID)
+
+	// Only the owner of the original task is notified the same way again
+	if p.User == original.User {
+		task.Notify = original.Notify
+		task.Webhook = original.Webhook
+	} else if p.Email != "" {
+		task.Notify = []string{p.Email}
+	}
+
+	shards := planner.RecipeShards(recipe)
+	task.Recipe = planner.NewRecipe(task, shards, recipe.ImageID, a.Config)
+
+	// The original task's modules are stored already
+	a.submitTask(c, task, shards, nil)
+}
+
+// EstimateTask plans a task without launching it, returning the shard layout
+// and how long the task is expected to take and cost. It takes the same body
+// as CreateTask. Instance throughput is learned from recent completed tasks
+// on the same instance type, if there are any.
+func (a *APIController) EstimateTask(c *gin.Context) {
+	req, ok := a.taskRequest(c)
+	if !ok {
+		return
+	}
+
+	instanceType, _ := a.Config.GetInstanceType(req.InstanceType)
+	shards, err := planner.Plan(req.Population, req.Instances, instanceType, a.Config)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	pastTasks, err := a.DAL.GetCompletedTasks(instanceType.Name, a.Config.EstimateSampleSize)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	patientsPerHour, samples := planner.Throughput(pastTasks.Tasks)
+	if samples == 0 {
+		patientsPerHour = float64(instanceType.PatientsPerHour)
+	}
+
+	estimate, err := planner.NewEstimate(shards, instanceType, patientsPerHour, db.FormatNames(req.Formats), a.Config.Prices)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	estimate.SampleTasks = samples
+	c.JSON(http.StatusOK, TaskEstimateResponse{
+		Estimate:        estimate,
+		Duration:        estimate.Duration.String(),
+		DurationSeconds: int64(estimate.Duration / time.Second),
+	})
+}
+
+// GetTasks returns a list of all Stork tasks and their statuses. Users
+// only see their own tasks, while admins see every task.
 func (a *APIController) GetTasks(c *gin.Context) {
+	var taskList *db.TaskList
+	var err error
+
 	// Check state for all non-deleted tasks
+	p := principal(c)
+	if p.IsAdmin() {
+		taskList, err = a.DAL.GetTasks()
+	} else {
+		taskList, err = a.DAL.GetTasksByUser(p.User)
+	}
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
 
 	// return a list of these states & statuses
+	c.JSON(http.StatusOK, taskList)
 }
 
 // GetTaskStatus gets the current status of an active task. While
 // a task is in-progress GetTaskStatus returns the number of running
 // instance, the current processing time, etc. Once complete, GetTaskStatus
-// returns the URL to the S3 bucket containing all of the exported data.
+// returns the URL of the task's files, see GetTaskFiles. A queued task's
+// position in the queue is returned instead.
 func (a *APIController) GetTaskStatus(c *gin.Context) {
 	// Check state for the desired task
-
 	// If not present (or deleted) - error
+	task, ok := a.getTask(c)
+	if !ok {
+		return
+	}
 
 	// Compute elapsed time
+	running := 0
+	for _, instance := range task.Instances {
+		if instance.Status == db.InstanceStatusActive {
+			running++
+		}
+	}
 
 	// Return status
+	resp := TaskStatusResponse{
+		Task:             task,
+		ElapsedTime:      task.ElapsedTime().String(),
+		RunningInstances: running,
+	}
+	if task.Status == db.TaskStatusCompleted {
+		resp.FilesURL = a.Config.BaseURL() + "/task/" + task.ID + "/files"
+	}
+	if task.Status == db.TaskStatusQueued {
+		// The task may have just been started, in which case it has no position
+		position, err := a.Lifecycle.QueuePosition(task)
+		if err != nil && err != mgo.ErrNotFound {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		resp.QueuePosition = position
+	}
+	c.JSON(http.StatusOK, resp)
 }
 
 // AbortTask stops a running Stork task, killing any active instances
-// then deleting the S3 bucket used for the export.
+// then deleting the bucket used for the export.
 func (a *APIController) AbortTask(c *gin.Context) {
 	// Check state for active task
-
 	// If not present (or deleted) - error
+	task, ok := a.getTask(c)
+	if !ok {
+		return
+	}
+
+	if task.Status != db.TaskStatusActive && task.Status != db.TaskStatusQueued {
+		abortWithError(c, http.StatusConflict, errors.New("Task "+task.ID+" is not active"))
+		return
+	}
+
+	// Mark the task aborted first, so the reconciler leaves it alone.
+	// A queued task that's aborted is never started.
+	err := a.Lifecycle.EndTask(task, db.TaskStatusAborted)
+	if err == mgo.ErrNotFound {
+		abortWithError(c, http.StatusConflict, errors.New("Task "+task.ID+" is not active"))
+		return
+	}
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
 
-	// Stop running EC2 instances
+	// Stop running EC2 instances. Attempts that already failed or finished
+	// are left alone, since EC2 may have forgotten about them.
+	if activeIDs := task.ActiveInstanceIDs(); len(activeIDs) > 0 {
+		err = a.Runner.TerminateInstances(activeIDs)
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
 
-	// When confirmed stopped, delete the s3 bucket
+	// When confirmed stopped, delete the bucket
+	if task.StartTime != nil {
+		err = a.Storage.DeleteNamespace(task.BucketName)
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
 
 	// Return status
+	c.JSON(http.StatusOK, task)
+}
+
+// GetTaskFiles returns the manifest of a completed task, with a download
+// link for every file. Links expire after config.DownloadExpiry.
+func (a *APIController) GetTaskFiles(c *gin.Context) {
+	task, ok := a.getTask(c)
+	if !ok {
+		return
+	}
+
+	if task.Status != db.TaskStatusCompleted {
+		abortWithError(c, http.StatusConflict, errors.New("Task "+task.ID+" is not completed"))
+		return
+	}
+
+	// The manifest may be missing if storage was unavailable when the task completed
+	manifest := task.Manifest
+	if manifest == nil {
+		objects, err := a.Storage.ListObjects(task.BucketName)
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		manifest = storage.BuildManifest(objects)
+	}
+
+	manifest, err := a.signManifest(task.BucketName, manifest)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, TaskFilesResponse{
+		Manifest: manifest,
+		Expires:  time.Now().Add(a.Config.DownloadExpiry),
+	})
+}
+
+// StreamTaskEvents streams the events of a task as Server-Sent Events,
+// starting with the task's current status. The stream ends after the task
+// does, with a final "task.status" event that includes the download manifest
+// of a completed task. If the task's output is being aggregated, the stream
+// stays open for another "task.status" event with the merged files.
+func (a *APIController) StreamTaskEvents(c *gin.Context) {
+	// Subscribe before the task is read, so that nothing that happens
+	// in between is missed
+	sub := a.Lifecycle.Events.Subscribe(c.Param("id"))
+	defer sub.Close()
+
+	task, ok := a.getTask(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+
+	event := events.NewTaskEvent(task)
+	for {
+		if event.Manifest != nil {
+			// Events are shared between subscribers, so sign a copy
+			terminal := *event
+			manifest, err := a.signManifest(task.BucketName, event.Manifest)
+			if err != nil {
+				logger.Error(err)
+			} else {
+				terminal.Manifest = manifest
+			}
+			event = &terminal
+		}
+
+		err := writeEvent(c.Writer, event)
+		if err != nil || event.Terminal() {
+			return
+		}
+
+		event, ok = a.nextEvent(c, sub)
+		if !ok {
+			return
+		}
+	}
+}
+
+// nextEvent waits for the next event from a subscription, sending a comment
+// every eventKeepAlive so proxies don't time out an idle stream. It returns
+// false if the client went away or the subscription was closed.
+func (a *APIController) nextEvent(c *gin.Context, sub *events.Subscription) (*events.Event, bool) {
+	closed := c.Writer.CloseNotify()
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, ok := <-sub.C:
+			return event, ok
+		case <-keepAlive.C:
+			_, err := c.Writer.WriteString(": keep-alive\n\n")
+			if err != nil {
+				return nil, false
+			}
+			c.Writer.Flush()
+		case <-closed:
+			return nil, false
+		}
+	}
+}
+
+// GetTaskWebhooks returns every event sent to a task's webhook, oldest
+// first, along with every attempt to deliver it.
+func (a *APIController) GetTaskWebhooks(c *gin.Context) {
+	task, ok := a.getTask(c)
+	if !ok {
+		return
+	}
+
+	deliveries, err := a.DAL.GetWebhookDeliveries(task.ID)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, deliveries)
 }
 
 // DeleteTask deletes a complete (or aborted) Stork task.
 func (a *APIController) DeleteTask(c *gin.Context) {
 	// Check state for inactive (or aborted) task
-
 	// If not present (or deleted) - error
+	task, ok := a.getTask(c)
+	if !ok {
+		return
+	}
 
-	// Delete state and S3 bucket (if applicable)
+	if task.Status == db.TaskStatusActive || task.Status == db.TaskStatusQueued {
+		abortWithError(c, http.StatusConflict, errors.New("Task "+task.ID+" is still "+task.Status+", abort it first"))
+		return
+	}
+
+	// Delete state and bucket (if applicable)
+	err := a.Lifecycle.DeleteTask(task)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
 
 	// Return confirmation
+	c.Status(http.StatusNoContent)
+}
+
+// Download serves an object from the fs storage, through a signed link
+// returned by FileStorage.DownloadURL.
+func (a *APIController) Download(c *gin.Context) {
+	fileStorage, ok := a.Storage.(*storage.FileStorage)
+	if !ok {
+		abortWithError(c, http.StatusNotFound, errors.New("Downloads are not served by Stork"))
+		return
+	}
+
+	name := c.Param("namespace")
+	key := strings.TrimPrefix(c.Param("key"), "/")
+
+	file, err := fileStorage.Open(name, key, c.Query("expires"), c.Query("signature"))
+	if err != nil {
+		abortWithError(c, http.StatusForbidden, err)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	http.ServeContent(c.Writer, c.Request, path.Base(key), info.ModTime(), file)
+}
+
+// CreateAPIKey creates a new API key for a user. Only admins may create keys.
+func (a *APIController) CreateAPIKey(c *gin.Context) {
+	if !principal(c).IsAdmin() {
+		abortWithError(c, http.StatusForbidden, errors.New("Only admins can create API keys"))
+		return
+	}
+
+	req := APIKeyRequest{}
+	err := json.NewDecoder(c.Request.Body).Decode(&req)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, errors.New("Malformed API key request: "+err.Error()))
+		return
+	}
+
+	if req.Role == "" {
+		req.Role = db.RoleUser
+	}
+	if req.User == "" || !db.IsValidRole(req.Role) {
+		abortWithError(c, http.StatusBadRequest, errors.New("A user and a valid role are required"))
+		return
+	}
+	if req.Email != "" {
+		_, err = mail.ParseAddress(req.Email)
+		if err != nil {
+			abortWithError(c, http.StatusBadRequest, errors.New("Invalid email address "+req.Email))
+			return
+		}
+	}
+
+	key, err := auth.NewAPIKey()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	now := time.Now()
+	err = a.DAL.SaveAPIKey(&db.APIKey{
+		KeyHash: auth.HashToken(key),
+		User:    req.User,
+		Role:    req.Role,
+		Email:   req.Email,
+		Created: &now,
+	})
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, APIKeyResponse{
+		Key:   key,
+		User:  req.User,
+		Role:  req.Role,
+		Email: req.Email,
+	})
+}
+
+// GetQuota returns the authenticated user's quota, and their current usage
+// against each of its limits. Admins can see any user's quota with the
+// user query parameter.
+func (a *APIController) GetQuota(c *gin.Context) {
+	p := principal(c)
+	user := p.User
+	if other := c.Query("user"); other != "" && other != user {
+		if !p.IsAdmin() {
+			abortWithError(c, http.StatusForbidden, errors.New("Only admins can see other users' quotas"))
+			return
+		}
+		user = other
+	}
+
+	userQuota, usage, err := a.quotaUsage(user)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, QuotaResponse{
+		User:       user,
+		Limits:     quota.Report(userQuota, usage),
+		MonthStart: quota.MonthStart(time.Now()),
+	})
+}
+
+// SetQuota replaces a user's quota. Only admins can set quotas.
+func (a *APIController) SetQuota(c *gin.Context) {
+	if !principal(c).IsAdmin() {
+		abortWithError(c, http.StatusForbidden, errors.New("Only admins can set quotas"))
+		return
+	}
+
+	req := QuotaRequest{}
+	err := json.NewDecoder(c.Request.Body).Decode(&req)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, errors.New("Malformed quota request: "+err.Error()))
+		return
+	}
+	if req.MaxActiveTasks < 0 || req.MaxInstances < 0 || req.MaxPatientsPerMonth < 0 || req.MaxStorageBytes < 0 {
+		abortWithError(c, http.StatusBadRequest, errors.New("Quota limits must not be negative"))
+		return
+	}
+
+	userQuota := &db.Quota{
+		User:                c.Param("user"),
+		MaxActiveTasks:      req.MaxActiveTasks,
+		MaxInstances:        req.MaxInstances,
+		MaxPatientsPerMonth: req.MaxPatientsPerMonth,
+		MaxStorageBytes:     req.MaxStorageBytes,
+	}
+	err = a.DAL.SaveQuota(userQuota)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, userQuota)
 }
 
 // SyntheaInstanceDone is an endpoint for use by Synthea EC2 instances
 // ONLY. Once an instance finishes generating its allocation of patients,
-// it pings this endpoint to indicate that it's done.
+// it pings this endpoint to indicate that it's done. The instance must
+// present the token from its InstanceConfig as a bearer token, and each
+// token can only be used once.
 func (a *APIController) SyntheaInstanceDone(c *gin.Context) {
-	// Check state for unique instance ID
+	task, instance, ok := a.callbackInstance(c, "done")
+	if !ok {
+		return
+	}
 
-	// If not present - error
+	req := InstanceDoneRequest{}
+	err := json.NewDecoder(c.Request.Body).Decode(&req)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, errors.New("Malformed done request: "+err.Error()))
+		return
+	}
 
 	// Update state to reflect instance completed, generation count, etc.
+	// This only succeeds once per instance, even for concurrent requests.
+	err = a.Lifecycle.InstanceDone(task, instance, req.PatientsGenerated)
+	if err == mgo.ErrNotFound {
+		logger.Warning("Rejected done callback for instance ", instance.InstanceID, ": token already used")
+		abortWithError(c, http.StatusConflict, errors.New("Instance "+instance.InstanceID+" is not active"))
+		return
+	}
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	// The instance has no more work to do
+	err = a.Runner.TerminateInstances([]string{instance.InstanceID})
+	if err != nil {
+		logger.Error(err)
+	}
+
+	// If this was the last instance, the task is complete. The instance
+	// can't report done again, so if the task can't be ended here the
+	// Reconciler ends it on its next pass instead.
+	task, err = a.DAL.GetTask(task.ID)
+	if err != nil {
+		logger.Error(err)
+	} else if task.Status == db.TaskStatusActive && lifecycle.TaskStatus(task) == db.TaskStatusCompleted {
+		err = a.Lifecycle.EndTask(task, db.TaskStatusCompleted)
+		if err != nil && err != mgo.ErrNotFound {
+			logger.Error(err)
+		}
+	}
 
 	// Return confirmation
+	c.Status(http.StatusNoContent)
+}
+
+// SyntheaInstanceProgress is called periodically by each Synthea instance
+// with the number of patients generated so far and what it's doing. Like
+// SyntheaInstanceDone, it's authenticated with the instance's token. An
+// instance that stops calling it is eventually failed by the Reconciler.
+func (a *APIController) SyntheaInstanceProgress(c *gin.Context) {
+	task, instance, ok := a.callbackInstance(c, "progress")
+	if !ok {
+		return
+	}
+
+	req := InstanceProgressRequest{}
+	err := json.NewDecoder(c.Request.Body).Decode(&req)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, errors.New("Malformed progress request: "+err.Error()))
+		return
+	}
+
+	err = a.Lifecycle.InstanceProgress(task, instance, req.PatientsGenerated, req.Phase)
+	if err == mgo.ErrNotFound {
+		abortWithError(c, http.StatusConflict, errors.New("Instance "+instance.InstanceID+" is not active"))
+		return
+	}
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// callbackInstance authenticates a callback from a Synthea instance,
+// returning the task and the active instance the callback's token was
+// minted for. Otherwise the request is aborted and ok is false.
+func (a *APIController) callbackInstance(c *gin.Context, callback string) (task *db.Task, instance *db.Instance, ok bool) {
+	taskID := c.Param("id")
+	logger.Debug(fmt.Sprintf("%s callback for task %s from %s", callback, taskID, c.ClientIP()))
+
+	// Check state for the task
+	task, err := a.DAL.GetTask(taskID)
+	if err != nil {
+		abortWithError(c, http.StatusNotFound, errors.New("Unknown task "+taskID))
+		return nil, nil, false
+	}
+
+	// Check the token, and find the unique instance it was minted for
+	token := auth.BearerToken(c.Request)
+	if token == "" {
+		logger.Warning("Rejected ", callback, " callback for task ", taskID, ": missing token")
+		abortWithError(c, http.StatusUnauthorized, errors.New("Missing token"))
+		return nil, nil, false
+	}
+
+	instance, err = a.instanceForToken(task, token)
+	if err != nil {
+		logger.Warning("Rejected ", callback, " callback for task ", taskID, ": ", err)
+		abortWithError(c, http.StatusUnauthorized, errors.New("Invalid token"))
+		return nil, nil, false
+	}
+
+	// If the instance is already done, the token is being replayed
+	if instance.Status != db.InstanceStatusActive {
+		logger.Warning("Rejected ", callback, " callback for instance ", instance.InstanceID, ": token already used")
+		abortWithError(c, http.StatusConflict, errors.New("Instance "+instance.InstanceID+" is not active"))
+		return nil, nil, false
+	}
+	return task, instance, true
+}
+
+// instanceForToken returns the instance of a task that a token was minted for.
+func (a *APIController) instanceForToken(task *db.Task, token string) (*db.Instance, error) {
+	shard, err := auth.VerifyInstanceToken([]byte(a.Config.CallbackSecret), task.ID, token)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := auth.HashToken(token)
+	for i := range task.Instances {
+		instance := &task.Instances[i]
+		if instance.Shard == shard && auth.TokenHashesEqual(instance.TokenHash, hash) {
+			return instance, nil
+		}
+	}
+	return nil, errors.New("no instance found for token")
+}
+
+// getTask returns the task named in the request path. If it doesn't exist,
+// was deleted, or isn't visible to the authenticated user, the request is
+// aborted with a 404 and ok is false.
+func (a *APIController) getTask(c *gin.Context) (task *db.Task, ok bool) {
+	taskID := c.Param("id")
+
+	task, err := a.DAL.GetTask(taskID)
+	if err != nil || task.Status == db.TaskStatusDeleted || !principal(c).CanAccess(task) {
+		abortWithError(c, http.StatusNotFound, errors.New("Unknown task "+taskID))
+		return nil, false
+	}
+	return task, true
+}
+
+// submitTask starts a new task, or queues it until there are enough
+// instances free, and responds with it. If the task can never run, or would
+// put the user over their quota, the request is aborted instead. The custom
+// modules uploaded with the task are only stored once it's accepted.
+func (a *APIController) submitTask(c *gin.Context, task *db.Task, shards []planner.Shard, uploads []ModuleUpload) {
+	// A task that needs more instances than can ever run at once would
+	// be queued forever
+	if max := a.Config.MaxRunningInstances; max > 0 && len(shards) > max {
+		abortWithError(c, http.StatusBadRequest, fmt.Errorf("at most %d instances can run at once", max))
+		return
+	}
+
+	// Users can't go over their quota, admins have none
+	p := principal(c)
+	if !p.IsAdmin() && !a.checkQuota(c, p.User, len(shards), task.Population) {
+		return
+	}
+
+	err := a.saveCustomModules(uploads)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = a.Lifecycle.SubmitTask(task, shards)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Return status
+	c.Header("Location", "/task/"+task.ID)
+	c.JSON(http.StatusCreated, task)
+}
+
+// checkQuota checks that a new task with the given number of instances and
+// population wouldn't put the user over their quota. If it would, or the
+// quota can't be checked, the request is aborted. Tasks created at the same
+// time are checked independently, so they can go over the quota together.
+func (a *APIController) checkQuota(c *gin.Context, user string, instances, population int) bool {
+	userQuota, usage, err := a.quotaUsage(user)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return false
+	}
+
+	qErr := quota.Check(userQuota, usage, instances, population)
+	if qErr != nil {
+		logger.Warning(fmt.Sprintf("Rejected a task for user %s: %s", user, qErr))
+		c.JSON(qErr.Status, QuotaErrorResponse{Error: qErr.Error(), Details: qErr})
+		c.Abort()
+		return false
+	}
+	return true
+}
+
+// quotaUsage returns a user's quota, and how much of it they're using.
+func (a *APIController) quotaUsage(user string) (*db.Quota, *quota.Usage, error) {
+	userQuota, err := a.DAL.GetQuota(user)
+	if err == mgo.ErrNotFound {
+		userQuota, err = quota.Default(user, a.Config), nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	taskList, err := a.DAL.GetQuotaTasks(user, quota.MonthStart(now))
+	if err != nil {
+		return nil, nil, err
+	}
+	return userQuota, quota.NewUsage(taskList.Tasks, now), nil
+}
+
+// taskRequest reads and validates the TaskRequest in the body of the
+// request. If it's malformed or invalid, the request is aborted. Custom
+// modules are uploaded in a multipart/form-data body instead, with the
+// TaskRequest in the "task" field and each module in a "modules" file.
+func (a *APIController) taskRequest(c *gin.Context) (*TaskRequest, bool) {
+	req := &TaskRequest{}
+	var err error
+	if strings.HasPrefix(c.Request.Header.Get("Content-Type"), "multipart/form-data") {
+		err = readMultipartTaskRequest(c, req)
+	} else {
+		err = json.NewDecoder(c.Request.Body).Decode(req)
+	}
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, errors.New("Malformed task request: "+err.Error()))
+		return nil, false
+	}
+
+	err = req.Validate(a.Config)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return nil, false
+	}
+	return req, true
+}
+
+// readMultipartTaskRequest reads a TaskRequest and its custom modules from
+// a multipart/form-data body. Modules are read up to one byte past the
+// size limit, so oversized modules fail validation.
+func readMultipartTaskRequest(c *gin.Context, req *TaskRequest) error {
+	r := c.Request
+	r.Body = http.MaxBytesReader(c.Writer, r.Body, (maxCustomModules+1)*maxCustomModuleSize)
+	err := r.ParseMultipartForm(maxCustomModuleSize)
+	if err != nil {
+		return err
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	values := r.MultipartForm.Value["task"]
+	if len(values) != 1 {
+		return errors.New("exactly 1 task field is required")
+	}
+	err = json.Unmarshal([]byte(values[0]), req)
+	if err != nil {
+		return err
+	}
+
+	for _, header := range r.MultipartForm.File["modules"] {
+		file, err := header.Open()
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadAll(io.LimitReader(file, maxCustomModuleSize+1))
+		file.Close()
+		if err != nil {
+			return err
+		}
+		req.CustomModules = append(req.CustomModules, ModuleUpload{
+			Filename: header.Filename,
+			Content:  content,
+		})
+	}
+	return nil
+}
+
+// exportSpecs returns the export specs of a task, with the default FHIR
+// version and layout filled in.
+func exportSpecs(specs []db.ExportSpec) []db.ExportSpec {
+	defaulted := make([]db.ExportSpec, len(specs))
+	for i, spec := range specs {
+		if spec.Format == db.FormatFHIR {
+			if spec.FHIRVersion == "" {
+				spec.FHIRVersion = db.FHIRVersionR4
+			}
+			if spec.FHIRLayout == "" {
+				spec.FHIRLayout = db.FHIRLayoutBundle
+			}
+		}
+		defaulted[i] = spec
+	}
+	return defaulted
+}
+
+// customModules returns the custom modules uploaded with a task, keyed
+// by where they'll be stored in the task's namespace.
+func customModules(uploads []ModuleUpload) []db.CustomModule {
+	modules := []db.CustomModule{}
+	for _, upload := range uploads {
+		modules = append(modules, db.CustomModule{
+			Key:      storage.ModulesPrefix + upload.Filename,
+			Size:     int64(len(upload.Content)),
+			Checksum: moduleChecksum(upload.Content),
+		})
+	}
+	return modules
+}
+
+// saveCustomModules stores the content of the custom modules uploaded with
+// a task, by checksum. The content isn't kept with the task itself, which
+// would quickly outgrow MongoDB's document size limit.
+func (a *APIController) saveCustomModules(uploads []ModuleUpload) error {
+	for _, upload := range uploads {
+		err := a.DAL.SaveModule(moduleChecksum(upload.Content), upload.Content)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moduleChecksum returns the hex MD5 checksum of a custom module.
+func moduleChecksum(content []byte) string {
+	sum := md5.Sum(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// principal returns the user authenticated for a request.
+func principal(c *gin.Context) *auth.Principal {
+	return c.MustGet(auth.PrincipalKey).(*auth.Principal)
+}
+
+// bucketName returns the name of the bucket (storage namespace) used by a task.
+func bucketName(taskID string) string {
+	return "stork-" + taskID
+}
+
+// signManifest returns a copy of a manifest with a download link for every file.
+func (a *APIController) signManifest(bucketName string, manifest *db.Manifest) (*db.Manifest, error) {
+	var err error
+	signed := *manifest
+	signed.Groups = make([]db.ManifestGroup, len(manifest.Groups))
+	for i, group := range manifest.Groups {
+		group.Files, err = a.signFiles(bucketName, group.Files)
+		if err != nil {
+			return nil, err
+		}
+		signed.Groups[i] = group
+	}
+
+	if len(manifest.Merged) > 0 {
+		signed.Merged, err = a.signFiles(bucketName, manifest.Merged)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if manifest.Archive != nil {
+		archive, err := a.signFiles(bucketName, []db.ManifestFile{*manifest.Archive})
+		if err != nil {
+			return nil, err
+		}
+		signed.Archive = &archive[0]
+	}
+	return &signed, nil
+}
+
+// signFiles returns copies of files with download links.
+func (a *APIController) signFiles(bucketName string, files []db.ManifestFile) ([]db.ManifestFile, error) {
+	signed := make([]db.ManifestFile, len(files))
+	for i, file := range files {
+		url, err := a.Storage.DownloadURL(bucketName, file.Key, a.Config.DownloadExpiry)
+		if err != nil {
+			return nil, err
+		}
+		file.URL = url
+		signed[i] = file
+	}
+	return signed, nil
+}
+
+// writeEvent writes a single Server-Sent Event, and flushes it to the client.
+func writeEvent(w gin.ResponseWriter, event *events.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	if err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
+// abortWithError stops the request and responds with an error message.
+func abortWithError(c *gin.Context, status int, err error) {
+	logger.Error(err)
+	c.JSON(status, gin.H{"error": err.Error()})
+	c.Abort()
 }
@@ -1,27 +1,46 @@
 package api
 
 import (
-	"github.com/cjduffett/stork/awsutil"
-	"github.com/cjduffett/stork/db"
+	"github.com/cjduffett/stork/lifecycle"
+	"github.com/cjduffett/stork/storage"
 	"github.com/gin-gonic/gin"
 )
 
 // RegisterRoutes registers all Stork API routes. All API routes are served from /stork/api.
-func RegisterRoutes(router *gin.Engine, dal *db.DataAccessLayer, awsClient *awsutil.AWSClient) {
+// Every route except the Synthea callbacks and downloads requires the authenticate middleware to pass.
+func RegisterRoutes(router *gin.Engine, manager *lifecycle.Manager, authenticate gin.HandlerFunc) {
 
-	apic := NewAPIController(dal, awsClient)
+	apic := NewAPIController(manager)
+
+	// Synthea ONLY endpoints, authenticated with per-instance tokens instead
+	router.POST("/task/:id/done", apic.SyntheaInstanceDone)
+	router.POST("/task/:id/progress", apic.SyntheaInstanceProgress)
+
+	// Downloads from the fs storage, authenticated with signed links instead
+	router.GET(storage.DownloadEndpoint+"/:namespace/*key", apic.Download)
+
+	// API keys can only be created by admins
+	router.POST("/apikey", authenticate, apic.CreateAPIKey)
+
+	// Estimates take the same body as new tasks, but don't create one
+	router.POST("/estimate", authenticate, apic.EstimateTask)
+
+	// Quotas can only be set by admins
+	router.GET("/quota", authenticate, apic.GetQuota)
+	router.PUT("/quota/:user", authenticate, apic.SetQuota)
 
 	// All task routes
-	taskGroup := router.Group("/task")
+	taskGroup := router.Group("/task", authenticate)
 	taskGroup.POST("", apic.CreateTask)
 	taskGroup.GET("", apic.GetTasks)
 
 	// Specific task item
 	taskItem := taskGroup.Group("/:id")
 	taskItem.GET("", apic.GetTaskStatus)
+	taskItem.GET("/files", apic.GetTaskFiles)
+	taskItem.GET("/events", apic.StreamTaskEvents)
+	taskItem.GET("/webhooks", apic.GetTaskWebhooks)
 	taskItem.DELETE("", apic.DeleteTask)
 	taskItem.POST("/abort", apic.AbortTask)
-
-	// Synthea ONLY endpoint
-	taskItem.POST("/done", apic.SyntheaInstanceDone)
+	taskItem.POST("/rerun", apic.RerunTask)
 }
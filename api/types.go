@@ -0,0 +1,480 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/db"
+	"github.com/cjduffett/stork/planner"
+	"github.com/cjduffett/stork/quota"
+	"github.com/cjduffett/stork/webhook"
+)
+
+// TaskRequest is the JSON body of a CreateTask request.
+type TaskRequest struct {
+	Population   int      `json:"population"`
+	Instances    int      `json:"instances"`
+	InstanceType string   `json:"instanceType"`
+	Notify       []string `json:"notify"`
+
+	// How to export the patients, one spec per format. A format may be
+	// given by name alone, to export it with the default options.
+	Formats []db.ExportSpec `json:"formats"`
+
+	// The options to run Synthea with. A seed of 0 means a random seed
+	// is picked, which is returned with the task.
+	Synthea db.SyntheaOptions `json:"synthea"`
+
+	// Status changes are POSTed to the callback URL, signed with the secret
+	CallbackURL    string `json:"callbackUrl"`
+	CallbackSecret string `json:"callbackSecret"`
+
+	// How failed shards are retried. If not set, config.DefaultMaxAttempts
+	// and config.DefaultRetryBackoff are used.
+	Retry *db.RetryPolicy `json:"retry"`
+
+	// Whether to run on spot instances. If not set, config.SyntheaSpot is used.
+	Spot *bool `json:"spot"`
+
+	// Higher priority tasks are started first when tasks are queued, if
+	// config.SchedulerOrder is "priority"
+	Priority int `json:"priority"`
+
+	// Custom Synthea modules, uploaded as files alongside the JSON body
+	// (see APIController.taskRequest)
+	CustomModules []ModuleUpload `json:"-"`
+}
+
+// ModuleUpload is a custom Synthea module uploaded with a TaskRequest.
+type ModuleUpload struct {
+	Filename string
+	Content  []byte
+}
+
+// MaxPriority is the highest priority a task can have.
+const MaxPriority = 10
+
+// InstanceDoneRequest is the JSON body a Synthea instance sends
+// when it's done generating patients.
+type InstanceDoneRequest struct {
+	PatientsGenerated int `json:"patients_generated"`
+}
+
+// InstanceProgressRequest is the JSON body a Synthea instance sends
+// periodically while it's generating patients.
+type InstanceProgressRequest struct {
+	PatientsGenerated int    `json:"patients_generated"`
+	Phase             string `json:"phase"`
+}
+
+// TaskStatusResponse is the JSON body returned by GetTaskStatus.
+type TaskStatusResponse struct {
+	*db.Task
+	ElapsedTime      string `json:"elapsedTime"`
+	RunningInstances int    `json:"runningInstances"`
+	FilesURL         string `json:"filesUrl,omitempty"`
+	QueuePosition    int    `json:"queuePosition,omitempty"`
+}
+
+// TaskEstimateResponse is the JSON body returned by EstimateTask.
+type TaskEstimateResponse struct {
+	*planner.Estimate
+	Duration        string `json:"duration"`
+	DurationSeconds int64  `json:"durationSeconds"`
+}
+
+// TaskFilesResponse is the JSON body returned by GetTaskFiles.
+type TaskFilesResponse struct {
+	*db.Manifest
+	Expires time.Time `json:"expires"`
+}
+
+// QuotaRequest is the JSON body of a SetQuota request. A limit of 0
+// is unlimited.
+type QuotaRequest struct {
+	MaxActiveTasks      int   `json:"maxActiveTasks"`
+	MaxInstances        int   `json:"maxInstances"`
+	MaxPatientsPerMonth int   `json:"maxPatientsPerMonth"`
+	MaxStorageBytes     int64 `json:"maxStorageBytes"`
+}
+
+// QuotaResponse is the JSON body returned by GetQuota. Monthly limits are
+// counted from MonthStart.
+type QuotaResponse struct {
+	User       string                `json:"user"`
+	Limits     map[string]quota.Line `json:"limits"`
+	MonthStart time.Time             `json:"monthStart"`
+}
+
+// QuotaErrorResponse is the JSON body returned when a task is rejected
+// because it would put the user over their quota.
+type QuotaErrorResponse struct {
+	Error   string       `json:"error"`
+	Details *quota.Error `json:"quota"`
+}
+
+// APIKeyRequest is the JSON body of a CreateAPIKey request.
+type APIKeyRequest struct {
+	User  string `json:"user"`
+	Role  string `json:"role"`
+	Email string `json:"email"`
+}
+
+// APIKeyResponse is the JSON body returned by CreateAPIKey. This is the
+// only time the key itself is ever returned.
+type APIKeyResponse struct {
+	Key   string `json:"key"`
+	User  string `json:"user"`
+	Role  string `json:"role"`
+	Email string `json:"email,omitempty"`
+}
+
+// Validate checks that a TaskRequest can be fulfilled with the current
+// Stork configuration. Instances is the maximum number of instances to
+// use, since the population is sharded so that each instance generates
+// at least config.MinPopulationSize patients. Email addresses in Notify
+// are reduced to the bare address, without any display name.
+func (t *TaskRequest) Validate(config *config.StorkConfig) error {
+	if t.Population < config.MinPopulationSize {
+		return fmt.Errorf("population must be at least %d", config.MinPopulationSize)
+	}
+
+	if t.Instances < 1 {
+		return errors.New("at least 1 instance is required")
+	}
+
+	if _, ok := config.GetInstanceType(t.InstanceType); !ok {
+		return fmt.Errorf("unsupported instance type %s", t.InstanceType)
+	}
+
+	if len(t.Formats) == 0 {
+		return errors.New("at least 1 format is required")
+	}
+
+	formats := []string{}
+	for i := range t.Formats {
+		spec := &t.Formats[i]
+		if contains(formats, spec.Format) {
+			return fmt.Errorf("format %s is given more than once", spec.Format)
+		}
+		formats = append(formats, spec.Format)
+
+		err := validateExportSpec(spec)
+		if err != nil {
+			return err
+		}
+	}
+
+	// SMTP only takes bare addresses as recipients
+	for i, address := range t.Notify {
+		addr, err := mail.ParseAddress(address)
+		if err != nil {
+			return fmt.Errorf("invalid email address %s", address)
+		}
+		t.Notify[i] = addr.Address
+	}
+
+	err := validateSyntheaOptions(&t.Synthea)
+	if err != nil {
+		return err
+	}
+
+	err = validateCustomModules(t.CustomModules)
+	if err != nil {
+		return err
+	}
+
+	if t.Priority < 0 || t.Priority > MaxPriority {
+		return fmt.Errorf("priority must be between 0 and %d", MaxPriority)
+	}
+
+	if t.Retry != nil {
+		if t.Retry.MaxAttempts < 1 || t.Retry.MaxAttempts > config.MaxAttemptsLimit {
+			return fmt.Errorf("max attempts must be between 1 and %d", config.MaxAttemptsLimit)
+		}
+		if t.Retry.BackoffSeconds < 0 {
+			return errors.New("backoff must not be negative")
+		}
+	}
+
+	if t.CallbackURL != "" {
+		u, err := url.Parse(t.CallbackURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid callback URL %s", t.CallbackURL)
+		}
+		if !config.WebhookAllowPrivate {
+			err = webhook.CheckURL(t.CallbackURL)
+			if err != nil {
+				return fmt.Errorf("invalid callback URL %s: %s", t.CallbackURL, err)
+			}
+		}
+		if t.CallbackSecret == "" {
+			return errors.New("a callback secret is required to sign events")
+		}
+	}
+	return nil
+}
+
+// The limits of the Synthea options a task can set
+const (
+	maxAge            = 140
+	maxYearsOfHistory = 100
+)
+
+// The date format of SyntheaOptions.ReferenceDate
+const referenceDateFormat = "2006-01-02"
+
+// Synthea module names are lower case paths, like "heart/chf"
+var moduleName = regexp.MustCompile(`^[a-z0-9_]+(/[a-z0-9_]+)*$`)
+
+// usStates lists every state Synthea can generate patients in.
+var usStates = []string{
+	"Alabama", "Alaska", "Arizona", "Arkansas", "California", "Colorado",
+	"Connecticut", "Delaware", "District of Columbia", "Florida", "Georgia",
+	"Hawaii", "Idaho", "Illinois", "Indiana", "Iowa", "Kansas", "Kentucky",
+	"Louisiana", "Maine", "Maryland", "Massachusetts", "Michigan", "Minnesota",
+	"Mississippi", "Missouri", "Montana", "Nebraska", "Nevada", "New Hampshire",
+	"New Jersey", "New Mexico", "New York", "North Carolina", "North Dakota",
+	"Ohio", "Oklahoma", "Oregon", "Pennsylvania", "Rhode Island",
+	"South Carolina", "South Dakota", "Tennessee", "Texas", "Utah", "Vermont",
+	"Virginia", "Washington", "West Virginia", "Wisconsin", "Wyoming",
+}
+
+// validateSyntheaOptions checks that Synthea can be run with the options
+// of a TaskRequest.
+func validateSyntheaOptions(o *db.SyntheaOptions) error {
+	if o.State != "" && !contains(usStates, o.State) {
+		return fmt.Errorf("unknown state %s", o.State)
+	}
+	if o.City != "" && o.State == "" {
+		return errors.New("a city requires a state")
+	}
+
+	if o.MinAge < 0 || o.MaxAge < 0 || o.MinAge > maxAge || o.MaxAge > maxAge {
+		return fmt.Errorf("ages must be between 0 and %d", maxAge)
+	}
+	if o.MaxAge > 0 && o.MinAge > o.MaxAge {
+		return errors.New("the minimum age must not be more than the maximum age")
+	}
+
+	if o.Gender != "" && o.Gender != "M" && o.Gender != "F" {
+		return fmt.Errorf("unknown gender %s, must be M or F", o.Gender)
+	}
+
+	for _, modules := range [][]string{o.Modules, o.ExcludeModules} {
+		for _, module := range modules {
+			if !moduleName.MatchString(module) {
+				return fmt.Errorf("invalid module name %s", module)
+			}
+		}
+	}
+	for _, module := range o.Modules {
+		if contains(o.ExcludeModules, module) {
+			return fmt.Errorf("module %s can't be both included and excluded", module)
+		}
+	}
+
+	if o.YearsOfHistory < 0 || o.YearsOfHistory > maxYearsOfHistory {
+		return fmt.Errorf("years of history must be between 0 and %d", maxYearsOfHistory)
+	}
+
+	if o.ReferenceDate != "" {
+		date, err := time.Parse(referenceDateFormat, o.ReferenceDate)
+		if err != nil {
+			return fmt.Errorf("invalid reference date %s, must be YYYY-MM-DD", o.ReferenceDate)
+		}
+		if date.After(time.Now()) {
+			return errors.New("the reference date must not be in the future")
+		}
+	}
+	return nil
+}
+
+// csvTables lists every table Synthea can export as CSV.
+var csvTables = []string{
+	"allergies", "careplans", "claims", "claims_transactions", "conditions",
+	"devices", "encounters", "imaging_studies", "immunizations", "medications",
+	"observations", "organizations", "patients", "payer_transitions", "payers",
+	"procedures", "providers", "supplies",
+}
+
+// The CSV tables of hospitals and practitioners
+var csvProviderTables = []string{"organizations", "providers"}
+
+// CSV column names are the headers of Synthea's CSV files, like "BIRTHDATE"
+var csvColumn = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// validateExportSpec checks that Synthea can export a format with the
+// options of an export spec, and that every option applies to the format.
+func validateExportSpec(spec *db.ExportSpec) error {
+	if !db.IsValidFormat(spec.Format) {
+		return fmt.Errorf("unknown format %s", spec.Format)
+	}
+
+	if spec.Format != db.FormatFHIR && (spec.FHIRVersion != "" || spec.FHIRLayout != "") {
+		return fmt.Errorf("a FHIR version and layout can't be set for format %s", spec.Format)
+	}
+	if spec.FHIRVersion != "" && spec.FHIRVersion != db.FHIRVersionSTU3 && spec.FHIRVersion != db.FHIRVersionR4 {
+		return fmt.Errorf("unknown FHIR version %s, must be %s or %s", spec.FHIRVersion, db.FHIRVersionSTU3, db.FHIRVersionR4)
+	}
+	if spec.FHIRLayout != "" && spec.FHIRLayout != db.FHIRLayoutBundle && spec.FHIRLayout != db.FHIRLayoutBulk {
+		return fmt.Errorf("unknown FHIR layout %s, must be %s or %s", spec.FHIRLayout, db.FHIRLayoutBundle, db.FHIRLayoutBulk)
+	}
+
+	if spec.Format != db.FormatCSV && len(spec.CSVColumns) > 0 {
+		return fmt.Errorf("CSV columns can't be set for format %s", spec.Format)
+	}
+	for table, columns := range spec.CSVColumns {
+		if !contains(csvTables, table) {
+			return fmt.Errorf("unknown CSV table %s", table)
+		}
+		if spec.ExcludeProviders && contains(csvProviderTables, table) {
+			return fmt.Errorf("CSV table %s is excluded with the providers", table)
+		}
+		if len(columns) == 0 {
+			return fmt.Errorf("at least 1 column of CSV table %s is required", table)
+		}
+		for i, column := range columns {
+			if !csvColumn.MatchString(column) {
+				return fmt.Errorf("invalid column %s of CSV table %s", column, table)
+			}
+			if contains(columns[:i], column) {
+				return fmt.Errorf("column %s of CSV table %s is given more than once", column, table)
+			}
+		}
+	}
+
+	if spec.ExcludeProviders && spec.Format != db.FormatFHIR && spec.Format != db.FormatCSV {
+		return fmt.Errorf("providers can't be excluded from format %s", spec.Format)
+	}
+	return nil
+}
+
+// The limits of the custom modules a task can upload
+const (
+	maxCustomModules    = 20
+	maxCustomModuleSize = 1 << 20
+)
+
+// customModule is the part of a Synthea module's JSON that's validated. A
+// module is a state machine, starting from the "Initial" state.
+type customModule struct {
+	Name   string                       `json:"name"`
+	States map[string]customModuleState `json:"states"`
+}
+
+// customModuleState is a single state of a customModule, with whichever
+// kind of transition it has. Complex transitions may pick from a
+// distribution instead of naming a single state.
+type customModuleState struct {
+	Type                  string                   `json:"type"`
+	DirectTransition      string                   `json:"direct_transition"`
+	DistributedTransition []customModuleTransition `json:"distributed_transition"`
+	ConditionalTransition []customModuleTransition `json:"conditional_transition"`
+	ComplexTransition     []customModuleTransition `json:"complex_transition"`
+}
+
+// customModuleTransition is one option of a transition that can lead to
+// more than one state.
+type customModuleTransition struct {
+	Transition    string                   `json:"transition"`
+	Distributions []customModuleTransition `json:"distributions"`
+}
+
+// validateCustomModules checks that the custom modules of a TaskRequest
+// are well formed Synthea modules, with unique file names. Only the
+// structure of each module is checked, not what its states do.
+func validateCustomModules(uploads []ModuleUpload) error {
+	if len(uploads) > maxCustomModules {
+		return fmt.Errorf("at most %d custom modules can be uploaded", maxCustomModules)
+	}
+
+	filenames := []string{}
+	for _, upload := range uploads {
+		name := strings.TrimSuffix(upload.Filename, ".json")
+		if name == upload.Filename || !moduleName.MatchString(name) {
+			return fmt.Errorf("invalid custom module file name %s, must be a module name ending in .json", upload.Filename)
+		}
+		if contains(filenames, upload.Filename) {
+			return fmt.Errorf("custom module %s was uploaded more than once", upload.Filename)
+		}
+		filenames = append(filenames, upload.Filename)
+
+		if len(upload.Content) > maxCustomModuleSize {
+			return fmt.Errorf("custom module %s is larger than %d bytes", upload.Filename, maxCustomModuleSize)
+		}
+
+		err := validateCustomModule(upload.Content)
+		if err != nil {
+			return fmt.Errorf("invalid custom module %s: %s", upload.Filename, err)
+		}
+	}
+	return nil
+}
+
+// validateCustomModule checks the structure of a single Synthea module:
+// it's named, starts from an Initial state, every state has a type, and
+// every transition leads to a state of the module.
+func validateCustomModule(content []byte) error {
+	module := customModule{}
+	err := json.Unmarshal(content, &module)
+	if err != nil {
+		return err
+	}
+
+	if module.Name == "" {
+		return errors.New("a name is required")
+	}
+	if initial, ok := module.States["Initial"]; !ok || initial.Type != "Initial" {
+		return errors.New("an Initial state is required")
+	}
+
+	for name, state := range module.States {
+		if state.Type == "" {
+			return fmt.Errorf("state %s has no type", name)
+		}
+
+		targets := []string{}
+		if state.DirectTransition != "" {
+			targets = append(targets, state.DirectTransition)
+		}
+		for _, transitions := range [][]customModuleTransition{state.DistributedTransition, state.ConditionalTransition, state.ComplexTransition} {
+			targets = appendTransitionTargets(targets, transitions)
+		}
+
+		for _, target := range targets {
+			if _, ok := module.States[target]; !ok {
+				return fmt.Errorf("state %s transitions to unknown state %s", name, target)
+			}
+		}
+	}
+	return nil
+}
+
+// appendTransitionTargets appends the states a list of transitions lead to.
+func appendTransitionTargets(targets []string, transitions []customModuleTransition) []string {
+	for _, transition := range transitions {
+		if transition.Transition != "" {
+			targets = append(targets, transition.Transition)
+		}
+		targets = appendTransitionTargets(targets, transition.Distributions)
+	}
+	return targets
+}
+
+// contains returns true if values contains value.
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,274 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/db"
+	"github.com/stretchr/testify/suite"
+)
+
+type TypesTestSuite struct {
+	suite.Suite
+}
+
+func TestTypesTestSuite(t *testing.T) {
+	suite.Run(t, new(TypesTestSuite))
+}
+
+func (t *TypesTestSuite) TestValidateTaskRequest() {
+	sConfig := config.DefaultConfig
+
+	// First, make sure a valid request passes
+	req := &TaskRequest{
+		Population: sConfig.MinPopulationSize * 2,
+		Instances:  2,
+		Formats:    []db.ExportSpec{db.ExportSpec{Format: "FHIR"}, db.ExportSpec{Format: "CSV"}},
+	}
+	t.NoError(req.Validate(sConfig))
+
+	// The population must be at least MinPopulationSize
+	req.Population = sConfig.MinPopulationSize - 1
+	t.Error(req.Validate(sConfig))
+	req.Population = sConfig.MinPopulationSize * 2
+
+	// At least 1 instance is required
+	req.Instances = 0
+	t.Error(req.Validate(sConfig))
+
+	// Only allowed instance types are supported
+	req.Instances = 2
+	req.InstanceType = "x1.32xlarge"
+	t.Error(req.Validate(sConfig))
+
+	req.InstanceType = sConfig.SyntheaInstanceType
+	t.NoError(req.Validate(sConfig))
+	req.InstanceType = "c4.xlarge"
+	t.NoError(req.Validate(sConfig))
+
+	// Unknown formats are rejected
+	req.Formats = []db.ExportSpec{db.ExportSpec{Format: "FHIR"}, db.ExportSpec{Format: "PDF"}}
+	t.Error(req.Validate(sConfig))
+
+	// So is an empty list of formats
+	req.Formats = []db.ExportSpec{}
+	t.Error(req.Validate(sConfig))
+	req.Formats = []db.ExportSpec{db.ExportSpec{Format: "FHIR"}}
+
+	// Email recipients must be valid addresses
+	req.Notify = []string{"jane@example.com", "not an address"}
+	t.Error(req.Validate(sConfig))
+
+	// Display names are dropped, since SMTP only takes bare addresses
+	req.Notify = []string{"jane@example.com", "John <john@example.com>"}
+	t.NoError(req.Validate(sConfig))
+	t.Equal([]string{"jane@example.com", "john@example.com"}, req.Notify)
+}
+
+func (t *TypesTestSuite) TestValidateRetry() {
+	sConfig := config.DefaultConfig
+	req := &TaskRequest{
+		Population: sConfig.MinPopulationSize,
+		Instances:  1,
+		Formats:    []db.ExportSpec{db.ExportSpec{Format: "FHIR"}},
+		Retry:      &db.RetryPolicy{MaxAttempts: 1, BackoffSeconds: 0},
+	}
+	t.NoError(req.Validate(sConfig))
+
+	// At least 1 attempt is required
+	req.Retry.MaxAttempts = 0
+	t.Error(req.Validate(sConfig))
+
+	// But no more than the limit
+	req.Retry.MaxAttempts = sConfig.MaxAttemptsLimit + 1
+	t.Error(req.Validate(sConfig))
+
+	req.Retry.MaxAttempts = sConfig.MaxAttemptsLimit
+	req.Retry.BackoffSeconds = -1
+	t.Error(req.Validate(sConfig))
+}
+
+func (t *TypesTestSuite) TestValidateCallback() {
+	sConfig := config.DefaultConfig
+	req := &TaskRequest{
+		Population:     sConfig.MinPopulationSize,
+		Instances:      1,
+		Formats:        []db.ExportSpec{db.ExportSpec{Format: "FHIR"}},
+		CallbackURL:    "https://example.com/stork",
+		CallbackSecret: "secret",
+	}
+	t.NoError(req.Validate(sConfig))
+
+	// Events can't be signed without a secret
+	req.CallbackSecret = ""
+	t.Error(req.Validate(sConfig))
+	req.CallbackSecret = "secret"
+
+	// Only absolute http(s) URLs are allowed
+	for _, callbackURL := range []string{"/stork", "ftp://example.com/stork", "https://", "::"} {
+		req.CallbackURL = callbackURL
+		t.Error(req.Validate(sConfig), callbackURL)
+	}
+
+	// Internal addresses aren't, unless explicitly allowed
+	req.CallbackURL = "http://169.254.169.254/latest/meta-data/"
+	t.Error(req.Validate(sConfig))
+	allowPrivate := *sConfig
+	allowPrivate.WebhookAllowPrivate = true
+	t.NoError(req.Validate(&allowPrivate))
+}
+
+func (t *TypesTestSuite) TestValidateSyntheaOptions() {
+	sConfig := config.DefaultConfig
+	req := &TaskRequest{
+		Population: sConfig.MinPopulationSize,
+		Instances:  1,
+		Formats:    []db.ExportSpec{db.ExportSpec{Format: "FHIR"}},
+		Synthea: db.SyntheaOptions{
+			State:          "Massachusetts",
+			City:           "Bedford",
+			MinAge:         18,
+			MaxAge:         65,
+			Gender:         "F",
+			Modules:        []string{"diabetes", "heart/chf"},
+			ExcludeModules: []string{"dermatitis"},
+			YearsOfHistory: 20,
+			ReferenceDate:  "2017-01-01",
+			Seed:           42,
+		},
+	}
+	t.NoError(req.Validate(sConfig))
+
+	// Every option is optional
+	req.Synthea = db.SyntheaOptions{}
+	t.NoError(req.Validate(sConfig))
+
+	invalid := []db.SyntheaOptions{
+		db.SyntheaOptions{State: "Atlantis"},
+		db.SyntheaOptions{City: "Bedford"},
+		db.SyntheaOptions{MinAge: -1},
+		db.SyntheaOptions{MinAge: 65, MaxAge: 18},
+		db.SyntheaOptions{MaxAge: 200},
+		db.SyntheaOptions{Gender: "X"},
+		db.SyntheaOptions{Modules: []string{"../etc/passwd"}},
+		db.SyntheaOptions{Modules: []string{"diabetes"}, ExcludeModules: []string{"diabetes"}},
+		db.SyntheaOptions{YearsOfHistory: -1},
+		db.SyntheaOptions{ReferenceDate: "01/01/2017"},
+		db.SyntheaOptions{ReferenceDate: "2999-01-01"},
+	}
+	for _, options := range invalid {
+		req.Synthea = options
+		t.Error(req.Validate(sConfig), "%+v", options)
+	}
+}
+
+func (t *TypesTestSuite) TestValidateCustomModules() {
+	sConfig := config.DefaultConfig
+	module := `{
+		"name": "Custom",
+		"states": {
+			"Initial": {"type": "Initial", "direct_transition": "Onset"},
+			"Onset": {
+				"type": "ConditionOnset",
+				"complex_transition": [
+					{"condition": {}, "transition": "Terminal"},
+					{"distributions": [{"distribution": 1, "transition": "Terminal"}]}
+				]
+			},
+			"Terminal": {"type": "Terminal"}
+		}
+	}`
+	req := &TaskRequest{
+		Population:    sConfig.MinPopulationSize,
+		Instances:     1,
+		Formats:       []db.ExportSpec{db.ExportSpec{Format: "FHIR"}},
+		CustomModules: []ModuleUpload{ModuleUpload{Filename: "custom.json", Content: []byte(module)}},
+	}
+	t.NoError(req.Validate(sConfig))
+
+	// File names must be module names
+	req.CustomModules[0].Filename = "custom.txt"
+	t.Error(req.Validate(sConfig))
+	req.CustomModules[0].Filename = "../custom.json"
+	t.Error(req.Validate(sConfig))
+	req.CustomModules[0].Filename = "custom.json"
+
+	// Each module is uploaded once
+	req.CustomModules = append(req.CustomModules, req.CustomModules[0])
+	t.Error(req.Validate(sConfig))
+	req.CustomModules = req.CustomModules[:1]
+
+	// Modules must be JSON, start from an Initial state, and only
+	// transition to their own states
+	invalid := []string{
+		`not json`,
+		`{"states": {"Initial": {"type": "Initial"}}}`,
+		`{"name": "Custom", "states": {"Start": {"type": "Initial"}}}`,
+		`{"name": "Custom", "states": {"Initial": {"type": "Initial"}, "Untyped": {}}}`,
+		`{"name": "Custom", "states": {"Initial": {"type": "Initial", "direct_transition": "Missing"}}}`,
+		`{"name": "Custom", "states": {"Initial": {"type": "Initial", "distributed_transition": [{"distribution": 1, "transition": "Missing"}]}}}`,
+	}
+	for _, content := range invalid {
+		req.CustomModules[0].Content = []byte(content)
+		t.Error(req.Validate(sConfig), content)
+	}
+
+	// Modules have a size limit
+	req.CustomModules[0].Content = make([]byte, maxCustomModuleSize+1)
+	t.Error(req.Validate(sConfig))
+}
+
+func (t *TypesTestSuite) TestValidateExportSpecs() {
+	sConfig := config.DefaultConfig
+	req := &TaskRequest{
+		Population: sConfig.MinPopulationSize,
+		Instances:  1,
+		Formats: []db.ExportSpec{
+			db.ExportSpec{Format: db.FormatFHIR, FHIRVersion: db.FHIRVersionSTU3, FHIRLayout: db.FHIRLayoutBulk},
+			db.ExportSpec{Format: db.FormatCSV, CSVColumns: map[string][]string{"patients": []string{"Id", "BIRTHDATE"}}},
+			db.ExportSpec{Format: db.FormatHTML},
+		},
+	}
+	t.NoError(req.Validate(sConfig))
+
+	// Each format is given once
+	req.Formats = append(req.Formats, db.ExportSpec{Format: db.FormatHTML})
+	t.Error(req.Validate(sConfig))
+	req.Formats = req.Formats[:3]
+
+	// Only known FHIR versions and layouts
+	req.Formats[0].FHIRVersion = "DSTU2"
+	t.Error(req.Validate(sConfig))
+	req.Formats[0].FHIRVersion = db.FHIRVersionR4
+	req.Formats[0].FHIRLayout = "zip"
+	t.Error(req.Validate(sConfig))
+	req.Formats[0].FHIRLayout = ""
+	t.NoError(req.Validate(sConfig))
+
+	// Only known CSV tables, with valid and distinct columns
+	req.Formats[1].CSVColumns = map[string][]string{"pets": []string{"Id"}}
+	t.Error(req.Validate(sConfig))
+	req.Formats[1].CSVColumns = map[string][]string{"patients": []string{}}
+	t.Error(req.Validate(sConfig))
+	req.Formats[1].CSVColumns = map[string][]string{"patients": []string{"Id", "Id"}}
+	t.Error(req.Validate(sConfig))
+	req.Formats[1].CSVColumns = map[string][]string{"patients": []string{"Id, SSN"}}
+	t.Error(req.Validate(sConfig))
+
+	// Provider tables can't be both excluded and exported
+	req.Formats[1].CSVColumns = map[string][]string{"providers": []string{"Id"}}
+	req.Formats[1].ExcludeProviders = true
+	t.Error(req.Validate(sConfig))
+	req.Formats[1].CSVColumns = nil
+	t.NoError(req.Validate(sConfig))
+
+	// Options must apply to the format
+	req.Formats[2].FHIRVersion = db.FHIRVersionR4
+	t.Error(req.Validate(sConfig))
+	req.Formats[2].FHIRVersion = ""
+	req.Formats[2].CSVColumns = map[string][]string{"patients": []string{"Id"}}
+	t.Error(req.Validate(sConfig))
+	req.Formats[2].CSVColumns = nil
+	req.Formats[2].ExcludeProviders = true
+	t.Error(req.Validate(sConfig))
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/cjduffett/stork/db"
+)
+
+// PrincipalKey is the gin context key an authenticated Principal is stored under.
+const PrincipalKey = "principal"
+
+// Principal is the authenticated user making a request.
+type Principal struct {
+	User  string
+	Role  string
+	Email string
+}
+
+// IsAdmin returns true if the principal can see and change every task.
+func (p *Principal) IsAdmin() bool {
+	return p.Role == db.RoleAdmin
+}
+
+// CanAccess returns true if the principal may see or change a task.
+func (p *Principal) CanAccess(task *db.Task) bool {
+	return p.IsAdmin() || task.User == p.User
+}
+
+// NewAPIKey returns a new random API key. Like instance tokens, API keys
+// are only stored as a hash (see HashToken).
+func NewAPIKey() (string, error) {
+	key := make([]byte, 24)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// BearerToken returns the bearer token from a request's Authorization
+// header, or an empty string if there isn't one.
+func BearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+}
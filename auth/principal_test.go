@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/cjduffett/stork/db"
+	"github.com/stretchr/testify/suite"
+)
+
+type PrincipalTestSuite struct {
+	suite.Suite
+}
+
+func TestPrincipalTestSuite(t *testing.T) {
+	suite.Run(t, new(PrincipalTestSuite))
+}
+
+func (p *PrincipalTestSuite) TestCanAccess() {
+	task := &db.Task{ID: "123abc", User: "bob"}
+
+	bob := &Principal{User: "bob", Role: db.RoleUser}
+	p.True(bob.CanAccess(task))
+	p.False(bob.IsAdmin())
+
+	// Users can't access each other's tasks
+	geoff := &Principal{User: "geoff", Role: db.RoleUser}
+	p.False(geoff.CanAccess(task))
+
+	// But admins can access everything
+	admin := &Principal{User: "admin", Role: db.RoleAdmin}
+	p.True(admin.CanAccess(task))
+	p.True(admin.IsAdmin())
+}
+
+func (p *PrincipalTestSuite) TestBearerToken() {
+	req, err := http.NewRequest("GET", "/task", nil)
+	p.NoError(err)
+	p.Equal("", BearerToken(req))
+
+	req.Header.Set("Authorization", "Basic abc123")
+	p.Equal("", BearerToken(req))
+
+	req.Header.Set("Authorization", "Bearer abc123")
+	p.Equal("abc123", BearerToken(req))
+}
+
+func (p *PrincipalTestSuite) TestNewAPIKey() {
+	key, err := NewAPIKey()
+	p.NoError(err)
+	p.Len(key, 48)
+
+	other, err := NewAPIKey()
+	p.NoError(err)
+	p.NotEqual(key, other)
+}
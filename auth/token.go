@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Instance tokens let a Synthea instance prove that it belongs to a task
+// when it calls back into Stork. Each token is a random nonce for one shard
+// of a task, signed with Stork's callback secret:
+//
+//     <shard>.<nonce>.<signature>
+//
+// Only a hash of each token is stored with the task, so a leaked database
+// can't be used to forge callbacks.
+
+const nonceSize = 16
+
+// NewInstanceToken mints a new token for one shard of a task.
+func NewInstanceToken(secret []byte, taskID string, shard int) (string, error) {
+	nonce := make([]byte, nonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	payload := strconv.Itoa(shard) + "." + hex.EncodeToString(nonce)
+	return payload + "." + sign(secret, taskID, payload), nil
+}
+
+// VerifyInstanceToken checks that a token was minted by Stork for the given
+// task, returning the shard it was minted for. It doesn't check whether the
+// token was already used, that's up to the caller.
+func VerifyInstanceToken(secret []byte, taskID string, token string) (int, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("malformed token")
+	}
+
+	shard, err := strconv.Atoi(parts[0])
+	if err != nil || shard < 0 {
+		return 0, fmt.Errorf("malformed token")
+	}
+
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(sign(secret, taskID, payload))) {
+		return 0, fmt.Errorf("invalid token signature")
+	}
+	return shard, nil
+}
+
+// HashToken returns the hex encoded SHA-256 hash of a token, for storage.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenHashesEqual compares two token hashes in constant time.
+func TokenHashesEqual(a, b string) bool {
+	return hmac.Equal([]byte(a), []byte(b))
+}
+
+// NewSecret returns a new random secret, hex encoded.
+func NewSecret() (string, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// sign returns the hex encoded HMAC-SHA256 of a token payload, bound to a task.
+func sign(secret []byte, taskID string, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(taskID + "." + payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type TokenTestSuite struct {
+	suite.Suite
+}
+
+func TestTokenTestSuite(t *testing.T) {
+	suite.Run(t, new(TokenTestSuite))
+}
+
+func (t *TokenTestSuite) TestInstanceToken() {
+	secret := []byte("secret")
+
+	token, err := NewInstanceToken(secret, "123abc", 2)
+	t.NoError(err)
+
+	// A valid token returns the shard it was minted for
+	shard, err := VerifyInstanceToken(secret, "123abc", token)
+	t.NoError(err)
+	t.Equal(2, shard)
+
+	// Tokens are unique, even for the same shard
+	other, err := NewInstanceToken(secret, "123abc", 2)
+	t.NoError(err)
+	t.NotEqual(token, other)
+	t.NotEqual(HashToken(token), HashToken(other))
+
+	// A token is only valid for the task it was minted for
+	_, err = VerifyInstanceToken(secret, "456def", token)
+	t.Error(err)
+
+	// And only with the secret it was signed with
+	_, err = VerifyInstanceToken([]byte("not the secret"), "123abc", token)
+	t.Error(err)
+
+	// Changing the shard invalidates the signature
+	forged := "3" + strings.TrimPrefix(token, "2")
+	_, err = VerifyInstanceToken(secret, "123abc", forged)
+	t.Error(err)
+
+	// Malformed tokens are rejected
+	_, err = VerifyInstanceToken(secret, "123abc", "")
+	t.Error(err)
+	_, err = VerifyInstanceToken(secret, "123abc", "abc.def")
+	t.Error(err)
+}
+
+func (t *TokenTestSuite) TestHashToken() {
+	t.True(TokenHashesEqual(HashToken("abc"), HashToken("abc")))
+	t.False(TokenHashesEqual(HashToken("abc"), HashToken("abd")))
+	t.Len(HashToken("abc"), 64)
+}
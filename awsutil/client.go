@@ -5,18 +5,25 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
 	"github.com/cjduffett/stork/config"
 	"github.com/cjduffett/stork/db"
 	"github.com/cjduffett/stork/logger"
+	"github.com/cjduffett/stork/storage"
 )
 
 // This file implements a series of utilities that simplify working
@@ -34,12 +41,17 @@ const (
 // AWSClient contains the initialized clients and interfaces
 // needed for Stork to interact with AWS.
 type AWSClient struct {
-	Config  *config.StorkConfig
-	Session *session.Session
-	S3      s3iface.S3API
-	EC2     ec2iface.EC2API
+	Config   *config.StorkConfig
+	Session  *session.Session
+	S3       s3iface.S3API
+	Uploader s3manageriface.UploaderAPI
+	EC2      ec2iface.EC2API
+	region   string
 }
 
+// The AWSClient stores Synthea output in S3
+var _ storage.Storage = (*AWSClient)(nil)
+
 // NewAWSClient returns a pointer to an initialized AWSClient
 func NewAWSClient(config *config.StorkConfig) *AWSClient {
 
@@ -63,27 +75,31 @@ func NewAWSClient(config *config.StorkConfig) *AWSClient {
 
 	// Establish a session with AWS
 	awsSession := session.Must(session.NewSession())
-	region := *awsSession.Config.Region
+	region := aws.StringValue(awsSession.Config.Region)
 	if region == "" {
-		region = "UNKNOWN"
+		logger.Info("Connecting Stork to AWS in region UNKNOWN")
+	} else {
+		logger.Info("Connecting Stork to AWS in region " + region)
 	}
-	logger.Info("Connecting Stork to AWS in region " + region)
 
 	// When debugging, log every request made and its payload
 	if config.Debug {
 		awsSession.Handlers.Send.PushFront(func(r *request.Request) {
 			logger.Debug(fmt.Sprintf(
 				"AWS API: Request: %s/%s, Payload: %s",
-				r.ClientInfo.ServiceName, r.Operation, r.Params,
+				r.ClientInfo.ServiceName, r.Operation.Name, r.Params,
 			))
 		})
 	}
 
+	s3Client := s3.New(awsSession)
 	return &AWSClient{
-		Config:  config,
-		Session: awsSession,
-		S3:      s3.New(awsSession),
-		EC2:     ec2.New(awsSession),
+		Config:   config,
+		Session:  awsSession,
+		S3:       s3Client,
+		Uploader: s3manager.NewUploaderWithClient(s3Client),
+		EC2:      ec2.New(awsSession),
+		region:   region,
 	}
 }
 
@@ -105,14 +121,22 @@ func (s *AWSClient) CreateBucket(name string) error {
 	return nil
 }
 
-// DeleteBucket deletes an existing S3 bucket and its contents, by name
+// DeleteBucket deletes an existing S3 bucket and its contents, by name.
+// S3 refuses to delete a bucket that isn't empty, so every object (and every
+// version of every object, if versioning is on) is deleted first.
 func (s *AWSClient) DeleteBucket(name string) error {
 	logger.Debug("Deleting bucket " + name + " and its contents")
 
+	err := s.emptyBucket(name)
+	if err != nil {
+		logger.Error("Failed to empty bucket " + name)
+		return err
+	}
+
 	params := &s3.DeleteBucketInput{
 		Bucket: aws.String(name),
 	}
-	_, err := s.S3.DeleteBucket(params)
+	_, err = s.S3.DeleteBucket(params)
 
 	if err != nil {
 		logger.Error("Failed to delete bucket " + name)
@@ -123,10 +147,203 @@ func (s *AWSClient) DeleteBucket(name string) error {
 	return nil
 }
 
+// The most objects a single DeleteObjects request can delete
+const deleteObjectsBatchSize = 1000
+
+// emptyBucket deletes every object in a bucket, in batches.
+func (s *AWSClient) emptyBucket(name string) error {
+	versioning, err := s.S3.GetBucketVersioning(&s3.GetBucketVersioningInput{
+		Bucket: aws.String(name),
+	})
+	if err != nil {
+		return err
+	}
+
+	batch := []*s3.ObjectIdentifier{}
+	var deleteErr error
+
+	// Adds an object to the current batch, deleting the batch once it's full.
+	// Returns false if a delete failed, to stop paging.
+	add := func(key, versionID *string) bool {
+		batch = append(batch, &s3.ObjectIdentifier{Key: key, VersionId: versionID})
+		if len(batch) == deleteObjectsBatchSize {
+			deleteErr = s.deleteObjects(name, batch)
+			batch = []*s3.ObjectIdentifier{}
+		}
+		return deleteErr == nil
+	}
+
+	// Once versioning has been enabled (even if it's suspended now) every
+	// version and delete marker must be deleted. Otherwise deleting the
+	// current version of each object is enough.
+	if aws.StringValue(versioning.Status) != "" {
+		logger.Debug("Deleting all object versions in bucket " + name)
+		params := &s3.ListObjectVersionsInput{Bucket: aws.String(name)}
+		err = s.S3.ListObjectVersionsPages(params, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+			for _, version := range page.Versions {
+				if !add(version.Key, version.VersionId) {
+					return false
+				}
+			}
+			for _, marker := range page.DeleteMarkers {
+				if !add(marker.Key, marker.VersionId) {
+					return false
+				}
+			}
+			return true
+		})
+	} else {
+		logger.Debug("Deleting all objects in bucket " + name)
+		params := &s3.ListObjectsV2Input{Bucket: aws.String(name)}
+		err = s.S3.ListObjectsV2Pages(params, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range page.Contents {
+				if !add(object.Key, nil) {
+					return false
+				}
+			}
+			return true
+		})
+	}
+
+	if err != nil {
+		return err
+	}
+	if deleteErr != nil {
+		return deleteErr
+	}
+
+	// Delete whatever is left in the last, partial batch
+	if len(batch) > 0 {
+		return s.deleteObjects(name, batch)
+	}
+	return nil
+}
+
+// deleteObjects deletes a single batch of objects from a bucket.
+func (s *AWSClient) deleteObjects(name string, objects []*s3.ObjectIdentifier) error {
+	logger.Debug(fmt.Sprintf("Deleting %d objects from bucket %s", len(objects), name))
+
+	resp, err := s.S3.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String(name),
+		Delete: &s3.Delete{
+			Objects: objects,
+			Quiet:   aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Failures for individual objects are reported in the response
+	if len(resp.Errors) > 0 {
+		first := resp.Errors[0]
+		return fmt.Errorf(
+			"Failed to delete %d objects from bucket %s, including %s: %s",
+			len(resp.Errors), name, aws.StringValue(first.Key), aws.StringValue(first.Message),
+		)
+	}
+	return nil
+}
+
+// CreateNamespace creates a new S3 bucket for a namespace
+func (s *AWSClient) CreateNamespace(name string) error {
+	return s.CreateBucket(name)
+}
+
+// DeleteNamespace deletes the S3 bucket for a namespace and its contents
+func (s *AWSClient) DeleteNamespace(name string) error {
+	return s.DeleteBucket(name)
+}
+
+// ListObjects lists every object in an S3 bucket. The checksum of each
+// object is its ETag, which is the MD5 of its contents unless it was
+// uploaded in multiple parts.
+func (s *AWSClient) ListObjects(name string) ([]storage.Object, error) {
+	logger.Debug("Listing objects in bucket " + name)
+
+	objects := []storage.Object{}
+	params := &s3.ListObjectsV2Input{
+		Bucket: aws.String(name),
+	}
+	err := s.S3.ListObjectsV2Pages(params, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			objects = append(objects, storage.Object{
+				Key:      aws.StringValue(object.Key),
+				Size:     aws.Int64Value(object.Size),
+				Checksum: strings.Trim(aws.StringValue(object.ETag), `"`),
+			})
+		}
+		return true
+	})
+
+	if err != nil {
+		logger.Error("Failed to list objects in bucket " + name)
+		return nil, err
+	}
+	return objects, nil
+}
+
+// GetObject opens an object in an S3 bucket for reading
+func (s *AWSClient) GetObject(name, key string) (io.ReadCloser, error) {
+	params := &s3.GetObjectInput{
+		Bucket: aws.String(name),
+		Key:    aws.String(key),
+	}
+	resp, err := s.S3.GetObject(params)
+
+	if err != nil {
+		logger.Error("Failed to get " + key + " from bucket " + name)
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// PutObject uploads an object to an S3 bucket. Large objects are uploaded
+// in parts, since a single PUT is limited to 5 GB.
+func (s *AWSClient) PutObject(name, key string, body io.ReadSeeker) error {
+	logger.Debug("Uploading " + key + " to bucket " + name)
+
+	params := &s3manager.UploadInput{
+		Bucket: aws.String(name),
+		Key:    aws.String(key),
+		Body:   body,
+	}
+	_, err := s.Uploader.Upload(params)
+
+	if err != nil {
+		logger.Error("Failed to upload " + key + " to bucket " + name)
+		return err
+	}
+	return nil
+}
+
+// DownloadURL returns a presigned URL for an object in an S3 bucket
+func (s *AWSClient) DownloadURL(name, key string, expires time.Duration) (string, error) {
+	req, _ := s.S3.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(name),
+		Key:    aws.String(key),
+	})
+
+	url, err := req.Presign(expires)
+	if err != nil {
+		logger.Error("Failed to presign " + key + " in bucket " + name)
+		return "", err
+	}
+	return url, nil
+}
+
+// Region returns the AWS region Stork is connected to
+func (s *AWSClient) Region() string {
+	return s.region
+}
+
 // StartInstances starts n new Synthea instances with the same configuration.
 // All instances are expected to share an equal compute load, with a minimum
-// of 500 patients each (this is validated elsewhere).
-func (s *AWSClient) StartInstances(n int64, iConfig *InstanceConfig) ([]string, error) {
+// of 500 patients each (this is validated elsewhere). If the instances were
+// started but could not be tagged, their IDs are still returned alongside the
+// error so the caller can clean them up. With options.Spot, spot instances are
+// requested first, and on-demand instances started if there is no spot capacity.
+func (s *AWSClient) StartInstances(n int64, iConfig *InstanceConfig, options LaunchOptions) ([]string, error) {
 	var err error
 
 	logger.Debug(fmt.Sprintf("Starting %d instances of Synthea for task %s", n, iConfig.TaskID))
@@ -146,10 +363,19 @@ func (s *AWSClient) StartInstances(n int64, iConfig *InstanceConfig) ([]string,
 	// decoded when Synthea requests it from the EC2 instance user data.
 	encodedUserData := b64.StdEncoding.EncodeToString(rawUserData)
 
+	instanceType := options.InstanceType
+	if instanceType == "" {
+		instanceType = s.Config.SyntheaInstanceType
+	}
+	imageID := options.ImageID
+	if imageID == "" {
+		imageID = s.Config.SyntheaImageID
+	}
+
 	// Make a RunInstances request for n Synthea instances
 	runParams := &ec2.RunInstancesInput{
-		ImageId:          aws.String(s.Config.SyntheaImageID),
-		InstanceType:     aws.String(s.Config.SyntheaInstanceType),
+		ImageId:          aws.String(imageID),
+		InstanceType:     aws.String(instanceType),
 		MinCount:         aws.Int64(n),
 		MaxCount:         aws.Int64(n),
 		SecurityGroupIds: []*string{aws.String(s.Config.SyntheaSecurityGroupID)},
@@ -160,7 +386,16 @@ func (s *AWSClient) StartInstances(n int64, iConfig *InstanceConfig) ([]string,
 		SubnetId: aws.String(s.Config.SyntheaSubnetID),
 		UserData: aws.String(encodedUserData),
 	}
+	if options.Spot {
+		runParams.InstanceMarketOptions = s.spotMarketOptions()
+	}
+
 	reservation, err := s.EC2.RunInstances(runParams)
+	if err != nil && options.Spot && isSpotUnavailable(err) {
+		logger.Warning(fmt.Sprintf("No spot capacity for task %s, starting on-demand instances instead: %s", iConfig.TaskID, err))
+		runParams.InstanceMarketOptions = nil
+		reservation, err = s.EC2.RunInstances(runParams)
+	}
 	if err != nil {
 		logger.Error("Failed to start instances for task " + iConfig.TaskID)
 		return nil, err
@@ -195,13 +430,55 @@ func (s *AWSClient) StartInstances(n int64, iConfig *InstanceConfig) ([]string,
 	_, err = s.EC2.CreateTags(tagParams)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Failed to tag instances %v", strInstanceIDs))
-		return nil, err
+		return strInstanceIDs, err
 	}
 	logger.Debug(fmt.Sprintf("Tagged instances %v", strInstanceIDs))
 
 	return strInstanceIDs, nil
 }
 
+// spotMarketOptions requests one-time spot instances that are terminated
+// when interrupted, optionally capped at config.SyntheaSpotMaxPrice. Without
+// a cap, EC2 caps the price at the on-demand price.
+func (s *AWSClient) spotMarketOptions() *ec2.InstanceMarketOptionsRequest {
+	spotOptions := &ec2.SpotMarketOptions{
+		SpotInstanceType:             aws.String(ec2.SpotInstanceTypeOneTime),
+		InstanceInterruptionBehavior: aws.String(ec2.InstanceInterruptionBehaviorTerminate),
+	}
+	if s.Config.SyntheaSpotMaxPrice != "" {
+		spotOptions.MaxPrice = aws.String(s.Config.SyntheaSpotMaxPrice)
+	}
+	return &ec2.InstanceMarketOptionsRequest{
+		MarketType:  aws.String(ec2.MarketTypeSpot),
+		SpotOptions: spotOptions,
+	}
+}
+
+// isSpotUnavailable returns true if a RunInstances request for spot instances
+// failed because no spot capacity is available at the requested price.
+func isSpotUnavailable(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	for _, code := range spotUnavailableCodes {
+		if aerr.Code() == code {
+			return true
+		}
+	}
+	return false
+}
+
+// The error codes returned by RunInstances when spot capacity is unavailable
+var spotUnavailableCodes = []string{
+	"InsufficientInstanceCapacity",
+	"SpotMaxPriceTooLow",
+	"MaxSpotInstanceCountExceeded",
+}
+
+// The state reason of a spot instance that EC2 reclaimed
+const spotInterruptionReason = "Server.SpotInstanceTermination"
+
 // TerminateInstances terminates one or more Synthea instances.
 // This may be called after the /done endpoint is pinged, or if
 // an abort request is made.
@@ -219,37 +496,97 @@ func (s *AWSClient) TerminateInstances(instanceIDs []string) error {
 }
 
 // DescribeInstanceStatus returns the status of one or more Synthea instances.
-// The status returned from ec2.DescribeInstanceStatus is converted to a local
-// representation of status.
+// The status returned from ec2.DescribeInstances is converted to a local
+// representation of status. EC2 rejects the whole request if any instance
+// no longer exists, so when that happens the instances are described one at
+// a time and the missing ones are left out of the result.
 func (s *AWSClient) DescribeInstanceStatus(instanceIDs []string) ([]InstanceStatus, error) {
 	logger.Debug(fmt.Sprintf("Getting status of instances %v", instanceIDs))
-	params := &ec2.DescribeInstanceStatusInput{
-		InstanceIds: toAWSStrings(instanceIDs),
+
+	// An empty list of IDs would describe every instance in the account
+	if len(instanceIDs) == 0 {
+		return []InstanceStatus{}, nil
+	}
+
+	statuses, err := s.describeInstances(instanceIDs)
+	if isInstanceNotFound(err) {
+		statuses = []InstanceStatus{}
+		for _, instanceID := range instanceIDs {
+			status, err := s.describeInstances([]string{instanceID})
+			if isInstanceNotFound(err) {
+				logger.Warning(fmt.Sprintf("Instance %s no longer exists", instanceID))
+				continue
+			}
+			if err != nil {
+				logger.Error(fmt.Sprintf("Failed to get status of instance %s", instanceID))
+				return nil, err
+			}
+			statuses = append(statuses, status...)
+		}
+		return statuses, nil
 	}
-	resp, err := s.EC2.DescribeInstanceStatus(params)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Failed to get status of instances %v", instanceIDs))
 		return nil, err
 	}
+	return statuses, nil
+}
+
+// describeInstances makes a single ec2.DescribeInstances request for the
+// given instances.
+func (s *AWSClient) describeInstances(instanceIDs []string) ([]InstanceStatus, error) {
+	// Instances are described in full rather than with DescribeInstanceStatus,
+	// since only the full description says why an instance was terminated.
+	params := &ec2.DescribeInstancesInput{
+		InstanceIds: toAWSStrings(instanceIDs),
+	}
 
 	// Parse the response into our own internal representation of instance status
-	statuses := make([]InstanceStatus, len(instanceIDs))
-	for i, status := range resp.InstanceStatuses {
-		statuses[i] = InstanceStatus{
-			InstanceID: *status.InstanceId,
-			Status:     convertInstanceStatus(status.InstanceState),
+	statuses := []InstanceStatus{}
+	err := s.EC2.DescribeInstancesPages(params, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				statuses = append(statuses, InstanceStatus{
+					InstanceID:  *instance.InstanceId,
+					Status:      convertInstanceStatus(instance.State),
+					Interrupted: isSpotInterrupted(instance),
+				})
+			}
 		}
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
 	return statuses, nil
 }
 
+// isInstanceNotFound returns true if an EC2 request failed because one of
+// the instances it named doesn't exist (anymore).
+func isInstanceNotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == "InvalidInstanceID.NotFound"
+}
+
+// isSpotInterrupted returns true if an instance is a spot instance that
+// EC2 reclaimed.
+func isSpotInterrupted(instance *ec2.Instance) bool {
+	return aws.StringValue(instance.InstanceLifecycle) == ec2.InstanceLifecycleTypeSpot &&
+		instance.StateReason != nil &&
+		aws.StringValue(instance.StateReason.Code) == spotInterruptionReason
+}
+
 // Converts and AWS instance state to a locally known string value.
-// For our purposes, any instance that isn't terminated is considered active.
+// For our purposes, any instance that is terminated (or about to be) is
+// done, and any instance that was stopped is in error since Synthea
+// instances never stop on their own. Everything else is active.
 func convertInstanceStatus(state *ec2.InstanceState) string {
 	status := ""
 	switch *state.Name {
-	case ec2.InstanceStateNameTerminated:
+	case ec2.InstanceStateNameTerminated, ec2.InstanceStateNameShuttingDown:
 		status = db.InstanceStatusDone
+	case ec2.InstanceStateNameStopping, ec2.InstanceStateNameStopped:
+		status = db.InstanceStatusError
 	default:
 		status = db.InstanceStatusActive
 	}
@@ -1,9 +1,17 @@
 package awsutil
 
 import (
+	"fmt"
+	"io/ioutil"
+	"strings"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
+
 	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/db"
 	"github.com/cjduffett/stork/logger"
 	"github.com/stretchr/testify/suite"
 )
@@ -51,11 +59,254 @@ func (a *AWSUtilsTestSuite) TestDeleteBucket() {
 	a.Error(err)
 }
 
+func (a *AWSUtilsTestSuite) TestDescribePurgedInstances() {
+	client := newMockAWSClient()
+	mock := client.EC2.(*EC2Mock)
+
+	instanceIDs, err := client.StartInstances(3, newInstanceConfig(), LaunchOptions{})
+	a.NoError(err)
+	a.NoError(client.TerminateInstances(instanceIDs[:1]))
+
+	// EC2 rejects a request naming an instance it no longer knows about,
+	// which only leaves that instance out of the result
+	mock.Purge(instanceIDs[0])
+	statuses, err := client.DescribeInstanceStatus(instanceIDs)
+	a.NoError(err)
+	a.Require().Len(statuses, 2)
+	a.Equal(instanceIDs[1], statuses[0].InstanceID)
+	a.Equal(instanceIDs[2], statuses[1].InstanceID)
+
+	// Nothing at all is described without any instances
+	statuses, err = client.DescribeInstanceStatus(instanceIDs[:1])
+	a.NoError(err)
+	a.Empty(statuses)
+	statuses, err = client.DescribeInstanceStatus(nil)
+	a.NoError(err)
+	a.Empty(statuses)
+}
+
+func (a *AWSUtilsTestSuite) TestDeleteBucketWithObjects() {
+	var err error
+	client := newMockAWSClient()
+	s3Mock := client.S3.(*S3Mock)
+	s3Mock.PageSize = 700
+
+	err = client.CreateBucket("test-bucket")
+	a.NoError(err)
+
+	// Add more objects than fit in a single DeleteObjects request
+	putObjects(s3Mock, "test-bucket", 2500)
+	a.Equal(2500, s3Mock.ObjectCount("test-bucket"))
+
+	// Every object should be deleted, in batches of 1000, before the bucket
+	err = client.DeleteBucket("test-bucket")
+	a.NoError(err)
+	a.Equal(3, s3Mock.DeleteObjectsCalls)
+	a.False(s3Mock.hasBucket("test-bucket"))
+}
+
+func (a *AWSUtilsTestSuite) TestDeleteVersionedBucket() {
+	var err error
+	client := newMockAWSClient()
+	s3Mock := client.S3.(*S3Mock)
+
+	err = client.CreateBucket("test-bucket")
+	a.NoError(err)
+
+	_, err = s3Mock.PutBucketVersioning(&s3.PutBucketVersioningInput{
+		Bucket: aws.String("test-bucket"),
+		VersioningConfiguration: &s3.VersioningConfiguration{
+			Status: aws.String(s3.BucketVersioningStatusEnabled),
+		},
+	})
+	a.NoError(err)
+
+	// Overwrite every object once, and delete one of them, leaving
+	// old versions and a delete marker behind
+	putObjects(s3Mock, "test-bucket", 10)
+	putObjects(s3Mock, "test-bucket", 10)
+	_, err = s3Mock.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String("test-bucket"),
+		Delete: &s3.Delete{Objects: []*s3.ObjectIdentifier{{Key: aws.String("object-0")}}},
+	})
+	a.NoError(err)
+	a.Equal(21, s3Mock.ObjectCount("test-bucket"))
+
+	objects, err := client.ListObjects("test-bucket")
+	a.NoError(err)
+	a.Len(objects, 9)
+
+	// All versions and delete markers must go before the bucket can be deleted
+	err = client.DeleteBucket("test-bucket")
+	a.NoError(err)
+	a.False(s3Mock.hasBucket("test-bucket"))
+}
+
+func (a *AWSUtilsTestSuite) TestListObjects() {
+	var err error
+	client := newMockAWSClient()
+	s3Mock := client.S3.(*S3Mock)
+	s3Mock.PageSize = 3
+
+	err = client.CreateBucket("test-bucket")
+	a.NoError(err)
+	putObjects(s3Mock, "test-bucket", 10)
+
+	// All pages should be listed
+	objects, err := client.ListObjects("test-bucket")
+	a.NoError(err)
+	a.Len(objects, 10)
+	a.Equal("object-0", objects[0].Key)
+	a.Equal(int64(100), objects[0].Size)
+	a.NotEmpty(objects[0].Checksum)
+	a.NotContains(objects[0].Checksum, `"`)
+
+	// Listing a bucket that doesn't exist should fail
+	_, err = client.ListObjects("foo-bucket")
+	a.Error(err)
+}
+
+func (a *AWSUtilsTestSuite) TestPutObject() {
+	var err error
+	client := newMockAWSClient()
+
+	err = client.CreateBucket("test-bucket")
+	a.NoError(err)
+
+	err = client.PutObject("test-bucket", "modules/custom.json", strings.NewReader("{}"))
+	a.NoError(err)
+
+	objects, err := client.ListObjects("test-bucket")
+	a.NoError(err)
+	a.Require().Len(objects, 1)
+	a.Equal("modules/custom.json", objects[0].Key)
+	a.Equal(int64(2), objects[0].Size)
+
+	body, err := client.GetObject("test-bucket", "modules/custom.json")
+	a.Require().NoError(err)
+	contents, err := ioutil.ReadAll(body)
+	body.Close()
+	a.NoError(err)
+	a.Equal("{}", string(contents))
+
+	// Uploading to a bucket that doesn't exist should fail, and so should
+	// getting an object that doesn't exist
+	err = client.PutObject("foo-bucket", "modules/custom.json", strings.NewReader("{}"))
+	a.Error(err)
+	_, err = client.GetObject("test-bucket", "modules/missing.json")
+	a.Error(err)
+}
+
+// putObjects adds n objects to a mocked bucket
+func putObjects(s3Mock *S3Mock, bucket string, n int) {
+	for i := 0; i < n; i++ {
+		s3Mock.PutObject(&s3.PutObjectInput{
+			Bucket:        aws.String(bucket),
+			Key:           aws.String(fmt.Sprintf("object-%d", i)),
+			ContentLength: aws.Int64(100),
+		})
+	}
+}
+
+func (a *AWSUtilsTestSuite) TestStartInstances() {
+	client := newMockAWSClient()
+	mock := client.EC2.(*EC2Mock)
+
+	instanceIDs, err := client.StartInstances(2, newInstanceConfig(), LaunchOptions{})
+	a.NoError(err)
+	a.Len(instanceIDs, 2)
+	a.Require().Len(mock.RunRequests, 1)
+	a.Nil(mock.RunRequests[0].InstanceMarketOptions)
+	a.Equal(config.DefaultConfig.SyntheaInstanceType, *mock.RunRequests[0].InstanceType)
+	a.Equal(config.DefaultConfig.SyntheaImageID, *mock.RunRequests[0].ImageId)
+
+	// Tasks can ask for another instance type, and reruns for the image
+	// the original task ran on
+	_, err = client.StartInstances(1, newInstanceConfig(), LaunchOptions{InstanceType: "c4.xlarge", ImageID: "ami-12345678"})
+	a.NoError(err)
+	a.Require().Len(mock.RunRequests, 2)
+	a.Equal("c4.xlarge", *mock.RunRequests[1].InstanceType)
+	a.Equal("ami-12345678", *mock.RunRequests[1].ImageId)
+
+	statuses, err := client.DescribeInstanceStatus(instanceIDs)
+	a.NoError(err)
+	a.Len(statuses, 2)
+	for _, status := range statuses {
+		a.Equal(db.InstanceStatusActive, status.Status)
+		a.False(status.Interrupted)
+	}
+}
+
+func (a *AWSUtilsTestSuite) TestStartSpotInstances() {
+	client := newMockAWSClient()
+	mock := client.EC2.(*EC2Mock)
+
+	sConfig := *config.DefaultConfig
+	sConfig.SyntheaSpotMaxPrice = "0.05"
+	client.Config = &sConfig
+
+	instanceIDs, err := client.StartInstances(1, newInstanceConfig(), LaunchOptions{Spot: true})
+	a.NoError(err)
+	a.Len(instanceIDs, 1)
+	a.Require().Len(mock.RunRequests, 1)
+
+	market := mock.RunRequests[0].InstanceMarketOptions
+	a.Require().NotNil(market)
+	a.Equal(ec2.MarketTypeSpot, *market.MarketType)
+	a.Equal("0.05", *market.SpotOptions.MaxPrice)
+	a.Equal(ec2.InstanceInterruptionBehaviorTerminate, *market.SpotOptions.InstanceInterruptionBehavior)
+
+	// EC2 reclaims the instance
+	mock.Interrupt(instanceIDs[0])
+	statuses, err := client.DescribeInstanceStatus(instanceIDs)
+	a.NoError(err)
+	a.Require().Len(statuses, 1)
+	a.Equal(db.InstanceStatusDone, statuses[0].Status)
+	a.True(statuses[0].Interrupted)
+}
+
+func (a *AWSUtilsTestSuite) TestSpotFallback() {
+	client := newMockAWSClient()
+	mock := client.EC2.(*EC2Mock)
+	mock.SpotUnavailable = true
+
+	// Without spot capacity, on-demand instances are started instead
+	instanceIDs, err := client.StartInstances(1, newInstanceConfig(), LaunchOptions{Spot: true})
+	a.NoError(err)
+	a.Len(instanceIDs, 1)
+	a.Require().Len(mock.RunRequests, 2)
+	a.Nil(mock.RunRequests[1].InstanceMarketOptions)
+
+	// Terminating an on-demand instance isn't an interruption
+	a.NoError(client.TerminateInstances(instanceIDs))
+	statuses, err := client.DescribeInstanceStatus(instanceIDs)
+	a.NoError(err)
+	a.False(statuses[0].Interrupted)
+}
+
+func newInstanceConfig() *InstanceConfig {
+	return &InstanceConfig{
+		TaskID:           "123abc",
+		Population:       config.DefaultConfig.MinPopulationSize,
+		BucketName:       "123abc-bucket",
+		BucketRegion:     "us-east-1",
+		DoneEndpoint:     "https://stork.com/tasks/123abc/done",
+		ProgressEndpoint: "https://stork.com/tasks/123abc/progress",
+		DoneToken:        "0.abc.def",
+		ShardIndex:       0,
+		ShardCount:       1,
+		OutputPrefix:     "shard-0/",
+	}
+}
+
 func newMockAWSClient() *AWSClient {
+	s3Mock := NewS3Mock()
 	return &AWSClient{
-		Config:  config.DefaultConfig,
-		Session: nil,
-		S3:      NewS3Mock(),
-		EC2:     NewEC2Mock(),
+		Config:   config.DefaultConfig,
+		Session:  nil,
+		S3:       s3Mock,
+		Uploader: NewUploaderMock(s3Mock),
+		EC2:      NewEC2Mock(),
+		region:   "us-east-1",
 	}
 }
@@ -1,19 +1,34 @@
 package awsutil
 
-import "github.com/aws/aws-sdk-go/service/ec2/ec2iface"
-import "github.com/aws/aws-sdk-go/service/ec2"
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
 
 // EC2Mock mocks out the AWS EC2 API for testing
 type EC2Mock struct {
 	ec2iface.EC2API
 	instances instanceMap
+	nextID    int
+
+	// When true, requests for spot instances fail for lack of capacity
+	SpotUnavailable bool
+
+	// Every RunInstances request made, in order
+	RunRequests []*ec2.RunInstancesInput
 }
 
 type instanceMock struct {
-	state string
+	state     string
+	lifecycle string
+	reason    string
 }
 
-type instanceMap map[string]instanceMock
+type instanceMap map[string]*instanceMock
 
 // NewEC2Mock returns a pointer to an initialized EC2 mock
 func NewEC2Mock() *EC2Mock {
@@ -21,11 +36,31 @@ func NewEC2Mock() *EC2Mock {
 }
 
 // RunInstances mocks the ec2.runInstances operation
-func (e *EC2Mock) RunInstances(*ec2.RunInstancesInput) (*ec2.Reservation, error) {
+func (e *EC2Mock) RunInstances(input *ec2.RunInstancesInput) (*ec2.Reservation, error) {
 	// expected input includes:
 	// ImageId, InstanceType, MinCount, MaxCount, SecurityGroupIds, SubnetId,
-	// IamInstanceProfile, UserData (optional)
-	return &ec2.Reservation{}, nil
+	// IamInstanceProfile, UserData (optional), InstanceMarketOptions (optional)
+	e.RunRequests = append(e.RunRequests, input)
+
+	lifecycle := ""
+	if input.InstanceMarketOptions != nil {
+		if e.SpotUnavailable {
+			return nil, awserr.New("InsufficientInstanceCapacity", "There is no Spot capacity available", nil)
+		}
+		lifecycle = ec2.InstanceLifecycleTypeSpot
+	}
+
+	reservation := &ec2.Reservation{}
+	for i := int64(0); i < aws.Int64Value(input.MaxCount); i++ {
+		e.nextID++
+		instanceID := fmt.Sprintf("i-%08d", e.nextID)
+		e.instances[instanceID] = &instanceMock{
+			state:     ec2.InstanceStateNameRunning,
+			lifecycle: lifecycle,
+		}
+		reservation.Instances = append(reservation.Instances, &ec2.Instance{InstanceId: aws.String(instanceID)})
+	}
+	return reservation, nil
 }
 
 // CreateTags mocks the ec2.createTags operation
@@ -34,11 +69,52 @@ func (e *EC2Mock) CreateTags(*ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error
 }
 
 // TerminateInstances mocks the ec2.terminateInstances operation
-func (e *EC2Mock) TerminateInstances(*ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+func (e *EC2Mock) TerminateInstances(input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+	for _, instanceID := range input.InstanceIds {
+		if instance, ok := e.instances[*instanceID]; ok {
+			instance.state = ec2.InstanceStateNameTerminated
+			instance.reason = "Client.UserInitiatedShutdown"
+		}
+	}
 	return &ec2.TerminateInstancesOutput{}, nil
 }
 
-// DescribeInstanceStatus mocks the ec2.describeInstanceStatus operation
-func (e *EC2Mock) DescribeInstanceStatus(*ec2.DescribeInstanceStatusInput) (*ec2.DescribeInstanceStatusOutput, error) {
-	return &ec2.DescribeInstanceStatusOutput{}, nil
+// DescribeInstancesPages mocks the ec2.describeInstances operation,
+// returning every requested instance on a single page
+func (e *EC2Mock) DescribeInstancesPages(input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool) error {
+	reservation := &ec2.Reservation{}
+	for _, instanceID := range input.InstanceIds {
+		instance, ok := e.instances[*instanceID]
+		if !ok {
+			return awserr.New("InvalidInstanceID.NotFound", "The instance ID '"+*instanceID+"' does not exist", nil)
+		}
+
+		described := &ec2.Instance{
+			InstanceId: instanceID,
+			State:      &ec2.InstanceState{Name: aws.String(instance.state)},
+		}
+		if instance.lifecycle != "" {
+			described.InstanceLifecycle = aws.String(instance.lifecycle)
+		}
+		if instance.reason != "" {
+			described.StateReason = &ec2.StateReason{Code: aws.String(instance.reason)}
+		}
+		reservation.Instances = append(reservation.Instances, described)
+	}
+
+	fn(&ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{reservation}}, true)
+	return nil
+}
+
+// Interrupt terminates a spot instance the way EC2 does when it reclaims it
+func (e *EC2Mock) Interrupt(instanceID string) {
+	instance := e.instances[instanceID]
+	instance.state = ec2.InstanceStateNameTerminated
+	instance.reason = spotInterruptionReason
+}
+
+// Purge forgets an instance entirely, the way EC2 does some time after an
+// instance is terminated
+func (e *EC2Mock) Purge(instanceID string) {
+	delete(e.instances, instanceID)
 }
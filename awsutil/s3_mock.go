@@ -1,24 +1,57 @@
 package awsutil
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
 )
 
 // S3Mock mocks out the AWS S3 API for testing
 type S3Mock struct {
 	s3iface.S3API
 	buckets bucketMap
+
+	// The most keys returned in a single page of a listing
+	PageSize int
+
+	// The number of DeleteObjects requests made
+	DeleteObjectsCalls int
+}
+
+type bucketMock struct {
+	versioning string
+	objects    objectMap
+	nextID     int
 }
 
-type bucketMap map[string]bool
+// objectMock is a single version of an object. Without versioning,
+// every object has exactly one version, with the ID "null".
+type objectMock struct {
+	versionID    string
+	size         int64
+	body         []byte
+	deleteMarker bool
+}
+
+type bucketMap map[string]*bucketMock
+
+// objectMap maps an object's key to its versions, oldest first
+type objectMap map[string][]objectMock
 
 // NewS3Mock returns a pointer to an initialized S3 mock
 func NewS3Mock() *S3Mock {
-	return &S3Mock{buckets: make(bucketMap)}
+	return &S3Mock{
+		buckets:  make(bucketMap),
+		PageSize: 1000,
+	}
 }
 
 // CreateBucket mocks the s3.createBucket operation
@@ -39,6 +72,11 @@ func (s *S3Mock) CreateBucket(in *s3.CreateBucketInput) (*s3.CreateBucketOutput,
 // DeleteBucket mocks the s3.deleteBucket operation
 func (s *S3Mock) DeleteBucket(in *s3.DeleteBucketInput) (*s3.DeleteBucketOutput, error) {
 
+	// Like S3, refuse to delete a bucket that isn't empty
+	if s.hasBucket(*in.Bucket) && len(s.buckets[*in.Bucket].objects) > 0 {
+		return nil, errors.New("BucketNotEmpty")
+	}
+
 	// Remove it from the list of known buckets, if it exists
 	err := s.removeBucket(*in.Bucket)
 	if err != nil {
@@ -47,6 +85,258 @@ func (s *S3Mock) DeleteBucket(in *s3.DeleteBucketInput) (*s3.DeleteBucketOutput,
 	return &s3.DeleteBucketOutput{}, nil
 }
 
+// PutBucketVersioning mocks the s3.putBucketVersioning operation
+func (s *S3Mock) PutBucketVersioning(in *s3.PutBucketVersioningInput) (*s3.PutBucketVersioningOutput, error) {
+	if !s.hasBucket(*in.Bucket) {
+		return nil, errors.New(s3.ErrCodeNoSuchBucket)
+	}
+	s.buckets[*in.Bucket].versioning = aws.StringValue(in.VersioningConfiguration.Status)
+	return &s3.PutBucketVersioningOutput{}, nil
+}
+
+// GetBucketVersioning mocks the s3.getBucketVersioning operation
+func (s *S3Mock) GetBucketVersioning(in *s3.GetBucketVersioningInput) (*s3.GetBucketVersioningOutput, error) {
+	if !s.hasBucket(*in.Bucket) {
+		return nil, errors.New(s3.ErrCodeNoSuchBucket)
+	}
+
+	out := &s3.GetBucketVersioningOutput{}
+	if versioning := s.buckets[*in.Bucket].versioning; versioning != "" {
+		out.Status = aws.String(versioning)
+	}
+	return out, nil
+}
+
+// PutObject mocks the s3.putObject operation. The object's body is kept if
+// there is one, otherwise its size is taken from ContentLength.
+func (s *S3Mock) PutObject(in *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	if !s.hasBucket(*in.Bucket) {
+		return nil, errors.New(s3.ErrCodeNoSuchBucket)
+	}
+	bucket := s.buckets[*in.Bucket]
+
+	version := objectMock{versionID: "null", size: aws.Int64Value(in.ContentLength)}
+	if in.Body != nil {
+		body, err := ioutil.ReadAll(in.Body)
+		if err != nil {
+			return nil, err
+		}
+		version.body = body
+		version.size = int64(len(body))
+	}
+	if bucket.versioning == s3.BucketVersioningStatusEnabled {
+		version.versionID = bucket.newVersionID()
+		bucket.objects[*in.Key] = append(bucket.objects[*in.Key], version)
+	} else {
+		bucket.objects[*in.Key] = []objectMock{version}
+	}
+
+	return &s3.PutObjectOutput{VersionId: aws.String(version.versionID)}, nil
+}
+
+// UploaderMock mocks out the s3manager Uploader, uploading every object
+// to an S3Mock with a single PutObject
+type UploaderMock struct {
+	s3manageriface.UploaderAPI
+	S3 *S3Mock
+}
+
+// NewUploaderMock returns a pointer to an UploaderMock for an S3 mock
+func NewUploaderMock(s3Mock *S3Mock) *UploaderMock {
+	return &UploaderMock{S3: s3Mock}
+}
+
+// Upload mocks the s3manager.Uploader.Upload operation
+func (u *UploaderMock) Upload(in *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	body, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := u.S3.PutObject(&s3.PutObjectInput{
+		Bucket: in.Bucket,
+		Key:    in.Key,
+		Body:   bytes.NewReader(body),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3manager.UploadOutput{VersionID: out.VersionId}, nil
+}
+
+// GetObject mocks the s3.getObject operation, returning the latest
+// version of an object.
+func (s *S3Mock) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	if !s.hasBucket(*in.Bucket) {
+		return nil, errors.New(s3.ErrCodeNoSuchBucket)
+	}
+
+	versions := s.buckets[*in.Bucket].objects[*in.Key]
+	if len(versions) == 0 || versions[len(versions)-1].deleteMarker {
+		return nil, errors.New(s3.ErrCodeNoSuchKey)
+	}
+	latest := versions[len(versions)-1]
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(bytes.NewReader(latest.body)),
+		ContentLength: aws.Int64(latest.size),
+	}, nil
+}
+
+// ListObjectsV2Pages mocks the s3.listObjectsV2 operation, returning
+// keys in order, PageSize keys at a time.
+func (s *S3Mock) ListObjectsV2Pages(in *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	if !s.hasBucket(*in.Bucket) {
+		return errors.New(s3.ErrCodeNoSuchBucket)
+	}
+	bucket := s.buckets[*in.Bucket]
+
+	// Only the current version of each object is listed
+	contents := []*s3.Object{}
+	for _, key := range bucket.keys() {
+		versions := bucket.objects[key]
+		current := versions[len(versions)-1]
+		if !current.deleteMarker {
+			contents = append(contents, &s3.Object{
+				Key:  aws.String(key),
+				Size: aws.Int64(current.size),
+				// A fake, but stable, ETag
+				ETag: aws.String(fmt.Sprintf(`"%x"`, key)),
+			})
+		}
+	}
+
+	for start := 0; start == 0 || start < len(contents); start += s.PageSize {
+		end := start + s.PageSize
+		if end > len(contents) {
+			end = len(contents)
+		}
+		lastPage := end == len(contents)
+		if !fn(&s3.ListObjectsV2Output{Contents: contents[start:end]}, lastPage) || lastPage {
+			break
+		}
+	}
+	return nil
+}
+
+// ListObjectVersionsPages mocks the s3.listObjectVersions operation, returning
+// every version and delete marker in order, PageSize at a time.
+func (s *S3Mock) ListObjectVersionsPages(in *s3.ListObjectVersionsInput, fn func(*s3.ListObjectVersionsOutput, bool) bool) error {
+	if !s.hasBucket(*in.Bucket) {
+		return errors.New(s3.ErrCodeNoSuchBucket)
+	}
+	bucket := s.buckets[*in.Bucket]
+
+	type listedVersion struct {
+		key string
+		objectMock
+	}
+	listed := []listedVersion{}
+	for _, key := range bucket.keys() {
+		for _, version := range bucket.objects[key] {
+			listed = append(listed, listedVersion{key, version})
+		}
+	}
+
+	for start := 0; start == 0 || start < len(listed); start += s.PageSize {
+		end := start + s.PageSize
+		if end > len(listed) {
+			end = len(listed)
+		}
+
+		page := &s3.ListObjectVersionsOutput{}
+		for _, version := range listed[start:end] {
+			if version.deleteMarker {
+				page.DeleteMarkers = append(page.DeleteMarkers, &s3.DeleteMarkerEntry{
+					Key:       aws.String(version.key),
+					VersionId: aws.String(version.versionID),
+				})
+			} else {
+				page.Versions = append(page.Versions, &s3.ObjectVersion{
+					Key:       aws.String(version.key),
+					VersionId: aws.String(version.versionID),
+					Size:      aws.Int64(version.size),
+				})
+			}
+		}
+
+		lastPage := end == len(listed)
+		if !fn(page, lastPage) || lastPage {
+			break
+		}
+	}
+	return nil
+}
+
+// DeleteObjects mocks the s3.deleteObjects operation
+func (s *S3Mock) DeleteObjects(in *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	s.DeleteObjectsCalls++
+
+	if !s.hasBucket(*in.Bucket) {
+		return nil, errors.New(s3.ErrCodeNoSuchBucket)
+	}
+	if len(in.Delete.Objects) > 1000 {
+		return nil, errors.New("MalformedXML")
+	}
+	bucket := s.buckets[*in.Bucket]
+
+	out := &s3.DeleteObjectsOutput{}
+	for _, object := range in.Delete.Objects {
+		bucket.deleteObject(*object.Key, aws.StringValue(object.VersionId))
+		out.Deleted = append(out.Deleted, &s3.DeletedObject{Key: object.Key, VersionId: object.VersionId})
+	}
+	return out, nil
+}
+
+// ObjectCount returns the number of object versions in a bucket,
+// including delete markers.
+func (s *S3Mock) ObjectCount(name string) int {
+	if !s.hasBucket(name) {
+		return 0
+	}
+	count := 0
+	for _, versions := range s.buckets[name].objects {
+		count += len(versions)
+	}
+	return count
+}
+
+// deleteObject deletes a single version of an object. Without a version ID,
+// a versioned bucket gets a new delete marker instead.
+func (b *bucketMock) deleteObject(key, versionID string) {
+	versions := b.objects[key]
+
+	if versionID == "" && b.versioning == s3.BucketVersioningStatusEnabled {
+		b.objects[key] = append(versions, objectMock{versionID: b.newVersionID(), deleteMarker: true})
+		return
+	}
+
+	remaining := []objectMock{}
+	for _, version := range versions {
+		if versionID != "" && version.versionID != versionID {
+			remaining = append(remaining, version)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(b.objects, key)
+	} else {
+		b.objects[key] = remaining
+	}
+}
+
+func (b *bucketMock) keys() []string {
+	keys := []string{}
+	for key := range b.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (b *bucketMock) newVersionID() string {
+	b.nextID++
+	return fmt.Sprintf("v%d", b.nextID)
+}
+
 func (s *S3Mock) hasBucket(name string) bool {
 	_, ok := s.buckets[name]
 	return ok
@@ -56,7 +346,7 @@ func (s *S3Mock) addBucket(name string) error {
 	if s.hasBucket(name) {
 		return errors.New("Bucket already exists")
 	}
-	s.buckets[name] = true
+	s.buckets[name] = &bucketMock{objects: make(objectMap)}
 	return nil
 }
 
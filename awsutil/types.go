@@ -4,6 +4,7 @@ import (
 	"reflect"
 
 	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/db"
 )
 
 // InstanceConfig describes the configuration that will be passed to each
@@ -13,8 +14,23 @@ type InstanceConfig struct {
 	Population   int    `json:"population"`
 	BucketName   string `json:"bucketName"`
 	BucketRegion string `json:"bucketRegion"`
-	// The endpoint Synthea should ping when done generating patients
-	DoneEndpoint string `json:"done_endpoint"`
+	// Which slice of the task's dataset this instance generates, and the
+	// prefix its output is written under (see storage.ShardPrefix)
+	ShardIndex   int    `json:"shard_index"`
+	ShardCount   int    `json:"shard_count"`
+	OutputPrefix string `json:"output_prefix"`
+	// The endpoint Synthea should ping when done generating patients, the
+	// endpoint it should periodically report progress to, and the token it
+	// must present as a bearer token when calling either one
+	DoneEndpoint     string `json:"done_endpoint"`
+	ProgressEndpoint string `json:"progress_endpoint"`
+	DoneToken        string `json:"done_token"`
+	// The options to run Synthea with, including this shard's own seed,
+	// and how to export its output
+	Synthea db.SyntheaOptions `json:"synthea"`
+	Formats []db.ExportSpec   `json:"formats"`
+	// The keys of the custom modules in the bucket Synthea should load
+	CustomModules []string `json:"custom_modules,omitempty"`
 }
 
 // ValidateConfig ensures that InstanceConfig is complete and can
@@ -22,8 +38,8 @@ type InstanceConfig struct {
 func ValidateConfig(i *InstanceConfig, config *config.StorkConfig) bool {
 	v := reflect.ValueOf(i).Elem() // Use Elem to dereference the pointer
 
-	for i := 0; i < v.NumField(); i++ {
-		field := v.Field(i)
+	for n := 0; n < v.NumField(); n++ {
+		field := v.Field(n)
 
 		switch field.Kind() {
 		case reflect.String:
@@ -34,22 +50,46 @@ func ValidateConfig(i *InstanceConfig, config *config.StorkConfig) bool {
 			}
 
 		case reflect.Int:
-			// This only applies to population:
+			// No number in the config may be negative
+			if field.Int() < 0 {
+				return false
+			}
+
 			// Population must be >= config.MinPopulationSize
-			if field.Int() < int64(config.MinPopulationSize) {
+			if v.Type().Field(n).Name == "Population" && field.Int() < int64(config.MinPopulationSize) {
 				return false
 			}
 
+		case reflect.Struct, reflect.Slice:
+			// The Synthea options, formats and custom modules are
+			// validated when the task is created
+
 		default:
 			// Unknown type in the config object
 			return false
 		}
 	}
-	return true
+
+	// The shard must be one of ShardCount shards
+	return i.ShardCount > 0 && i.ShardIndex < i.ShardCount
+}
+
+// LaunchOptions are the per-task options for how Synthea instances are
+// launched. Unlike the InstanceConfig, they aren't passed to the instance.
+type LaunchOptions struct {
+	// The EC2 instance type and AMI to launch. If empty,
+	// config.SyntheaInstanceType and config.SyntheaImageID
+	InstanceType string
+	ImageID      string
+
+	// Request spot capacity, falling back to on-demand if there is none
+	Spot bool
 }
 
 // InstanceStatus describes the current status of a running Synthea instance.
 type InstanceStatus struct {
 	InstanceID string
 	Status     string
+	// True if a spot instance was terminated because EC2 reclaimed it
+	Interrupted bool
 }
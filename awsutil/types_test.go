@@ -22,11 +22,16 @@ func (t *TypesTestSuite) TestValidateInstanceConfig() {
 
 	// First, make sure a valid config returns true
 	iConfig := &InstanceConfig{
-		TaskID:       "123abc",
-		Population:   sConfig.MinPopulationSize + 100,
-		BucketName:   "123abc-bucket",
-		BucketRegion: "us-east-1",
-		DoneEndpoint: "https://stork.com/tasks/:id/done",
+		TaskID:           "123abc",
+		Population:       sConfig.MinPopulationSize + 100,
+		BucketName:       "123abc-bucket",
+		BucketRegion:     "us-east-1",
+		DoneEndpoint:     "https://stork.com/tasks/:id/done",
+		ProgressEndpoint: "https://stork.com/tasks/:id/progress",
+		DoneToken:        "0.abc.def",
+		ShardIndex:       0,
+		ShardCount:       1,
+		OutputPrefix:     "shard-0/",
 	}
 	t.True(ValidateConfig(iConfig, sConfig))
 
@@ -38,4 +43,13 @@ func (t *TypesTestSuite) TestValidateInstanceConfig() {
 	iConfig.Population = sConfig.MinPopulationSize + 1000
 	iConfig.TaskID = ""
 	t.False(ValidateConfig(iConfig, sConfig))
+
+	// Now test with a shard outside of the shard count
+	iConfig.TaskID = "123abc"
+	iConfig.ShardIndex = 1
+	t.False(ValidateConfig(iConfig, sConfig))
+
+	// And with a negative shard index
+	iConfig.ShardIndex = -1
+	t.False(ValidateConfig(iConfig, sConfig))
 }
@@ -1,5 +1,10 @@
 package config
 
+import (
+	"strings"
+	"time"
+)
+
 // DefaultConfig is the default set of configuration options for Stork.
 // Note: with this default configuration Stork has enough information to start,
 // but not to make requests to AWS. Those configuration options will need
@@ -7,19 +12,70 @@ package config
 var DefaultConfig = &StorkConfig{
 	ServerHost: "localhost",
 	ServerPort: "8080",
+	PublicURL:  "",
 	Debug:      false,
 
+	CORSOrigins: "*",
+	AdminAPIKey: "",
+
 	DatabaseHost: "localhost:27017",
 	DatabaseName: "stork",
 
+	Storage:        "s3",
+	StorageRoot:    "stork-data",
+	DownloadExpiry: 24 * time.Hour,
+	DownloadSecret: "",
+	Aggregate:      true,
+
+	Mailer:       "log",
+	MailFrom:     "stork@localhost",
+	MailFile:     "",
+	SMTPHost:     "",
+	SMTPPort:     "587",
+	SMTPUser:     "",
+	SMTPPassword: "",
+
+	WebhookMaxAttempts:  8,
+	WebhookRetryDelay:   30 * time.Second,
+	WebhookTimeout:      10 * time.Second,
+	WebhookAllowPrivate: false,
+
+	Runner:       "ec2",
+	LocalCommand: "",
+	LocalImage:   "",
+
 	SyntheaImageID:         "",
 	SyntheaInstanceType:    "t2.micro",
+	SyntheaInstanceTypes:   DefaultInstanceTypes,
 	SyntheaSecurityGroupID: "",
 	SyntheaRoleArn:         "",
 	SyntheaSubnetID:        "",
+	SyntheaSpot:            false,
+	SyntheaSpotMaxPrice:    "",
 
 	MinPopulationSize: 500,
+	MaxShardDuration:  4 * time.Hour,
 	DoneEndpoint:      "/task/:id/done",
+	ProgressEndpoint:  "/task/:id/progress",
+	CallbackSecret:    "",
+
+	Prices:             DefaultPrices,
+	EstimateSampleSize: 20,
+
+	QuotaMaxActiveTasks:      5,
+	QuotaMaxInstances:        50,
+	QuotaMaxPatientsPerMonth: 1000000,
+	QuotaMaxStorageBytes:     100 << 30,
+
+	DefaultMaxAttempts:  3,
+	DefaultRetryBackoff: time.Minute,
+	MaxAttemptsLimit:    10,
+
+	MaxRunningInstances: 20,
+	SchedulerOrder:      "fifo",
+
+	ReconcileInterval: time.Minute,
+	StallTimeout:      15 * time.Minute,
 }
 
 // StorkConfig encapsulates all Stork configuration options.
@@ -29,16 +85,84 @@ type StorkConfig struct {
 	ServerPort string
 	Debug      bool
 
+	// The base URL that Synthea instances use to reach Stork, for example
+	// "https://stork.example.com". If empty, it's derived from ServerHost
+	// and ServerPort.
+	PublicURL string
+
+	// The origins allowed to make cross-origin requests, comma separated.
+	CORSOrigins string
+
+	// An API key with the admin role, created at startup if set. This
+	// bootstraps access to Stork, since API keys are otherwise created
+	// through the API by an admin.
+	AdminAPIKey string
+
 	// MongoDB configuration options.
 	DatabaseHost string
 	DatabaseName string
 
+	// Where to store Synthea output: "s3", or "fs" for development. The fs
+	// storage keeps one directory per task under StorageRoot.
+	Storage     string
+	StorageRoot string
+
+	// How long download links for a completed task's files are valid.
+	DownloadExpiry time.Duration
+
+	// The secret used to sign download links served by the fs storage. If
+	// empty, a random secret is generated at startup, and links handed out
+	// before a restart stop working.
+	DownloadSecret string
+
+	// Whether the output of a completed task's shards is merged into a
+	// single dataset, before its recipients are emailed (see package
+	// aggregate).
+	Aggregate bool
+
+	// How to email users when their tasks end: "smtp", or "log" for
+	// development. The log mailer appends messages to MailFile, or logs
+	// them if MailFile is empty.
+	Mailer   string
+	MailFrom string
+	MailFile string
+
+	// The SMTP server the smtp mailer sends through. SMTPUser and
+	// SMTPPassword are optional.
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUser     string
+	SMTPPassword string
+
+	// How many times an event is sent to a task's webhook before giving up,
+	// how long to wait before the first retry (doubling after each one), and
+	// how long to wait for the receiver to respond.
+	WebhookMaxAttempts int
+	WebhookRetryDelay  time.Duration
+	WebhookTimeout     time.Duration
+
+	// Whether webhooks may point at loopback, link-local and private
+	// addresses. Only meant for development, since anyone who can submit a
+	// task could otherwise reach services on Stork's own network.
+	WebhookAllowPrivate bool
+
+	// Where to run Synthea: "ec2", or "local" for development.
+	Runner string
+
+	// The command the local runner uses to start Synthea, or the Docker image
+	// it runs instead. The InstanceConfig is passed in the environment.
+	LocalCommand string
+	LocalImage   string
+
 	// The prebuilt Snythea image (already available in AWS) to use.
 	SyntheaImageID string
 
-	// The EC2 instance type to run Synthea on. A compute-optimized instance
-	// is recommended, for example a c4.large instance.
-	SyntheaInstanceType string
+	// The EC2 instance type to run Synthea on, unless a task asks for one
+	// of the other allowed types. A compute-optimized instance is
+	// recommended, for example a c4.large instance. The default type must be
+	// allowed too.
+	SyntheaInstanceType  string
+	SyntheaInstanceTypes []InstanceType
 
 	// The security groups ID (already created in AWS) for Snythea to use.
 	// Minimally, Synthea must be able to make outbound HTTP/HTTPS requests.
@@ -52,11 +176,77 @@ type StorkConfig struct {
 	// be in the same region as Stork and the S3 bucket Synthea writes to.
 	SyntheaSubnetID string
 
+	// Whether tasks run Synthea on spot instances by default, and the most
+	// to pay for them per hour, in USD. If empty, spot instances cost at most
+	// as much as on-demand instances. Tasks fall back to on-demand instances
+	// when there is no spot capacity.
+	SyntheaSpot         bool
+	SyntheaSpotMaxPrice string
+
 	// The minimum number of patient records that an instance should generate.
 	// This is practically defined by the towns.json data the feeds a sequential
 	// synthea run. In that case, 481 patients are generated.
 	MinPopulationSize int
 
+	// How long a single instance should take to generate its shard at most.
+	// Together with an instance type's throughput estimate this caps the
+	// number of patients per instance.
+	MaxShardDuration time.Duration
+
+	// The price table task estimates are based on, and how many recent
+	// completed tasks to learn instance throughput from.
+	Prices             *Prices
+	EstimateSampleSize int
+
+	// The quota of users that don't have their own: how many tasks and
+	// instances they can run at once, how many patients they can generate
+	// per month, and how many bytes of output they can keep. A limit of 0 is
+	// unlimited. Admins aren't limited at all.
+	QuotaMaxActiveTasks      int
+	QuotaMaxInstances        int
+	QuotaMaxPatientsPerMonth int
+	QuotaMaxStorageBytes     int64
+
 	// The stork endpoint that Synthea instances should ping when done.
 	DoneEndpoint string
+
+	// The stork endpoint that Synthea instances should periodically
+	// report their progress to.
+	ProgressEndpoint string
+
+	// The secret used to sign the tokens Synthea instances present when
+	// calling back into Stork. If empty, a random secret is generated at
+	// startup, and tasks that were running before a restart can no longer
+	// report back.
+	CallbackSecret string
+
+	// The retry policy of tasks that don't set their own: how many instances
+	// each shard gets, and how long to wait before the first retry. Tasks can't
+	// ask for more than MaxAttemptsLimit attempts.
+	DefaultMaxAttempts  int
+	DefaultRetryBackoff time.Duration
+	MaxAttemptsLimit    int
+
+	// The most Synthea instances that can run at once, across all tasks.
+	// Tasks are queued until there are enough free for all of their shards,
+	// and started in "fifo" or "priority" order. A limit of 0 is unlimited.
+	MaxRunningInstances int
+	SchedulerOrder      string
+
+	// How often Stork checks the state of active tasks against the
+	// state of their instances in EC2.
+	ReconcileInterval time.Duration
+
+	// How long an instance can go without reporting progress before it's
+	// considered stalled and failed. Instances that never report progress
+	// aren't checked. Zero disables stall detection.
+	StallTimeout time.Duration
+}
+
+// BaseURL returns the URL that Synthea instances should use to reach Stork.
+func (c *StorkConfig) BaseURL() string {
+	if c.PublicURL != "" {
+		return strings.TrimSuffix(c.PublicURL, "/")
+	}
+	return "http://" + c.ServerHost + ":" + strings.TrimPrefix(c.ServerPort, ":")
 }
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// InstanceType describes an EC2 instance type tasks are allowed to run
+// Synthea on. PatientsPerHour is a rough estimate of how fast a single
+// instance of this type generates patients.
+type InstanceType struct {
+	Name            string  `json:"name"`
+	VCPUs           int     `json:"vcpus"`
+	MemoryGiB       float64 `json:"memoryGiB"`
+	PatientsPerHour int     `json:"patientsPerHour"`
+}
+
+// DefaultInstanceTypes is the default allow-list of instance types.
+var DefaultInstanceTypes = []InstanceType{
+	{Name: "t2.micro", VCPUs: 1, MemoryGiB: 1, PatientsPerHour: 1000},
+	{Name: "c4.large", VCPUs: 2, MemoryGiB: 3.75, PatientsPerHour: 4000},
+	{Name: "c4.xlarge", VCPUs: 4, MemoryGiB: 7.5, PatientsPerHour: 8000},
+	{Name: "c4.2xlarge", VCPUs: 8, MemoryGiB: 15, PatientsPerHour: 16000},
+	{Name: "c4.4xlarge", VCPUs: 16, MemoryGiB: 30, PatientsPerHour: 32000},
+}
+
+// MaxPopulation returns the most patients a single instance of this type
+// should generate, so that it's done within maxShardDuration. It's never
+// less than minPopulation, since no instance generates fewer patients.
+func (i InstanceType) MaxPopulation(maxShardDuration time.Duration, minPopulation int) int {
+	max := int(float64(i.PatientsPerHour) * maxShardDuration.Hours())
+	if max < minPopulation {
+		return minPopulation
+	}
+	return max
+}
+
+// GetInstanceType returns the allowed instance type with the given name.
+// An empty name is the default SyntheaInstanceType.
+func (c *StorkConfig) GetInstanceType(name string) (InstanceType, bool) {
+	if name == "" {
+		name = c.SyntheaInstanceType
+	}
+	for _, instanceType := range c.SyntheaInstanceTypes {
+		if instanceType.Name == name {
+			return instanceType, true
+		}
+	}
+	return InstanceType{}, false
+}
+
+// LoadInstanceTypes reads an allow-list of instance types from a JSON
+// file, a list of InstanceType objects.
+func LoadInstanceTypes(path string) ([]InstanceType, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	instanceTypes := []InstanceType{}
+	err = json.NewDecoder(file).Decode(&instanceTypes)
+	if err != nil {
+		return nil, fmt.Errorf("Malformed instance types in %s: %s", path, err)
+	}
+
+	for _, instanceType := range instanceTypes {
+		if instanceType.Name == "" || instanceType.PatientsPerHour < 1 {
+			return nil, fmt.Errorf("Instance types in %s need a name and a patients per hour estimate", path)
+		}
+	}
+	return instanceTypes, nil
+}
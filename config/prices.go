@@ -0,0 +1,68 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Prices is the price table task estimates are based on, in USD. Output
+// sizes are rough averages per patient, keyed by export format.
+type Prices struct {
+	// On-demand price per hour, by instance type
+	InstanceHourly map[string]float64 `json:"instanceHourly"`
+
+	// S3 storage per GB-month, and PUT requests per 1000
+	S3GBMonth    float64 `json:"s3GBMonth"`
+	S3PutPer1000 float64 `json:"s3PutPer1000"`
+
+	// Average output size of a single patient, by format
+	BytesPerPatient map[string]int64 `json:"bytesPerPatient"`
+}
+
+// DefaultPrices are the us-east-1 prices of the DefaultInstanceTypes.
+var DefaultPrices = &Prices{
+	InstanceHourly: map[string]float64{
+		"t2.micro":   0.0116,
+		"c4.large":   0.1,
+		"c4.xlarge":  0.199,
+		"c4.2xlarge": 0.398,
+		"c4.4xlarge": 0.796,
+	},
+	S3GBMonth:    0.023,
+	S3PutPer1000: 0.005,
+	BytesPerPatient: map[string]int64{
+		"FHIR": 2000000,
+		"CCDA": 500000,
+		"HTML": 300000,
+		"text": 50000,
+		"CSV":  100000,
+	},
+}
+
+// LoadPrices reads a price table from a JSON file.
+func LoadPrices(path string) (*Prices, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	prices := &Prices{}
+	err = json.NewDecoder(file).Decode(prices)
+	if err != nil {
+		return nil, fmt.Errorf("Malformed prices in %s: %s", path, err)
+	}
+	return prices, nil
+}
+
+// CheckInstanceTypes returns an error if any of the given instance types
+// has no hourly price, since tasks on it couldn't be estimated.
+func (p *Prices) CheckInstanceTypes(instanceTypes []InstanceType) error {
+	for _, instanceType := range instanceTypes {
+		if _, ok := p.InstanceHourly[instanceType.Name]; !ok {
+			return fmt.Errorf("No hourly price for instance type %s", instanceType.Name)
+		}
+	}
+	return nil
+}
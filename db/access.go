@@ -2,6 +2,8 @@ package db
 
 import (
 	"errors"
+	"io/ioutil"
+	"time"
 
 	"github.com/cjduffett/stork/logger"
 	mgo "gopkg.in/mgo.v2"
@@ -9,7 +11,14 @@ import (
 )
 
 const (
-	tasksCollection = "tasks"
+	tasksCollection    = "tasks"
+	apiKeysCollection  = "apikeys"
+	webhooksCollection = "webhooks"
+	quotasCollection   = "quotas"
+
+	// Custom module content is kept in GridFS, apart from the tasks
+	// that use it, since it can be larger than a task document may be
+	modulesGridFS = "modules"
 )
 
 // DataAccessLayer exposes all methods needed to access saved state in MongoDB.
@@ -65,6 +74,83 @@ func (s *DataAccessLayer) GetTasks() (*TaskList, error) {
 	return &TaskList{Tasks: tasks}, nil
 }
 
+// GetTasksByUser retrieves all tasks owned by a user, excluding
+// those that were deleted.
+func (s *DataAccessLayer) GetTasksByUser(user string) (*TaskList, error) {
+	worker := s.session.Copy()
+	defer worker.Close()
+
+	logger.Debug("Getting all tasks for user ", user)
+
+	tasks := []Task{}
+	query := bson.M{"user": user, "status": bson.M{"$ne": TaskStatusDeleted}}
+	err := worker.DB(s.dbname).C(tasksCollection).Find(query).All(&tasks)
+
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+	return &TaskList{Tasks: tasks}, nil
+}
+
+// GetTasksByStatus retrieves all tasks with the given status.
+func (s *DataAccessLayer) GetTasksByStatus(status string) (*TaskList, error) {
+	worker := s.session.Copy()
+	defer worker.Close()
+
+	logger.Debug("Getting all ", status, " tasks")
+
+	tasks := []Task{}
+	err := worker.DB(s.dbname).C(tasksCollection).Find(bson.M{"status": status}).All(&tasks)
+
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+	return &TaskList{Tasks: tasks}, nil
+}
+
+// GetPendingAggregations returns every completed task whose output is
+// still waiting to be aggregated.
+func (s *DataAccessLayer) GetPendingAggregations() (*TaskList, error) {
+	worker := s.session.Copy()
+	defer worker.Close()
+
+	logger.Debug("Getting all tasks with pending aggregations")
+
+	tasks := []Task{}
+	query := bson.M{"status": TaskStatusCompleted, "manifest.aggregation": AggregationPending}
+	err := worker.DB(s.dbname).C(tasksCollection).Find(query).All(&tasks)
+
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+	return &TaskList{Tasks: tasks}, nil
+}
+
+// GetCompletedTasks returns the most recently completed tasks that ran on
+// the given instance type, at most limit of them.
+func (s *DataAccessLayer) GetCompletedTasks(instanceType string, limit int) (*TaskList, error) {
+	worker := s.session.Copy()
+	defer worker.Close()
+
+	logger.Debug("Getting the last ", limit, " completed ", instanceType, " tasks")
+
+	selector := bson.M{
+		"status":       TaskStatusCompleted,
+		"instanceType": instanceType,
+	}
+	tasks := []Task{}
+	err := worker.DB(s.dbname).C(tasksCollection).Find(selector).Sort("-endTime").Limit(limit).All(&tasks)
+
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+	return &TaskList{Tasks: tasks}, nil
+}
+
 // CreateTask adds a new task to the database
 func (s *DataAccessLayer) CreateTask(task *Task) (string, error) {
 	worker := s.session.Copy()
@@ -106,6 +192,148 @@ func (s *DataAccessLayer) UpdateTask(task *Task) (*Task, error) {
 	return task, nil
 }
 
+// EndTask saves the final status, end time, and manifest of an active or
+// queued task. Only those fields are updated, and only if the task is still
+// active or queued in the database, so a task that was aborted in the
+// meantime is left alone. In that case mgo.ErrNotFound is returned.
+func (s *DataAccessLayer) EndTask(task *Task) error {
+	worker := s.session.Copy()
+	defer worker.Close()
+
+	logger.Debug("Ending task ", task.ID, " with status ", task.Status)
+
+	selector := bson.M{
+		"_id":    task.ID,
+		"status": bson.M{"$in": []string{TaskStatusQueued, TaskStatusActive}},
+	}
+	update := bson.M{"$set": bson.M{
+		"status":   task.Status,
+		"endTime":  task.EndTime,
+		"manifest": task.Manifest,
+	}}
+	return worker.DB(s.dbname).C(tasksCollection).Update(selector, update)
+}
+
+// SetManifest replaces the manifest of a completed task. If the task is no
+// longer completed, because it was deleted, mgo.ErrNotFound is returned.
+func (s *DataAccessLayer) SetManifest(taskID string, manifest *Manifest) error {
+	worker := s.session.Copy()
+	defer worker.Close()
+
+	logger.Debug("Setting the manifest of task ", taskID)
+
+	selector := bson.M{"_id": taskID, "status": TaskStatusCompleted}
+	update := bson.M{"$set": bson.M{"manifest": manifest}}
+	return worker.DB(s.dbname).C(tasksCollection).Update(selector, update)
+}
+
+// StartQueuedTask records that a queued task was started, along with its
+// instances. If the task is no longer queued, mgo.ErrNotFound is returned.
+func (s *DataAccessLayer) StartQueuedTask(task *Task) error {
+	worker := s.session.Copy()
+	defer worker.Close()
+
+	logger.Debug("Starting queued task ", task.ID)
+
+	selector := bson.M{"_id": task.ID, "status": TaskStatusQueued}
+	update := bson.M{"$set": bson.M{
+		"status":      TaskStatusActive,
+		"startTime":   task.StartTime,
+		"instances":   task.Instances,
+		"instanceIds": task.InstanceIDs,
+	}}
+	return worker.DB(s.dbname).C(tasksCollection).Update(selector, update)
+}
+
+// AddInstance adds a newly launched instance to an active task. If the task
+// is no longer active in the database, mgo.ErrNotFound is returned.
+func (s *DataAccessLayer) AddInstance(taskID string, instance *Instance) error {
+	worker := s.session.Copy()
+	defer worker.Close()
+
+	logger.Debug("Adding instance ", instance.InstanceID, " to task ", taskID)
+
+	selector := bson.M{"_id": taskID, "status": TaskStatusActive}
+	update := bson.M{"$push": bson.M{
+		"instances":   instance,
+		"instanceIds": instance.InstanceID,
+	}}
+	return worker.DB(s.dbname).C(tasksCollection).Update(selector, update)
+}
+
+// SetInstanceDone marks a single active instance of a task as done, recording
+// how many patients it generated. Only that instance is modified, so concurrent
+// updates to other instances of the same task are never overwritten. If the
+// instance isn't found or isn't active, mgo.ErrNotFound is returned.
+func (s *DataAccessLayer) SetInstanceDone(taskID, instanceID string, patientsGenerated int) error {
+	logger.Debug("Marking instance ", instanceID, " of task ", taskID, " as 'done'")
+
+	now := time.Now()
+	return s.updateActiveInstance(taskID, instanceID, bson.M{
+		"instances.$.status":            InstanceStatusDone,
+		"instances.$.doneTime":          &now,
+		"instances.$.patientsGenerated": patientsGenerated,
+	})
+}
+
+// SetInstanceProgress records the latest progress reported by a single active
+// instance of a task: how many patients it has generated so far and what it's
+// doing. Like SetInstanceDone, only that instance is modified.
+func (s *DataAccessLayer) SetInstanceProgress(taskID, instanceID string, patientsGenerated int, phase string) error {
+	logger.Debug("Recording progress of instance ", instanceID, " of task ", taskID)
+
+	now := time.Now()
+	return s.updateActiveInstance(taskID, instanceID, bson.M{
+		"instances.$.patientsGenerated": patientsGenerated,
+		"instances.$.phase":             phase,
+		"instances.$.lastHeartbeat":     &now,
+	})
+}
+
+// SetInstanceError marks a single active instance of a task as failed, with an
+// error message. Like SetInstanceDone, only that instance is modified.
+func (s *DataAccessLayer) SetInstanceError(taskID, instanceID, message string) error {
+	logger.Debug("Marking instance ", instanceID, " of task ", taskID, " as 'error'")
+
+	now := time.Now()
+	return s.updateActiveInstance(taskID, instanceID, bson.M{
+		"instances.$.status":       InstanceStatusError,
+		"instances.$.doneTime":     &now,
+		"instances.$.errorMessage": message,
+	})
+}
+
+// SetInstanceInterrupted marks a single active spot instance of a task as
+// failed because EC2 reclaimed it. Like SetInstanceDone, only that instance
+// is modified.
+func (s *DataAccessLayer) SetInstanceInterrupted(taskID, instanceID, message string) error {
+	logger.Debug("Marking instance ", instanceID, " of task ", taskID, " as interrupted")
+
+	now := time.Now()
+	return s.updateActiveInstance(taskID, instanceID, bson.M{
+		"instances.$.status":       InstanceStatusError,
+		"instances.$.doneTime":     &now,
+		"instances.$.errorMessage": message,
+		"instances.$.interrupted":  true,
+	})
+}
+
+// updateActiveInstance atomically applies fields to the matching active
+// instance of a task, using the positional $ operator.
+func (s *DataAccessLayer) updateActiveInstance(taskID, instanceID string, fields bson.M) error {
+	worker := s.session.Copy()
+	defer worker.Close()
+
+	selector := bson.M{
+		"_id": taskID,
+		"instances": bson.M{"$elemMatch": bson.M{
+			"instanceId": instanceID,
+			"status":     InstanceStatusActive,
+		}},
+	}
+	return worker.DB(s.dbname).C(tasksCollection).Update(selector, bson.M{"$set": fields})
+}
+
 // DeleteTask marks a task in the database as "deleted"
 func (s *DataAccessLayer) DeleteTask(taskID string) error {
 	worker := s.session.Copy()
@@ -115,3 +343,192 @@ func (s *DataAccessLayer) DeleteTask(taskID string) error {
 	query := bson.M{"$set": bson.M{"status": TaskStatusDeleted}}
 	return worker.DB(s.dbname).C(tasksCollection).UpdateId(taskID, query)
 }
+
+// GetAPIKey retrieves an APIKey from the database, by the hash of the key
+func (s *DataAccessLayer) GetAPIKey(keyHash string) (*APIKey, error) {
+	worker := s.session.Copy()
+	defer worker.Close()
+
+	apiKey := APIKey{}
+	err := worker.DB(s.dbname).C(apiKeysCollection).FindId(keyHash).One(&apiKey)
+	if err != nil {
+		return nil, err
+	}
+	return &apiKey, nil
+}
+
+// SaveAPIKey adds an APIKey to the database, replacing any existing
+// APIKey with the same hash.
+func (s *DataAccessLayer) SaveAPIKey(apiKey *APIKey) error {
+	worker := s.session.Copy()
+	defer worker.Close()
+
+	if apiKey.KeyHash == "" {
+		err := errors.New("Unknown API key: no key hash found")
+		logger.Error(err)
+		return err
+	}
+	logger.Debug("Saving API key for user ", apiKey.User)
+
+	_, err := worker.DB(s.dbname).C(apiKeysCollection).UpsertId(apiKey.KeyHash, apiKey)
+	if err != nil {
+		logger.Error(err)
+	}
+	return err
+}
+
+// GetQuota retrieves a user's own Quota from the database. If the user
+// doesn't have one, mgo.ErrNotFound is returned.
+func (s *DataAccessLayer) GetQuota(user string) (*Quota, error) {
+	worker := s.session.Copy()
+	defer worker.Close()
+
+	quota := Quota{}
+	err := worker.DB(s.dbname).C(quotasCollection).FindId(user).One(&quota)
+	if err != nil {
+		return nil, err
+	}
+	return &quota, nil
+}
+
+// SaveQuota adds a user's Quota to the database, replacing any existing one.
+func (s *DataAccessLayer) SaveQuota(quota *Quota) error {
+	worker := s.session.Copy()
+	defer worker.Close()
+
+	logger.Debug("Saving quota for user ", quota.User)
+
+	_, err := worker.DB(s.dbname).C(quotasCollection).UpsertId(quota.User, quota)
+	if err != nil {
+		logger.Error(err)
+	}
+	return err
+}
+
+// GetQuotaTasks retrieves every task that counts against a user's quota:
+// all tasks that weren't deleted, and those started since the given time
+// even if they were.
+func (s *DataAccessLayer) GetQuotaTasks(user string, since time.Time) (*TaskList, error) {
+	worker := s.session.Copy()
+	defer worker.Close()
+
+	logger.Debug("Getting quota tasks for user ", user)
+
+	tasks := []Task{}
+	query := bson.M{
+		"user": user,
+		"$or": []bson.M{
+			bson.M{"status": bson.M{"$ne": TaskStatusDeleted}},
+			bson.M{"startTime": bson.M{"$gte": since}},
+		},
+	}
+	err := worker.DB(s.dbname).C(tasksCollection).Find(query).All(&tasks)
+
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+	return &TaskList{Tasks: tasks}, nil
+}
+
+// CreateWebhookDelivery adds a new webhook delivery to the database
+func (s *DataAccessLayer) CreateWebhookDelivery(delivery *WebhookDelivery) error {
+	worker := s.session.Copy()
+	defer worker.Close()
+
+	if delivery.ID == "" {
+		delivery.ID = bson.NewObjectId().Hex()
+	}
+	logger.Debug("Creating webhook delivery ", delivery.ID, " for task ", delivery.TaskID)
+
+	err := worker.DB(s.dbname).C(webhooksCollection).Insert(delivery)
+	if err != nil {
+		logger.Error(err)
+	}
+	return err
+}
+
+// UpdateWebhookDelivery saves the status and attempts of a webhook delivery
+func (s *DataAccessLayer) UpdateWebhookDelivery(delivery *WebhookDelivery) error {
+	worker := s.session.Copy()
+	defer worker.Close()
+
+	logger.Debug("Updating webhook delivery ", delivery.ID)
+
+	update := bson.M{"$set": bson.M{
+		"status":      delivery.Status,
+		"attempts":    delivery.Attempts,
+		"nextAttempt": delivery.NextAttempt,
+	}}
+	return worker.DB(s.dbname).C(webhooksCollection).UpdateId(delivery.ID, update)
+}
+
+// GetWebhookDeliveries retrieves every webhook delivery for a task, oldest first
+func (s *DataAccessLayer) GetWebhookDeliveries(taskID string) (*WebhookDeliveryList, error) {
+	return s.findWebhookDeliveries(bson.M{"taskId": taskID})
+}
+
+// GetPendingWebhookDeliveries retrieves every webhook delivery that
+// hasn't yet succeeded or failed for good, oldest first
+func (s *DataAccessLayer) GetPendingWebhookDeliveries() (*WebhookDeliveryList, error) {
+	return s.findWebhookDeliveries(bson.M{"status": DeliveryStatusPending})
+}
+
+func (s *DataAccessLayer) findWebhookDeliveries(query bson.M) (*WebhookDeliveryList, error) {
+	worker := s.session.Copy()
+	defer worker.Close()
+
+	deliveries := []WebhookDelivery{}
+	err := worker.DB(s.dbname).C(webhooksCollection).Find(query).Sort("created").All(&deliveries)
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+	return &WebhookDeliveryList{Deliveries: deliveries}, nil
+}
+
+// SaveModule stores the content of a custom Synthea module, named by its
+// checksum. Content that's already stored isn't stored again, so every task
+// uploading the same module shares it.
+func (s *DataAccessLayer) SaveModule(checksum string, content []byte) error {
+	worker := s.session.Copy()
+	defer worker.Close()
+
+	gfs := worker.DB(s.dbname).GridFS(modulesGridFS)
+	n, err := gfs.Find(bson.M{"filename": checksum}).Count()
+	if err != nil {
+		logger.Error(err)
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	logger.Debug("Saving custom module ", checksum)
+	file, err := gfs.Create(checksum)
+	if err != nil {
+		logger.Error(err)
+		return err
+	}
+	// Close reports any error from writing, too
+	file.Write(content)
+	err = file.Close()
+	if err != nil {
+		logger.Error(err)
+	}
+	return err
+}
+
+// GetModule retrieves the content of a custom Synthea module by its checksum.
+// If it was never saved, mgo.ErrNotFound is returned.
+func (s *DataAccessLayer) GetModule(checksum string) ([]byte, error) {
+	worker := s.session.Copy()
+	defer worker.Close()
+
+	file, err := worker.DB(s.dbname).GridFS(modulesGridFS).Open(checksum)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
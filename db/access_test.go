@@ -1,7 +1,9 @@
 package db
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"gopkg.in/mgo.v2/bson"
 
@@ -41,6 +43,11 @@ func (a *AccessTestSuite) TearDownTest() {
 	// Drop the tasksCollection between tests.
 	// This may silently error out if the collection does not exist yet.
 	a.DB().C(tasksCollection).DropCollection()
+	a.DB().C(apiKeysCollection).DropCollection()
+	a.DB().C(webhooksCollection).DropCollection()
+	a.DB().C(quotasCollection).DropCollection()
+	a.DB().C(modulesGridFS + ".files").DropCollection()
+	a.DB().C(modulesGridFS + ".chunks").DropCollection()
 }
 
 func (a *AccessTestSuite) TearDownSuite() {
@@ -62,7 +69,7 @@ func (a *AccessTestSuite) TestCreateTask() {
 		InstanceIDs: []string{"abc123", "def456"},
 		BucketName:  "test-bucket",
 		User:        "bob",
-		Formats:     []string{"FHIR", "CSV"},
+		Formats:     []ExportSpec{ExportSpec{Format: FormatFHIR}, ExportSpec{Format: FormatCSV}},
 	}
 	task.Start()
 
@@ -112,7 +119,7 @@ func (a *AccessTestSuite) TestGetTask() {
 		InstanceIDs: []string{"abc123", "def456"},
 		BucketName:  "test-bucket",
 		User:        "bob",
-		Formats:     []string{"FHIR", "CSV"},
+		Formats:     []ExportSpec{ExportSpec{Format: FormatFHIR}, ExportSpec{Format: FormatCSV}},
 	}
 	task.Start()
 
@@ -140,7 +147,7 @@ func (a *AccessTestSuite) TestGetAllTasks() {
 		InstanceIDs: []string{"abc123", "def456"},
 		BucketName:  "test-bucket-1",
 		User:        "bob",
-		Formats:     []string{"FHIR", "CSV"},
+		Formats:     []ExportSpec{ExportSpec{Format: FormatFHIR}, ExportSpec{Format: FormatCSV}},
 	}
 	task1.Start()
 
@@ -154,7 +161,7 @@ func (a *AccessTestSuite) TestGetAllTasks() {
 		InstanceIDs: []string{"abc123", "def456"},
 		BucketName:  "test-bucket-2",
 		User:        "bob",
-		Formats:     []string{"FHIR", "CSV"},
+		Formats:     []ExportSpec{ExportSpec{Format: FormatFHIR}, ExportSpec{Format: FormatCSV}},
 	}
 	task2.Start()
 
@@ -190,7 +197,7 @@ func (a *AccessTestSuite) TestUpdateTask() {
 		InstanceIDs: []string{"abc123", "def456"},
 		BucketName:  "test-bucket",
 		User:        "bob",
-		Formats:     []string{"FHIR", "CSV"},
+		Formats:     []ExportSpec{ExportSpec{Format: FormatFHIR}, ExportSpec{Format: FormatCSV}},
 	}
 	task.Start()
 
@@ -224,6 +231,350 @@ func (a *AccessTestSuite) TestUpdateTask() {
 	a.NotNil(gotTask.EndTime)
 }
 
+func (a *AccessTestSuite) TestGetTasksByStatus() {
+	var err error
+
+	// Add an active and a completed task to the database
+	active := &Task{
+		Status:      TaskStatusActive,
+		InstanceIDs: []string{"abc123"},
+		BucketName:  "test-bucket-1",
+		User:        "bob",
+		Formats:     []ExportSpec{ExportSpec{Format: FormatFHIR}},
+	}
+	_, err = a.DAL.CreateTask(active)
+	a.NoError(err)
+
+	completed := &Task{
+		Status:      TaskStatusCompleted,
+		InstanceIDs: []string{"def456"},
+		BucketName:  "test-bucket-2",
+		User:        "bob",
+		Formats:     []ExportSpec{ExportSpec{Format: FormatFHIR}},
+	}
+	_, err = a.DAL.CreateTask(completed)
+	a.NoError(err)
+
+	// Only the active task should be returned
+	taskList, err := a.DAL.GetTasksByStatus(TaskStatusActive)
+	a.NoError(err)
+	a.Len(taskList.Tasks, 1)
+	a.Equal(active.ID, taskList.Tasks[0].ID)
+}
+
+func (a *AccessTestSuite) TestStartQueuedTask() {
+	var err error
+
+	queuedAt := time.Now()
+	task := &Task{
+		Status:     TaskStatusQueued,
+		QueuedTime: &queuedAt,
+		ShardCount: 1,
+		BucketName: "test-bucket",
+		User:       "bob",
+		Formats:    []ExportSpec{ExportSpec{Format: FormatFHIR}},
+	}
+	taskID, err := a.DAL.CreateTask(task)
+	a.NoError(err)
+
+	task.AddInstance(Instance{InstanceID: "abc123", Shard: 0, Attempt: 1, Status: InstanceStatusActive})
+	task.Start()
+	err = a.DAL.StartQueuedTask(task)
+	a.NoError(err)
+
+	gotTask, err := a.DAL.GetTask(taskID)
+	a.NoError(err)
+	a.Equal(TaskStatusActive, gotTask.Status)
+	a.Equal([]string{"abc123"}, gotTask.InstanceIDs)
+	a.NotNil(gotTask.StartTime)
+
+	// It can only be started once
+	err = a.DAL.StartQueuedTask(task)
+	a.Equal(mgo.ErrNotFound, err)
+
+	// Queued tasks can be aborted before they start
+	queued := &Task{Status: TaskStatusQueued, BucketName: "test-bucket-2", User: "bob"}
+	_, err = a.DAL.CreateTask(queued)
+	a.NoError(err)
+	queued.Status = TaskStatusAborted
+	queued.End()
+	a.NoError(a.DAL.EndTask(queued))
+
+	err = a.DAL.StartQueuedTask(queued)
+	a.Equal(mgo.ErrNotFound, err)
+}
+
+func (a *AccessTestSuite) TestQuotas() {
+	var err error
+
+	// Users don't have a quota until one is saved
+	_, err = a.DAL.GetQuota("bob")
+	a.Equal(mgo.ErrNotFound, err)
+
+	err = a.DAL.SaveQuota(&Quota{User: "bob", MaxActiveTasks: 2, MaxStorageBytes: 1 << 30})
+	a.NoError(err)
+	err = a.DAL.SaveQuota(&Quota{User: "bob", MaxActiveTasks: 3})
+	a.NoError(err)
+
+	quota, err := a.DAL.GetQuota("bob")
+	a.NoError(err)
+	a.Equal(3, quota.MaxActiveTasks)
+	a.Equal(int64(0), quota.MaxStorageBytes)
+
+	// Deleted tasks only count if they started recently
+	monthStart := time.Now().Add(-time.Hour)
+	lastMonth := monthStart.Add(-time.Hour)
+	for i, task := range []*Task{
+		&Task{Status: TaskStatusCompleted, StartTime: &lastMonth},
+		&Task{Status: TaskStatusDeleted, StartTime: &lastMonth},
+		&Task{Status: TaskStatusDeleted, StartTime: &monthStart},
+	} {
+		task.User = "bob"
+		task.BucketName = fmt.Sprintf("test-bucket-%d", i)
+		_, err = a.DAL.CreateTask(task)
+		a.NoError(err)
+	}
+
+	taskList, err := a.DAL.GetQuotaTasks("bob", monthStart)
+	a.NoError(err)
+	a.Len(taskList.Tasks, 2)
+
+	taskList, err = a.DAL.GetQuotaTasks("alice", monthStart)
+	a.NoError(err)
+	a.Empty(taskList.Tasks)
+}
+
+func (a *AccessTestSuite) TestGetCompletedTasks() {
+	var err error
+
+	// Complete 3 tasks, 2 of them on the same instance type
+	now := time.Now()
+	for i, instanceType := range []string{"c4.large", "c4.large", "t2.micro"} {
+		endTime := now.Add(time.Duration(i) * time.Minute)
+		_, err = a.DAL.CreateTask(&Task{
+			Status:       TaskStatusCompleted,
+			EndTime:      &endTime,
+			InstanceType: instanceType,
+			BucketName:   fmt.Sprintf("test-bucket-%d", i),
+			User:         "bob",
+			Formats:      []ExportSpec{ExportSpec{Format: FormatFHIR}},
+		})
+		a.NoError(err)
+	}
+
+	// The most recent one comes first
+	taskList, err := a.DAL.GetCompletedTasks("c4.large", 10)
+	a.NoError(err)
+	a.Require().Len(taskList.Tasks, 2)
+	a.Equal("test-bucket-1", taskList.Tasks[0].BucketName)
+
+	taskList, err = a.DAL.GetCompletedTasks("c4.large", 1)
+	a.NoError(err)
+	a.Len(taskList.Tasks, 1)
+}
+
+func (a *AccessTestSuite) TestEndTask() {
+	var err error
+
+	// Create a new task
+	task := &Task{
+		Status:      TaskStatusActive,
+		InstanceIDs: []string{"abc123", "def456"},
+		BucketName:  "test-bucket",
+		User:        "bob",
+		Formats:     []ExportSpec{ExportSpec{Format: FormatFHIR}, ExportSpec{Format: FormatCSV}},
+	}
+	task.Start()
+
+	taskID, err := a.DAL.CreateTask(task)
+	a.NoError(err)
+
+	// End it
+	task.Status = TaskStatusCompleted
+	task.End()
+	task.Manifest = &Manifest{
+		Groups: []ManifestGroup{ManifestGroup{
+			Format: FormatFHIR,
+			Shard:  0,
+			Size:   2,
+			Files:  []ManifestFile{ManifestFile{Key: "shard-0/fhir/patient.json", Size: 2}},
+		}},
+		FileCount: 1,
+		TotalSize: 2,
+	}
+	err = a.DAL.EndTask(task)
+	a.NoError(err)
+
+	gotTask, err := a.DAL.GetTask(taskID)
+	a.NoError(err)
+	a.Equal(TaskStatusCompleted, gotTask.Status)
+	a.NotNil(gotTask.EndTime)
+	a.NotNil(gotTask.Manifest)
+	a.Equal(1, gotTask.Manifest.FileCount)
+
+	// A task that is no longer active can't be ended again
+	task.Status = TaskStatusError
+	err = a.DAL.EndTask(task)
+	a.Equal(mgo.ErrNotFound, err)
+
+	gotTask, err = a.DAL.GetTask(taskID)
+	a.NoError(err)
+	a.Equal(TaskStatusCompleted, gotTask.Status)
+}
+
+func (a *AccessTestSuite) TestAggregations() {
+	var err error
+
+	task := &Task{
+		Status:     TaskStatusCompleted,
+		BucketName: "test-bucket",
+		User:       "bob",
+		Formats:    []ExportSpec{ExportSpec{Format: FormatCSV}},
+		Manifest:   &Manifest{Aggregation: AggregationPending, FileCount: 1, TotalSize: 2},
+	}
+	taskID, err := a.DAL.CreateTask(task)
+	a.NoError(err)
+
+	taskList, err := a.DAL.GetPendingAggregations()
+	a.NoError(err)
+	a.Require().Len(taskList.Tasks, 1)
+	a.Equal(taskID, taskList.Tasks[0].ID)
+
+	// Once it's aggregated, it's no longer pending
+	manifest := &Manifest{
+		Archive:     &ManifestFile{Key: "merged/dataset.zip", Size: 3},
+		Aggregation: AggregationDone,
+		FileCount:   2,
+		TotalSize:   5,
+	}
+	err = a.DAL.SetManifest(taskID, manifest)
+	a.NoError(err)
+
+	gotTask, err := a.DAL.GetTask(taskID)
+	a.NoError(err)
+	a.Equal(AggregationDone, gotTask.Manifest.Aggregation)
+	a.Equal(int64(5), gotTask.Manifest.TotalSize)
+
+	taskList, err = a.DAL.GetPendingAggregations()
+	a.NoError(err)
+	a.Empty(taskList.Tasks)
+
+	// The manifest of a task that isn't completed can't be set
+	err = a.DAL.SetManifest("nonexistent", manifest)
+	a.Equal(mgo.ErrNotFound, err)
+}
+
+func (a *AccessTestSuite) TestSetInstanceStatus() {
+	var err error
+
+	// Create a new task with 2 active instances
+	task := &Task{
+		Status:      TaskStatusActive,
+		InstanceIDs: []string{"abc123", "def456"},
+		Instances: []Instance{
+			Instance{InstanceID: "abc123", Shard: 0, Status: InstanceStatusActive},
+			Instance{InstanceID: "def456", Shard: 1, Status: InstanceStatusActive},
+		},
+		BucketName: "test-bucket",
+		User:       "bob",
+		Formats:    []ExportSpec{ExportSpec{Format: FormatFHIR}, ExportSpec{Format: FormatCSV}},
+	}
+	task.Start()
+
+	taskID, err := a.DAL.CreateTask(task)
+	a.NoError(err)
+
+	// Report progress for the first
+	err = a.DAL.SetInstanceProgress(taskID, "abc123", 250, "exporting")
+	a.NoError(err)
+
+	gotTask, err := a.DAL.GetTask(taskID)
+	a.NoError(err)
+	progress := gotTask.GetInstance("abc123")
+	a.Equal(InstanceStatusActive, progress.Status)
+	a.Equal(250, progress.PatientsGenerated)
+	a.Equal("exporting", progress.Phase)
+	a.NotNil(progress.LastHeartbeat)
+
+	// Mark one done and the other failed
+	err = a.DAL.SetInstanceDone(taskID, "abc123", 600)
+	a.NoError(err)
+	err = a.DAL.SetInstanceError(taskID, "def456", "out of memory")
+	a.NoError(err)
+
+	gotTask, err = a.DAL.GetTask(taskID)
+	a.NoError(err)
+
+	done := gotTask.GetInstance("abc123")
+	a.NotNil(done)
+	a.Equal(InstanceStatusDone, done.Status)
+	a.Equal(600, done.PatientsGenerated)
+	a.NotNil(done.DoneTime)
+
+	failed := gotTask.GetInstance("def456")
+	a.NotNil(failed)
+	a.Equal(InstanceStatusError, failed.Status)
+	a.Equal("out of memory", failed.ErrorMessage)
+
+	// An instance that is no longer active can't be updated again
+	err = a.DAL.SetInstanceDone(taskID, "abc123", 700)
+	a.Equal(mgo.ErrNotFound, err)
+
+	// Neither can an unknown instance
+	err = a.DAL.SetInstanceDone(taskID, "ghi789", 700)
+	a.Equal(mgo.ErrNotFound, err)
+
+	gotTask, err = a.DAL.GetTask(taskID)
+	a.NoError(err)
+	a.Equal(600, gotTask.GetInstance("abc123").PatientsGenerated)
+}
+
+func (a *AccessTestSuite) TestAddInstance() {
+	var err error
+
+	task := &Task{
+		Status:      TaskStatusActive,
+		InstanceIDs: []string{"abc123"},
+		Instances: []Instance{
+			Instance{InstanceID: "abc123", Shard: 0, Attempt: 1, Status: InstanceStatusError},
+		},
+		BucketName: "test-bucket",
+		User:       "bob",
+		Formats:    []ExportSpec{ExportSpec{Format: FormatFHIR}},
+	}
+	taskID, err := a.DAL.CreateTask(task)
+	a.NoError(err)
+
+	// Add a retry of the failed shard
+	err = a.DAL.AddInstance(taskID, &Instance{InstanceID: "def456", Shard: 0, Attempt: 2, Status: InstanceStatusActive})
+	a.NoError(err)
+
+	gotTask, err := a.DAL.GetTask(taskID)
+	a.NoError(err)
+	a.Equal([]string{"abc123", "def456"}, gotTask.InstanceIDs)
+	a.Len(gotTask.Instances, 2)
+	a.Equal(2, gotTask.GetInstance("def456").Attempt)
+
+	// Spot instances that are reclaimed are flagged as interrupted
+	err = a.DAL.SetInstanceInterrupted(taskID, "def456", "Spot instance interrupted")
+	a.NoError(err)
+
+	gotTask, err = a.DAL.GetTask(taskID)
+	a.NoError(err)
+	interrupted := gotTask.GetInstance("def456")
+	a.Equal(InstanceStatusError, interrupted.Status)
+	a.True(interrupted.Interrupted)
+	a.False(gotTask.GetInstance("abc123").Interrupted)
+
+	// Instances can't be added once the task has ended
+	gotTask.Status = TaskStatusError
+	err = a.DAL.EndTask(gotTask)
+	a.NoError(err)
+
+	err = a.DAL.AddInstance(taskID, &Instance{InstanceID: "ghi789", Shard: 0, Attempt: 3})
+	a.Equal(mgo.ErrNotFound, err)
+}
+
 func (a *AccessTestSuite) TestDeleteTask() {
 
 	var err error
@@ -235,7 +586,7 @@ func (a *AccessTestSuite) TestDeleteTask() {
 		InstanceIDs: []string{"abc123", "def456"},
 		BucketName:  "test-bucket",
 		User:        "bob",
-		Formats:     []string{"FHIR", "CSV"},
+		Formats:     []ExportSpec{ExportSpec{Format: FormatFHIR}, ExportSpec{Format: FormatCSV}},
 	}
 	task.Start()
 
@@ -255,3 +606,119 @@ func (a *AccessTestSuite) TestDeleteTask() {
 	a.Equal(taskID, gotTask.ID)
 	a.Equal(TaskStatusDeleted, gotTask.Status)
 }
+
+func (a *AccessTestSuite) TestGetTasksByUser() {
+	var err error
+
+	// Add tasks for 2 different users
+	for _, user := range []string{"bob", "bob", "geoff"} {
+		_, err = a.DAL.CreateTask(&Task{
+			Status:     TaskStatusActive,
+			BucketName: "test-bucket",
+			User:       user,
+			Formats:    []ExportSpec{ExportSpec{Format: FormatFHIR}},
+		})
+		a.NoError(err)
+	}
+
+	taskList, err := a.DAL.GetTasksByUser("bob")
+	a.NoError(err)
+	a.Len(taskList.Tasks, 2)
+
+	// Deleted tasks are excluded
+	err = a.DAL.DeleteTask(taskList.Tasks[0].ID)
+	a.NoError(err)
+
+	taskList, err = a.DAL.GetTasksByUser("bob")
+	a.NoError(err)
+	a.Len(taskList.Tasks, 1)
+}
+
+func (a *AccessTestSuite) TestAPIKeys() {
+	var err error
+
+	// Unknown keys aren't found
+	_, err = a.DAL.GetAPIKey("abc123")
+	a.Equal(mgo.ErrNotFound, err)
+
+	// Save a key
+	apiKey := &APIKey{KeyHash: "abc123", User: "bob", Role: RoleUser}
+	err = a.DAL.SaveAPIKey(apiKey)
+	a.NoError(err)
+
+	gotKey, err := a.DAL.GetAPIKey("abc123")
+	a.NoError(err)
+	a.Equal("bob", gotKey.User)
+	a.Equal(RoleUser, gotKey.Role)
+
+	// Saving it again replaces it
+	apiKey.Role = RoleAdmin
+	err = a.DAL.SaveAPIKey(apiKey)
+	a.NoError(err)
+
+	gotKey, err = a.DAL.GetAPIKey("abc123")
+	a.NoError(err)
+	a.Equal(RoleAdmin, gotKey.Role)
+
+	// A key without a hash can't be saved
+	err = a.DAL.SaveAPIKey(&APIKey{User: "geoff", Role: RoleUser})
+	a.Error(err)
+}
+
+func (a *AccessTestSuite) TestWebhookDeliveries() {
+	var err error
+
+	now := time.Now()
+	later := now.Add(time.Minute)
+	first := &WebhookDelivery{TaskID: "abc123", TaskStatus: TaskStatusActive, Status: DeliveryStatusPending, Created: &now}
+	second := &WebhookDelivery{TaskID: "abc123", TaskStatus: TaskStatusCompleted, Status: DeliveryStatusPending, Created: &later}
+	other := &WebhookDelivery{TaskID: "def456", TaskStatus: TaskStatusActive, Status: DeliveryStatusPending, Created: &now}
+
+	// Insert them out of order
+	for _, delivery := range []*WebhookDelivery{second, first, other} {
+		err = a.DAL.CreateWebhookDelivery(delivery)
+		a.NoError(err)
+		a.NotEmpty(delivery.ID)
+	}
+
+	// Deliveries are listed per task, oldest first
+	list, err := a.DAL.GetWebhookDeliveries("abc123")
+	a.NoError(err)
+	a.Require().Len(list.Deliveries, 2)
+	a.Equal(first.ID, list.Deliveries[0].ID)
+	a.Equal(second.ID, list.Deliveries[1].ID)
+
+	// Record a successful attempt
+	first.Status = DeliveryStatusDelivered
+	first.Attempts = append(first.Attempts, WebhookAttempt{Time: &now, StatusCode: 200})
+	err = a.DAL.UpdateWebhookDelivery(first)
+	a.NoError(err)
+
+	list, err = a.DAL.GetWebhookDeliveries("abc123")
+	a.NoError(err)
+	a.Equal(DeliveryStatusDelivered, list.Deliveries[0].Status)
+	a.Len(list.Deliveries[0].Attempts, 1)
+
+	// Delivered events are no longer pending
+	list, err = a.DAL.GetPendingWebhookDeliveries()
+	a.NoError(err)
+	a.Len(list.Deliveries, 2)
+}
+
+func (a *AccessTestSuite) TestModules() {
+	// Nothing is stored yet
+	_, err := a.DAL.GetModule("abc123")
+	a.Equal(mgo.ErrNotFound, err)
+
+	content := []byte(`{"name": "Custom", "states": {}}`)
+	a.NoError(a.DAL.SaveModule("abc123", content))
+	saved, err := a.DAL.GetModule("abc123")
+	a.NoError(err)
+	a.Equal(content, saved)
+
+	// The same module uploaded again is only stored once
+	a.NoError(a.DAL.SaveModule("abc123", content))
+	n, err := a.DB().GridFS(modulesGridFS).Find(nil).Count()
+	a.NoError(err)
+	a.Equal(1, n)
+}
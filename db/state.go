@@ -1,8 +1,15 @@
 package db
 
-import "time"
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
 
 const (
+	TaskStatusQueued    = "queued"
 	TaskStatusActive    = "active"
 	TaskStatusCompleted = "completed"
 	TaskStatusError     = "error"
@@ -18,8 +25,37 @@ const (
 	FormatHTML = "HTML"
 	FormatText = "text"
 	FormatCSV  = "CSV"
+
+	FHIRVersionSTU3  = "STU3"
+	FHIRVersionR4    = "R4"
+	FHIRLayoutBundle = "bundle"
+	FHIRLayoutBulk   = "bulk"
+
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+
+	DeliveryStatusPending   = "pending"
+	DeliveryStatusDelivered = "delivered"
+	DeliveryStatusFailed    = "failed"
+
+	AggregationPending = "pending"
+	AggregationDone    = "done"
+	AggregationFailed  = "failed"
 )
 
+// ValidFormats lists every export format Synthea supports.
+var ValidFormats = []string{FormatFHIR, FormatCCDA, FormatHTML, FormatText, FormatCSV}
+
+// IsValidFormat returns true if format is one of the ValidFormats.
+func IsValidFormat(format string) bool {
+	for _, f := range ValidFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
 // TaskList is a list of Stork Tasks
 type TaskList struct {
 	Tasks []Task `json:"tasks"`
@@ -27,14 +63,299 @@ type TaskList struct {
 
 // Task is a single Stork task
 type Task struct {
-	ID          string     `bson:"_id" json:"id"`
-	Status      string     `bson:"status" json:"status"`
-	StartTime   *time.Time `bson:"startTime" json:"startTime"`
-	EndTime     *time.Time `bson:"endTime" json:"endTime"`
-	InstanceIDs []string   `bson:"instanceIds" json:"instanceIds"`
-	BucketName  string     `bson:"bucketName" json:"bucketName"`
-	User        string     `bson:"user" json:"user"`
-	Formats     []string   `bson:"formats" json:"formats"`
+	ID           string         `bson:"_id" json:"id"`
+	Status       string         `bson:"status" json:"status"`
+	StartTime    *time.Time     `bson:"startTime" json:"startTime"`
+	EndTime      *time.Time     `bson:"endTime" json:"endTime"`
+	InstanceIDs  []string       `bson:"instanceIds" json:"instanceIds"`
+	Instances    []Instance     `bson:"instances" json:"instances"`
+	BucketName   string         `bson:"bucketName" json:"bucketName"`
+	Population   int            `bson:"population" json:"population"`
+	InstanceType string         `bson:"instanceType,omitempty" json:"instanceType,omitempty"`
+	ShardCount   int            `bson:"shardCount" json:"shardCount"`
+	Priority     int            `bson:"priority" json:"priority"`
+	QueuedTime   *time.Time     `bson:"queuedTime,omitempty" json:"queuedTime,omitempty"`
+	User         string         `bson:"user" json:"user"`
+	Formats      []ExportSpec   `bson:"formats" json:"formats"`
+	Synthea      SyntheaOptions `bson:"synthea" json:"synthea"`
+	Modules      []CustomModule `bson:"modules,omitempty" json:"modules,omitempty"`
+	Notify       []string       `bson:"notify,omitempty" json:"notify,omitempty"`
+	Webhook      *Webhook       `bson:"webhook,omitempty" json:"webhook,omitempty"`
+	Retry        RetryPolicy    `bson:"retry" json:"retry"`
+	Spot         bool           `bson:"spot" json:"spot"`
+	Manifest     *Manifest      `bson:"manifest,omitempty" json:"manifest,omitempty"`
+	Recipe       *Recipe        `bson:"recipe,omitempty" json:"recipe,omitempty"`
+	RerunOf      string         `bson:"rerunOf,omitempty" json:"rerunOf,omitempty"`
+}
+
+// SyntheaOptions are the options a task's patients are generated with.
+// Options that aren't set use Synthea's defaults. Every shard of a task is
+// generated with its own seed, derived from the task's Seed, so the same
+// options always generate the same dataset.
+type SyntheaOptions struct {
+	State          string   `bson:"state,omitempty" json:"state,omitempty"`
+	City           string   `bson:"city,omitempty" json:"city,omitempty"`
+	MinAge         int      `bson:"minAge,omitempty" json:"minAge,omitempty"`
+	MaxAge         int      `bson:"maxAge,omitempty" json:"maxAge,omitempty"`
+	Gender         string   `bson:"gender,omitempty" json:"gender,omitempty"`
+	Modules        []string `bson:"modules,omitempty" json:"modules,omitempty"`
+	ExcludeModules []string `bson:"excludeModules,omitempty" json:"excludeModules,omitempty"`
+	YearsOfHistory int      `bson:"yearsOfHistory,omitempty" json:"yearsOfHistory,omitempty"`
+	ReferenceDate  string   `bson:"referenceDate,omitempty" json:"referenceDate,omitempty"`
+	Seed           int64    `bson:"seed" json:"seed"`
+}
+
+// ExportSpec is how a task's patients are exported in one of the
+// ValidFormats. Options that don't apply to the format are left empty.
+type ExportSpec struct {
+	Format string `bson:"format" json:"format"`
+
+	// FHIR only: the FHIR version, and whether each patient is exported as
+	// a bundle or every patient is exported as bulk NDJSON, with a file per
+	// resource type
+	FHIRVersion string `bson:"fhirVersion,omitempty" json:"fhirVersion,omitempty"`
+	FHIRLayout  string `bson:"fhirLayout,omitempty" json:"fhirLayout,omitempty"`
+
+	// CSV only: the columns to export, keyed by table. Tables that aren't
+	// listed are exported with every column.
+	CSVColumns map[string][]string `bson:"csvColumns,omitempty" json:"csvColumns,omitempty"`
+
+	// FHIR and CSV: hospital and practitioner files are exported too,
+	// unless they're excluded
+	ExcludeProviders bool `bson:"excludeProviders,omitempty" json:"excludeProviders,omitempty"`
+}
+
+// The kind of a BSON string element
+const bsonKindString = 0x02
+
+// exportSpec has the fields of ExportSpec, without its methods, so the
+// methods can decode into it.
+type exportSpec ExportSpec
+
+// UnmarshalJSON decodes an ExportSpec, or a bare format name as a spec
+// with only a format.
+func (e *ExportSpec) UnmarshalJSON(data []byte) error {
+	var format string
+	if json.Unmarshal(data, &format) == nil {
+		*e = ExportSpec{Format: format}
+		return nil
+	}
+	return json.Unmarshal(data, (*exportSpec)(e))
+}
+
+// SetBSON decodes an ExportSpec, or a bare format name, like tasks saved
+// before formats had options.
+func (e *ExportSpec) SetBSON(raw bson.Raw) error {
+	if raw.Kind == bsonKindString {
+		*e = ExportSpec{}
+		return raw.Unmarshal(&e.Format)
+	}
+	return raw.Unmarshal((*exportSpec)(e))
+}
+
+// FormatNames returns the format of each spec.
+func FormatNames(specs []ExportSpec) []string {
+	formats := make([]string, len(specs))
+	for i, spec := range specs {
+		formats[i] = spec.Format
+	}
+	return formats
+}
+
+// CustomModule is a Synthea module uploaded with a task. It's stored in the
+// task's namespace under Key when the task starts, and loaded by every
+// instance. Until then, and for reruns, its content is kept in the database
+// apart from the task, by checksum (see DataAccessLayer.SaveModule).
+type CustomModule struct {
+	Key      string `bson:"key" json:"key"`
+	Size     int64  `bson:"size" json:"size"`
+	Checksum string `bson:"checksum" json:"checksum"`
+}
+
+// Recipe is everything needed to generate a task's dataset again: the
+// Synthea options and custom modules, the exact shard layout and seeds, and
+// what it ran on. Custom modules are identified by their checksum.
+// Formats and modules are sorted, so equal recipes look the same.
+type Recipe struct {
+	Population   int            `bson:"population" json:"population"`
+	Formats      []ExportSpec   `bson:"formats" json:"formats"`
+	Synthea      SyntheaOptions `bson:"synthea" json:"synthea"`
+	Modules      []CustomModule `bson:"modules,omitempty" json:"modules,omitempty"`
+	Shards       []RecipeShard  `bson:"shards" json:"shards"`
+	Runner       string         `bson:"runner" json:"runner"`
+	ImageID      string         `bson:"imageId,omitempty" json:"imageId,omitempty"`
+	InstanceType string         `bson:"instanceType" json:"instanceType"`
+	StorkVersion string         `bson:"storkVersion" json:"storkVersion"`
+}
+
+// RecipeShard is a single shard of a Recipe, with its own seed.
+type RecipeShard struct {
+	Index      int   `bson:"index" json:"index"`
+	Population int   `bson:"population" json:"population"`
+	Seed       int64 `bson:"seed" json:"seed"`
+}
+
+// Manifest lists every file a completed task generated, grouped by
+// format and shard.
+//
+// Once the task is completed, its output is aggregated into Merged files,
+// one per CSV table and FHIR resource type, and a single Archive of the
+// whole dataset. Aggregation is the status of that job, if there is one.
+type Manifest struct {
+	Groups      []ManifestGroup `bson:"groups" json:"groups"`
+	Merged      []ManifestFile  `bson:"merged,omitempty" json:"merged,omitempty"`
+	Archive     *ManifestFile   `bson:"archive,omitempty" json:"archive,omitempty"`
+	Aggregation string          `bson:"aggregation,omitempty" json:"aggregation,omitempty"`
+	FileCount   int             `bson:"fileCount" json:"fileCount"`
+	TotalSize   int64           `bson:"totalSize" json:"totalSize"`
+}
+
+// ManifestGroup is every file of one format generated by one shard.
+// Files that don't follow the expected layout are grouped with an
+// empty format and a shard of -1.
+type ManifestGroup struct {
+	Format string         `bson:"format" json:"format"`
+	Shard  int            `bson:"shard" json:"shard"`
+	Size   int64          `bson:"size" json:"size"`
+	Files  []ManifestFile `bson:"files" json:"files"`
+}
+
+// ManifestFile is a single generated file. The URL is only set when the
+// manifest is returned to a user, since download links expire.
+type ManifestFile struct {
+	Key      string `bson:"key" json:"key"`
+	Size     int64  `bson:"size" json:"size"`
+	Checksum string `bson:"checksum" json:"checksum"`
+	URL      string `bson:"-" json:"url,omitempty"`
+}
+
+// RetryPolicy decides how often a failed shard of a task is relaunched.
+// Each shard gets up to MaxAttempts instances, and the delay before each
+// retry starts at BackoffSeconds and doubles with every attempt.
+type RetryPolicy struct {
+	MaxAttempts    int `bson:"maxAttempts" json:"maxAttempts"`
+	BackoffSeconds int `bson:"backoffSeconds" json:"backoffSeconds"`
+}
+
+// Delay returns how long to wait before retrying a shard after the
+// given attempt failed.
+func (r RetryPolicy) Delay(attempt int) time.Duration {
+	delay := time.Duration(r.BackoffSeconds) * time.Second
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+	}
+	return delay
+}
+
+// Webhook is where events are POSTed when a task's status changes. Each
+// event is signed with the secret, which is never returned by the API.
+type Webhook struct {
+	URL    string `bson:"url" json:"url"`
+	Secret string `bson:"secret" json:"-"`
+}
+
+// WebhookDeliveryList is a list of WebhookDeliveries
+type WebhookDeliveryList struct {
+	Deliveries []WebhookDelivery `json:"deliveries"`
+}
+
+// WebhookDelivery is a single event POSTed to a task's webhook, along with
+// every attempt to deliver it. The payload and its signature are fixed when
+// the event is created, so retries send exactly the same request.
+type WebhookDelivery struct {
+	ID          string           `bson:"_id" json:"id"`
+	TaskID      string           `bson:"taskId" json:"taskId"`
+	TaskStatus  string           `bson:"taskStatus" json:"taskStatus"`
+	URL         string           `bson:"url" json:"url"`
+	Payload     string           `bson:"payload" json:"payload"`
+	Signature   string           `bson:"signature" json:"-"`
+	Status      string           `bson:"status" json:"status"`
+	Attempts    []WebhookAttempt `bson:"attempts" json:"attempts"`
+	Created     *time.Time       `bson:"created" json:"created"`
+	NextAttempt *time.Time       `bson:"nextAttempt,omitempty" json:"nextAttempt,omitempty"`
+}
+
+// WebhookAttempt is the outcome of a single attempt to deliver an event.
+type WebhookAttempt struct {
+	Time       *time.Time `bson:"time" json:"time"`
+	StatusCode int        `bson:"statusCode,omitempty" json:"statusCode,omitempty"`
+	Error      string     `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+// Instance is a single Synthea instance generating one shard of a Task.
+// A shard that fails is retried by a new Instance with the next Attempt,
+// so every attempt at every shard is kept.
+type Instance struct {
+	InstanceID        string     `bson:"instanceId" json:"instanceId"`
+	Shard             int        `bson:"shard" json:"shard"`
+	Attempt           int        `bson:"attempt" json:"attempt"`
+	Population        int        `bson:"population" json:"population"`
+	Status            string     `bson:"status" json:"status"`
+	LaunchTime        *time.Time `bson:"launchTime" json:"launchTime"`
+	DoneTime          *time.Time `bson:"doneTime" json:"doneTime"`
+	PatientsGenerated int        `bson:"patientsGenerated" json:"patientsGenerated"`
+	Phase             string     `bson:"phase,omitempty" json:"phase,omitempty"`
+	LastHeartbeat     *time.Time `bson:"lastHeartbeat,omitempty" json:"lastHeartbeat,omitempty"`
+	ErrorMessage      string     `bson:"errorMessage,omitempty" json:"errorMessage,omitempty"`
+	// True if this was a spot instance EC2 reclaimed before it was done.
+	// Interrupted attempts count against the task's retry policy, but are
+	// retried right away, and on-demand.
+	Interrupted bool `bson:"interrupted,omitempty" json:"interrupted,omitempty"`
+	// A hash of the token this instance uses to call back into Stork
+	TokenHash string `bson:"tokenHash" json:"-"`
+}
+
+// GetInstance returns the Instance with the given ID, or nil if
+// no such instance belongs to this task.
+func (t *Task) GetInstance(instanceID string) *Instance {
+	for i := range t.Instances {
+		if t.Instances[i].InstanceID == instanceID {
+			return &t.Instances[i]
+		}
+	}
+	return nil
+}
+
+// AddInstance adds a newly launched instance to the task.
+func (t *Task) AddInstance(instance Instance) {
+	t.Instances = append(t.Instances, instance)
+	t.InstanceIDs = append(t.InstanceIDs, instance.InstanceID)
+}
+
+// ActiveInstanceIDs returns the IDs of the task's instances that are still
+// active. Unlike InstanceIDs, this leaves out attempts that already failed or
+// finished, which the Runner may no longer know about.
+func (t *Task) ActiveInstanceIDs() []string {
+	instanceIDs := []string{}
+	for _, instance := range t.Instances {
+		if instance.Status == InstanceStatusActive {
+			instanceIDs = append(instanceIDs, instance.InstanceID)
+		}
+	}
+	return instanceIDs
+}
+
+// LatestInstances returns the latest attempt at each shard of the task,
+// ordered by shard. Of two instances with the same attempt, which tasks
+// from before interrupted attempts were counted can have, the last one added
+// wins.
+func (t *Task) LatestInstances() []*Instance {
+	latest := make(map[int]*Instance)
+	for i := range t.Instances {
+		instance := &t.Instances[i]
+		if current, ok := latest[instance.Shard]; !ok || instance.Attempt >= current.Attempt {
+			latest[instance.Shard] = instance
+		}
+	}
+
+	instances := make([]*Instance, 0, len(latest))
+	for _, instance := range latest {
+		instances = append(instances, instance)
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Shard < instances[j].Shard
+	})
+	return instances
 }
 
 // ElapsedTime returns the total runtime for this tasks.
@@ -68,3 +389,29 @@ func (t *Task) End() {
 		t.EndTime = &now
 	}
 }
+
+// APIKey authenticates a Stork user. Only a hash of the key itself is
+// stored, and it doubles as the document ID.
+type APIKey struct {
+	KeyHash string     `bson:"_id" json:"-"`
+	User    string     `bson:"user" json:"user"`
+	Role    string     `bson:"role" json:"role"`
+	Email   string     `bson:"email,omitempty" json:"email,omitempty"`
+	Created *time.Time `bson:"created" json:"created"`
+}
+
+// Quota limits how much a single user can run and keep at once. A limit
+// of 0 is unlimited. Users without a quota of their own get the default
+// quota from the config.
+type Quota struct {
+	User                string `bson:"_id" json:"user"`
+	MaxActiveTasks      int    `bson:"maxActiveTasks" json:"maxActiveTasks"`
+	MaxInstances        int    `bson:"maxInstances" json:"maxInstances"`
+	MaxPatientsPerMonth int    `bson:"maxPatientsPerMonth" json:"maxPatientsPerMonth"`
+	MaxStorageBytes     int64  `bson:"maxStorageBytes" json:"maxStorageBytes"`
+}
+
+// IsValidRole returns true if role is RoleUser or RoleAdmin.
+func IsValidRole(role string) bool {
+	return role == RoleUser || role == RoleAdmin
+}
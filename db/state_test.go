@@ -1,10 +1,12 @@
 package db
 
 import (
+	"encoding/json"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/suite"
+	"gopkg.in/mgo.v2/bson"
 )
 
 type StateTestSuite struct {
@@ -25,3 +27,66 @@ func (s *StateTestSuite) TestElapsedTime() {
 	t.End()
 	s.Equal(t.ElapsedTime(), t.EndTime.Sub(*t.StartTime))
 }
+
+func (s *StateTestSuite) TestLatestInstances() {
+	t := new(Task)
+	t.AddInstance(Instance{InstanceID: "a", Shard: 1, Attempt: 1, Status: InstanceStatusError})
+	t.AddInstance(Instance{InstanceID: "b", Shard: 0, Attempt: 1, Status: InstanceStatusActive})
+	t.AddInstance(Instance{InstanceID: "c", Shard: 1, Attempt: 2, Status: InstanceStatusActive})
+	s.Equal([]string{"a", "b", "c"}, t.InstanceIDs)
+
+	latest := t.LatestInstances()
+	s.Len(latest, 2)
+	s.Equal("b", latest[0].InstanceID)
+	s.Equal("c", latest[1].InstanceID)
+
+	// An interrupted instance is relaunched as the same attempt
+	t.AddInstance(Instance{InstanceID: "d", Shard: 1, Attempt: 2, Status: InstanceStatusActive})
+	latest = t.LatestInstances()
+	s.Len(latest, 2)
+	s.Equal("d", latest[1].InstanceID)
+}
+
+func (s *StateTestSuite) TestActiveInstanceIDs() {
+	t := new(Task)
+	s.Empty(t.ActiveInstanceIDs())
+
+	// Retried attempts are kept in InstanceIDs, but aren't active
+	t.AddInstance(Instance{InstanceID: "a", Shard: 0, Attempt: 1, Status: InstanceStatusError})
+	t.AddInstance(Instance{InstanceID: "b", Shard: 1, Attempt: 1, Status: InstanceStatusDone})
+	t.AddInstance(Instance{InstanceID: "c", Shard: 0, Attempt: 2, Status: InstanceStatusActive})
+	s.Equal([]string{"a", "b", "c"}, t.InstanceIDs)
+	s.Equal([]string{"c"}, t.ActiveInstanceIDs())
+}
+
+func (s *StateTestSuite) TestRetryDelay() {
+	policy := RetryPolicy{MaxAttempts: 4, BackoffSeconds: 30}
+	s.Equal(30*time.Second, policy.Delay(1))
+	s.Equal(60*time.Second, policy.Delay(2))
+	s.Equal(120*time.Second, policy.Delay(3))
+}
+
+func (s *StateTestSuite) TestExportSpecDecoding() {
+	// Formats may be bare names
+	specs := []ExportSpec{}
+	err := json.Unmarshal([]byte(`["CSV", {"format": "FHIR", "fhirVersion": "STU3"}]`), &specs)
+	s.NoError(err)
+	s.Equal([]ExportSpec{
+		ExportSpec{Format: FormatCSV},
+		ExportSpec{Format: FormatFHIR, FHIRVersion: FHIRVersionSTU3},
+	}, specs)
+
+	err = json.Unmarshal([]byte(`[42]`), &specs)
+	s.Error(err)
+
+	// Tasks saved before formats had options still load
+	data, err := bson.Marshal(bson.M{"formats": []interface{}{"CSV", bson.M{"format": "FHIR", "fhirLayout": "bulk"}}})
+	s.Require().NoError(err)
+	task := &Task{}
+	s.NoError(bson.Unmarshal(data, task))
+	s.Equal([]ExportSpec{
+		ExportSpec{Format: FormatCSV},
+		ExportSpec{Format: FormatFHIR, FHIRLayout: FHIRLayoutBulk},
+	}, task.Formats)
+	s.Equal([]string{FormatCSV, FormatFHIR}, FormatNames(task.Formats))
+}
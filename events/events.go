@@ -0,0 +1,166 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cjduffett/stork/db"
+)
+
+const (
+	InstanceStarted  = "instance.started"
+	InstanceProgress = "instance.progress"
+	InstanceDone     = "instance.done"
+	InstanceError    = "instance.error"
+	TaskStatus       = "task.status"
+
+	// How many events a subscriber can fall behind by before
+	// it's closed. A closed subscriber can always subscribe again.
+	bufferSize = 64
+)
+
+// Event is something that happened to a task or one of its instances.
+type Event struct {
+	Type     string       `json:"type"`
+	TaskID   string       `json:"taskId"`
+	Time     time.Time    `json:"time"`
+	Status   string       `json:"status"`
+	Instance *db.Instance `json:"instance,omitempty"`
+	Manifest *db.Manifest `json:"manifest,omitempty"`
+}
+
+// NewInstanceEvent returns an event for a change to one instance of a task.
+// The instance is copied, so later changes to it aren't published.
+func NewInstanceEvent(eventType, taskID string, instance *db.Instance) *Event {
+	copied := *instance
+	return &Event{
+		Type:     eventType,
+		TaskID:   taskID,
+		Time:     time.Now(),
+		Status:   instance.Status,
+		Instance: &copied,
+	}
+}
+
+// NewTaskEvent returns an event for the current status of a task,
+// including its manifest if it has one.
+func NewTaskEvent(task *db.Task) *Event {
+	return &Event{
+		Type:     TaskStatus,
+		TaskID:   task.ID,
+		Time:     time.Now(),
+		Status:   task.Status,
+		Manifest: task.Manifest,
+	}
+}
+
+// Terminal returns true if nothing else will happen to the task after this
+// event. A completed task whose output is still being aggregated gets one
+// more event once that's done. Events are shared between subscribers, so
+// they must not be modified.
+func (e *Event) Terminal() bool {
+	if e.Manifest != nil && e.Manifest.Aggregation == db.AggregationPending {
+		return false
+	}
+	return e.Type == TaskStatus && e.Status != db.TaskStatusActive && e.Status != db.TaskStatusQueued
+}
+
+// Bus delivers events about a task to everyone subscribed to that task.
+// Publishing never blocks, so a slow subscriber can't hold up the API or
+// the Reconciler. Instead a subscriber that falls too far behind is closed.
+type Bus struct {
+	mutex       sync.Mutex
+	subscribers map[string]map[*Subscription]bool
+	closed      bool
+}
+
+// NewBus returns a pointer to an initialized Bus
+func NewBus() *Bus {
+	return &Bus{
+		subscribers: make(map[string]map[*Subscription]bool),
+	}
+}
+
+// Subscription receives the events about a single task on C, until it's
+// closed. C is closed when the subscription is.
+type Subscription struct {
+	C <-chan *Event
+
+	bus    *Bus
+	taskID string
+	ch     chan *Event
+}
+
+// Subscribe returns a new Subscription to the events about a task.
+func (b *Bus) Subscribe(taskID string) *Subscription {
+	ch := make(chan *Event, bufferSize)
+	sub := &Subscription{
+		C:      ch,
+		bus:    b,
+		taskID: taskID,
+		ch:     ch,
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		close(ch)
+		return sub
+	}
+	if b.subscribers[taskID] == nil {
+		b.subscribers[taskID] = make(map[*Subscription]bool)
+	}
+	b.subscribers[taskID][sub] = true
+	return sub
+}
+
+// Publish sends an event to everyone subscribed to its task.
+func (b *Bus) Publish(event *Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for sub := range b.subscribers[event.TaskID] {
+		select {
+		case sub.ch <- event:
+		default:
+			b.remove(sub)
+		}
+	}
+}
+
+// Close closes every subscription, and any made afterwards.
+func (b *Bus) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, subs := range b.subscribers {
+		for sub := range subs {
+			b.remove(sub)
+		}
+	}
+	b.closed = true
+}
+
+// Close stops delivery of events to the subscription. It's safe
+// to call more than once.
+func (s *Subscription) Close() {
+	s.bus.mutex.Lock()
+	defer s.bus.mutex.Unlock()
+	s.bus.remove(s)
+}
+
+// remove closes a subscription, if it's still open. The caller
+// must hold the mutex.
+func (b *Bus) remove(sub *Subscription) {
+	subs := b.subscribers[sub.taskID]
+	if !subs[sub] {
+		return
+	}
+
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(b.subscribers, sub.taskID)
+	}
+	close(sub.ch)
+}
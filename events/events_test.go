@@ -0,0 +1,99 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/cjduffett/stork/db"
+	"github.com/stretchr/testify/suite"
+)
+
+type EventsTestSuite struct {
+	suite.Suite
+}
+
+func TestEventsTestSuite(t *testing.T) {
+	suite.Run(t, new(EventsTestSuite))
+}
+
+func (e *EventsTestSuite) TestPublish() {
+	bus := NewBus()
+	first := bus.Subscribe("abc123")
+	second := bus.Subscribe("abc123")
+	other := bus.Subscribe("def456")
+
+	instance := &db.Instance{InstanceID: "i-1", Status: db.InstanceStatusDone}
+	bus.Publish(NewInstanceEvent(InstanceDone, "abc123", instance))
+
+	// Both subscribers to the task get the event
+	for _, sub := range []*Subscription{first, second} {
+		event := <-sub.C
+		e.Equal(InstanceDone, event.Type)
+		e.Equal("i-1", event.Instance.InstanceID)
+		e.False(event.Terminal())
+	}
+
+	// Subscribers to other tasks don't
+	e.Len(other.C, 0)
+
+	// Closed subscriptions don't either
+	second.Close()
+	second.Close()
+	bus.Publish(NewTaskEvent(&db.Task{ID: "abc123", Status: db.TaskStatusCompleted}))
+
+	event := <-first.C
+	e.True(event.Terminal())
+	_, ok := <-second.C
+	e.False(ok)
+}
+
+func (e *EventsTestSuite) TestTerminal() {
+	e.False(NewTaskEvent(&db.Task{ID: "abc123", Status: db.TaskStatusQueued}).Terminal())
+	e.False(NewTaskEvent(&db.Task{ID: "abc123", Status: db.TaskStatusActive}).Terminal())
+	e.True(NewTaskEvent(&db.Task{ID: "abc123", Status: db.TaskStatusAborted}).Terminal())
+
+	// A completed task isn't done until its output is aggregated
+	task := &db.Task{ID: "abc123", Status: db.TaskStatusCompleted, Manifest: &db.Manifest{Aggregation: db.AggregationPending}}
+	e.False(NewTaskEvent(task).Terminal())
+	task.Manifest = &db.Manifest{Aggregation: db.AggregationFailed}
+	e.True(NewTaskEvent(task).Terminal())
+}
+
+func (e *EventsTestSuite) TestInstanceEventCopiesInstance() {
+	instance := &db.Instance{InstanceID: "i-1", Status: db.InstanceStatusActive}
+	event := NewInstanceEvent(InstanceStarted, "abc123", instance)
+
+	instance.Status = db.InstanceStatusDone
+	e.Equal(db.InstanceStatusActive, event.Instance.Status)
+	e.Equal(db.InstanceStatusActive, event.Status)
+}
+
+func (e *EventsTestSuite) TestSlowSubscriber() {
+	bus := NewBus()
+	slow := bus.Subscribe("abc123")
+
+	// A subscriber that falls too far behind is closed, rather than
+	// blocking everyone else
+	task := &db.Task{ID: "abc123", Status: db.TaskStatusActive}
+	for i := 0; i < bufferSize+1; i++ {
+		bus.Publish(NewTaskEvent(task))
+	}
+
+	received := 0
+	for range slow.C {
+		received++
+	}
+	e.Equal(bufferSize, received)
+}
+
+func (e *EventsTestSuite) TestClose() {
+	bus := NewBus()
+	sub := bus.Subscribe("abc123")
+	bus.Close()
+
+	_, ok := <-sub.C
+	e.False(ok)
+
+	// Subscribing after the bus is closed returns a closed subscription
+	_, ok = <-bus.Subscribe("abc123").C
+	e.False(ok)
+}
@@ -0,0 +1,77 @@
+package lifecycle
+
+import (
+	"fmt"
+
+	"github.com/cjduffett/stork/aggregate"
+	"github.com/cjduffett/stork/db"
+	"github.com/cjduffett/stork/logger"
+	"github.com/cjduffett/stork/storage"
+	"gopkg.in/mgo.v2"
+)
+
+// Aggregate merges the output of a completed task's shards into a single
+// dataset, records the merged files in the task's manifest, then announces
+// the new manifest and emails the task's recipients. If aggregation fails the
+// task is still completed, since the files of every shard are still there.
+func (m *Manager) Aggregate(task *db.Task) {
+	manifest, err := m.aggregate(task)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to aggregate the output of task %s: %s", task.ID, err))
+
+		// Anything merged before the failure isn't listed
+		failed := *task.Manifest
+		failed.Aggregation = db.AggregationFailed
+		manifest = &failed
+	} else {
+		logger.Info(fmt.Sprintf("Aggregated the output of task %s", task.ID))
+	}
+
+	err = m.DAL.SetManifest(task.ID, manifest)
+	if err == mgo.ErrNotFound {
+		// The task was deleted in the meantime
+		return
+	}
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to save the manifest of task %s: %s", task.ID, err))
+	}
+
+	// Subscribers and webhooks only got the task's status while it was
+	// still being aggregated
+	task.Manifest = manifest
+	m.statusChanged(task)
+	if m.Notifier != nil {
+		m.notify(task)
+	}
+}
+
+// ResumeAggregations aggregates the output of completed tasks that were
+// still being aggregated when Stork last stopped.
+func (m *Manager) ResumeAggregations() error {
+	taskList, err := m.DAL.GetPendingAggregations()
+	if err != nil {
+		return err
+	}
+
+	for i := range taskList.Tasks {
+		task := &taskList.Tasks[i]
+		m.goBackground(func() { m.Aggregate(task) })
+	}
+	return nil
+}
+
+// aggregate merges the output of a task, and returns its new manifest.
+func (m *Manager) aggregate(task *db.Task) (*db.Manifest, error) {
+	err := aggregate.Aggregate(m.Storage, task.BucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := m.Storage.ListObjects(task.BucketName)
+	if err != nil {
+		return nil, err
+	}
+	manifest := storage.BuildManifest(objects)
+	manifest.Aggregation = db.AggregationDone
+	return manifest, nil
+}
@@ -0,0 +1,399 @@
+package lifecycle
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cjduffett/stork/auth"
+	"github.com/cjduffett/stork/awsutil"
+	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/db"
+	"github.com/cjduffett/stork/events"
+	"github.com/cjduffett/stork/logger"
+	"github.com/cjduffett/stork/notify"
+	"github.com/cjduffett/stork/planner"
+	"github.com/cjduffett/stork/runner"
+	"github.com/cjduffett/stork/storage"
+	"github.com/cjduffett/stork/webhook"
+)
+
+// Manager moves tasks between states, doing whatever else each change
+// requires. Both the API and the Reconciler change task state through it.
+type Manager struct {
+	DAL      *db.DataAccessLayer
+	Config   *config.StorkConfig
+	Runner   runner.Runner
+	Storage  storage.Storage
+	Notifier *notify.Notifier
+	Webhooks *webhook.Dispatcher
+
+	// Every change to a task or its instances is published on Events
+	Events *events.Bus
+
+	// Held while deciding which tasks to start, see SubmitTask. Tasks
+	// picked to start reserve capacity in starting, by ID, so the lock
+	// isn't held while their instances are launched.
+	scheduling sync.Mutex
+	starting   map[string]int
+
+	// Tracks the work ended tasks start in the background, see Wait
+	background sync.WaitGroup
+}
+
+// NewManager returns a pointer to an initialized Manager. The notifier and
+// webhook dispatcher may be nil, in which case nobody is told about changes.
+func NewManager(dal *db.DataAccessLayer, config *config.StorkConfig, runner runner.Runner, storage storage.Storage, notifier *notify.Notifier, webhooks *webhook.Dispatcher) *Manager {
+	return &Manager{
+		DAL:      dal,
+		Config:   config,
+		Runner:   runner,
+		Storage:  storage,
+		Notifier: notifier,
+		Webhooks: webhooks,
+		Events:   events.NewBus(),
+		starting: make(map[string]int),
+	}
+}
+
+// TaskCreated announces a task that was just saved as queued, or a queued
+// task that was just started.
+func (m *Manager) TaskCreated(task *db.Task) {
+	logger.Info(fmt.Sprintf("Task %s is %s", task.ID, task.Status))
+	m.statusChanged(task)
+
+	for i := range task.Instances {
+		m.Events.Publish(events.NewInstanceEvent(events.InstanceStarted, task.ID, &task.Instances[i]))
+	}
+}
+
+// StartTask creates the bucket of a new task, uploads its custom modules to
+// it, and launches an instance for each of its shards, adding them to the
+// task. Saving the task is up to the caller. If anything fails, whatever was
+// created is cleaned up.
+func (m *Manager) StartTask(task *db.Task, shards []planner.Shard) error {
+	err := m.Storage.CreateNamespace(task.BucketName)
+	if err != nil {
+		return err
+	}
+
+	// Custom modules must be in place before any instance starts
+	for _, module := range task.Modules {
+		var content []byte
+		content, err = m.DAL.GetModule(module.Checksum)
+		if err == nil {
+			err = m.Storage.PutObject(task.BucketName, module.Key, bytes.NewReader(content))
+		}
+		if err != nil {
+			m.rollback(task)
+			return err
+		}
+	}
+
+	for _, shard := range shards {
+		instance, err := m.StartInstance(task, shard, 1, task.Spot)
+		if err != nil {
+			m.rollback(task)
+			return err
+		}
+		task.AddInstance(*instance)
+	}
+	task.Start()
+	return nil
+}
+
+// StartInstance launches a new instance to generate one shard of a task.
+// The instance isn't added to the task, that's up to the caller. Each
+// instance gets its own token to call back into Stork with. With spot, a spot
+// instance is requested if there is spot capacity.
+func (m *Manager) StartInstance(task *db.Task, shard planner.Shard, attempt int, spot bool) (*db.Instance, error) {
+	token, err := auth.NewInstanceToken([]byte(m.Config.CallbackSecret), task.ID, shard.Index)
+	if err != nil {
+		return nil, err
+	}
+
+	iConfig := shard.InstanceConfig(awsutil.InstanceConfig{
+		TaskID:           task.ID,
+		BucketName:       task.BucketName,
+		BucketRegion:     m.Storage.Region(),
+		DoneEndpoint:     m.callbackURL(m.Config.DoneEndpoint, task.ID),
+		ProgressEndpoint: m.callbackURL(m.Config.ProgressEndpoint, task.ID),
+		Synthea:          task.Synthea,
+		Formats:          task.Formats,
+	})
+	iConfig.DoneToken = token
+	for _, module := range task.Modules {
+		iConfig.CustomModules = append(iConfig.CustomModules, module.Key)
+	}
+
+	options := awsutil.LaunchOptions{
+		InstanceType: task.InstanceType,
+		Spot:         spot,
+	}
+	if task.Recipe != nil {
+		options.ImageID = task.Recipe.ImageID
+	}
+
+	instanceIDs, err := m.Runner.StartInstances(1, iConfig, options)
+	if err != nil {
+		// Instances may have started even though the request failed
+		if len(instanceIDs) > 0 {
+			m.terminate(instanceIDs)
+		}
+		return nil, err
+	}
+
+	launchTime := time.Now()
+	return &db.Instance{
+		InstanceID: instanceIDs[0],
+		Shard:      shard.Index,
+		Attempt:    attempt,
+		Population: shard.Population,
+		Status:     db.InstanceStatusActive,
+		LaunchTime: &launchTime,
+		TokenHash:  auth.HashToken(token),
+	}, nil
+}
+
+// RetryShard launches the next attempt at the shard of a failed instance,
+// and adds it to the task. If the task is no longer active in the database,
+// the new instance is terminated and mgo.ErrNotFound is returned. The
+// attempt after an interrupted spot instance is launched on-demand, so that
+// it isn't interrupted again.
+func (m *Manager) RetryShard(task *db.Task, failed db.Instance) error {
+	shard := planner.Shard{
+		Index:      failed.Shard,
+		Count:      len(task.LatestInstances()),
+		Population: failed.Population,
+	}
+
+	spot := task.Spot && !failed.Interrupted
+	instance, err := m.StartInstance(task, shard, failed.Attempt+1, spot)
+	if err != nil {
+		return err
+	}
+
+	err = m.DAL.AddInstance(task.ID, instance)
+	if err != nil {
+		m.terminate([]string{instance.InstanceID})
+		return err
+	}
+	logger.Info(fmt.Sprintf("Retrying shard %d of task %s with instance %s, attempt %d of %d",
+		shard.Index, task.ID, instance.InstanceID, instance.Attempt, task.Retry.MaxAttempts))
+
+	task.AddInstance(*instance)
+	m.Events.Publish(events.NewInstanceEvent(events.InstanceStarted, task.ID, instance))
+	return nil
+}
+
+// InstanceDone marks an active instance of a task as done, recording how
+// many patients it generated. If the instance is no longer active in the
+// database, mgo.ErrNotFound is returned.
+func (m *Manager) InstanceDone(task *db.Task, instance *db.Instance, patientsGenerated int) error {
+	err := m.DAL.SetInstanceDone(task.ID, instance.InstanceID, patientsGenerated)
+	if err != nil {
+		return err
+	}
+	logger.Info(fmt.Sprintf("Instance %s of task %s is done", instance.InstanceID, task.ID))
+
+	now := time.Now()
+	instance.Status = db.InstanceStatusDone
+	instance.DoneTime = &now
+	instance.PatientsGenerated = patientsGenerated
+	m.Events.Publish(events.NewInstanceEvent(events.InstanceDone, task.ID, instance))
+	return nil
+}
+
+// InstanceProgress records the progress reported by an active instance of a
+// task. Like InstanceDone, mgo.ErrNotFound is returned if it's no longer active.
+func (m *Manager) InstanceProgress(task *db.Task, instance *db.Instance, patientsGenerated int, phase string) error {
+	err := m.DAL.SetInstanceProgress(task.ID, instance.InstanceID, patientsGenerated, phase)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	instance.PatientsGenerated = patientsGenerated
+	instance.Phase = phase
+	instance.LastHeartbeat = &now
+	m.Events.Publish(events.NewInstanceEvent(events.InstanceProgress, task.ID, instance))
+	return nil
+}
+
+// InstanceFailed marks an active instance of a task as failed. Like
+// InstanceDone, mgo.ErrNotFound is returned if it's no longer active.
+func (m *Manager) InstanceFailed(task *db.Task, instance *db.Instance, message string) error {
+	err := m.DAL.SetInstanceError(task.ID, instance.InstanceID, message)
+	if err != nil {
+		return err
+	}
+	logger.Warning(fmt.Sprintf("Instance %s of task %s failed: %s", instance.InstanceID, task.ID, message))
+
+	now := time.Now()
+	instance.Status = db.InstanceStatusError
+	instance.DoneTime = &now
+	instance.ErrorMessage = message
+	m.Events.Publish(events.NewInstanceEvent(events.InstanceError, task.ID, instance))
+	return nil
+}
+
+// InstanceInterrupted marks an active spot instance of a task as failed
+// because EC2 reclaimed it. Like InstanceDone, mgo.ErrNotFound is returned
+// if it's no longer active.
+func (m *Manager) InstanceInterrupted(task *db.Task, instance *db.Instance) error {
+	message := "Spot instance interrupted"
+	err := m.DAL.SetInstanceInterrupted(task.ID, instance.InstanceID, message)
+	if err != nil {
+		return err
+	}
+	logger.Warning(fmt.Sprintf("Spot instance %s of task %s was interrupted", instance.InstanceID, task.ID))
+
+	now := time.Now()
+	instance.Status = db.InstanceStatusError
+	instance.DoneTime = &now
+	instance.ErrorMessage = message
+	instance.Interrupted = true
+	m.Events.Publish(events.NewInstanceEvent(events.InstanceError, task.ID, instance))
+	return nil
+}
+
+// EndTask records the final status of an active task. A completed task
+// also gets a manifest of every file it generated, and its output is
+// aggregated if config.Aggregate is set. If the task is no longer active in
+// the database, mgo.ErrNotFound is returned.
+func (m *Manager) EndTask(task *db.Task, status string) error {
+	logger.Info(fmt.Sprintf("Task %s is %s", task.ID, status))
+	task.Status = status
+	task.End()
+
+	if status == db.TaskStatusCompleted {
+		objects, err := m.Storage.ListObjects(task.BucketName)
+		if err != nil {
+			// The files are still there, so the manifest
+			// can be built again when it's requested
+			logger.Error(fmt.Sprintf("Failed to build manifest for task %s: %s", task.ID, err))
+		} else {
+			task.Manifest = storage.BuildManifest(objects)
+			if m.Config.Aggregate {
+				task.Manifest.Aggregation = db.AggregationPending
+			}
+		}
+	}
+
+	err := m.DAL.EndTask(task)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to end task %s: %s", task.ID, err))
+		return err
+	}
+
+	// Email in the background, so a slow mail server doesn't hold up
+	// the request or reconciliation pass that ended the task. The
+	// recipients of a task being aggregated are emailed once it's done.
+	ended := *task
+	if task.Manifest != nil && task.Manifest.Aggregation == db.AggregationPending {
+		m.goBackground(func() { m.Aggregate(&ended) })
+	} else if m.Notifier != nil {
+		m.goBackground(func() { m.notify(&ended) })
+	}
+	m.statusChanged(task)
+
+	// The task's instances are done, so queued tasks may fit now
+	if len(task.Instances) > 0 {
+		m.goBackground(m.Schedule)
+	}
+	return nil
+}
+
+// Wait waits for the work started in the background when tasks end, like
+// emails, aggregations and scheduling queued tasks, to finish. It must only
+// be called once nothing else can end tasks, like the Reconciler and API.
+func (m *Manager) Wait() {
+	m.background.Wait()
+}
+
+// goBackground runs f in a new goroutine, which Wait waits for.
+func (m *Manager) goBackground(f func()) {
+	m.background.Add(1)
+	go func() {
+		defer m.background.Done()
+		f()
+	}()
+}
+
+// DeleteTask deletes an inactive task, along with its output. Aborted
+// tasks had their output deleted when they were aborted, and tasks that
+// never left the queue have no output.
+func (m *Manager) DeleteTask(task *db.Task) error {
+	if task.Status != db.TaskStatusAborted && task.StartTime != nil {
+		err := m.Storage.DeleteNamespace(task.BucketName)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := m.DAL.DeleteTask(task.ID)
+	if err != nil {
+		return err
+	}
+
+	logger.Info(fmt.Sprintf("Task %s is %s", task.ID, db.TaskStatusDeleted))
+	task.Status = db.TaskStatusDeleted
+	m.statusChanged(task)
+	return nil
+}
+
+// rollback cleans up any resources created for a task that
+// failed to start. Failures are logged, since there is nothing
+// else the caller can do about them.
+func (m *Manager) rollback(task *db.Task) {
+	logger.Warning("Rolling back task ", task.ID)
+
+	if len(task.InstanceIDs) > 0 {
+		m.terminate(task.InstanceIDs)
+	}
+
+	err := m.Storage.DeleteNamespace(task.BucketName)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+// terminate terminates instances that are of no use, logging any failure
+// since there is nothing else the caller can do about it.
+func (m *Manager) terminate(instanceIDs []string) {
+	err := m.Runner.TerminateInstances(instanceIDs)
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+// callbackURL returns the full URL a Synthea instance should use to call
+// one of the callback endpoints (DoneEndpoint or ProgressEndpoint) for a task.
+func (m *Manager) callbackURL(endpoint, taskID string) string {
+	return m.Config.BaseURL() + strings.Replace(endpoint, ":id", taskID, 1)
+}
+
+// notify emails the recipients of a task that has ended.
+func (m *Manager) notify(task *db.Task) {
+	err := m.Notifier.TaskEnded(task)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to email the recipients of task %s: %s", task.ID, err))
+	}
+}
+
+// statusChanged publishes the new status of a task, and sends it to
+// the task's webhook if it has one.
+func (m *Manager) statusChanged(task *db.Task) {
+	m.Events.Publish(events.NewTaskEvent(task))
+
+	if m.Webhooks == nil {
+		return
+	}
+
+	err := m.Webhooks.TaskStatusChanged(task)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to send a webhook event for task %s: %s", task.ID, err))
+	}
+}
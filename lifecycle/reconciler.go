@@ -0,0 +1,254 @@
+package lifecycle
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cjduffett/stork/awsutil"
+	"github.com/cjduffett/stork/db"
+	"github.com/cjduffett/stork/logger"
+	"gopkg.in/mgo.v2"
+)
+
+// Reconciler periodically compares the state of every active task with
+// the state of its instances in the Runner, and moves tasks to completed or
+// error accordingly. Without it a task whose instances die without pinging the
+// /done endpoint would stay active forever.
+type Reconciler struct {
+	*Manager
+	Interval time.Duration
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewReconciler returns a pointer to an initialized Reconciler
+func NewReconciler(manager *Manager, interval time.Duration) *Reconciler {
+	return &Reconciler{
+		Manager:  manager,
+		Interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start runs the reconciliation loop in a new goroutine, once every Interval.
+func (r *Reconciler) Start() {
+	logger.Info(fmt.Sprintf("Reconciling tasks every %s", r.Interval))
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(r.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				r.Reconcile()
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the reconciliation loop, waiting for any pass in progress to finish.
+func (r *Reconciler) Stop() {
+	close(r.stop)
+	r.wg.Wait()
+	logger.Info("Stopped reconciling tasks")
+}
+
+// Reconcile makes a single pass over all active tasks.
+func (r *Reconciler) Reconcile() {
+	logger.Debug("Reconciling active tasks")
+
+	taskList, err := r.DAL.GetTasksByStatus(db.TaskStatusActive)
+	if err != nil {
+		return
+	}
+
+	for i := range taskList.Tasks {
+		r.reconcileTask(&taskList.Tasks[i])
+	}
+
+	// Start any queued tasks there is capacity for now
+	r.Schedule()
+}
+
+// reconcileTask checks a single active task against its instances,
+// ending the task if all of its instances are done or any failed.
+func (r *Reconciler) reconcileTask(task *db.Task) {
+	// A task without instances will never produce anything. It must not be
+	// described either, since an empty list describes every instance in EC2.
+	if len(task.Instances) == 0 {
+		logger.Warning("Task ", task.ID, " has no instances")
+		r.EndTask(task, db.TaskStatusError)
+		return
+	}
+
+	// Only instances still active in the database need checking. Retired
+	// attempts may be long gone from the Runner.
+	activeIDs := task.ActiveInstanceIDs()
+	var err error
+	statuses := []awsutil.InstanceStatus{}
+	if len(activeIDs) > 0 {
+		statuses, err = r.Runner.DescribeInstanceStatus(activeIDs)
+		if err != nil {
+			return
+		}
+	}
+
+	runnerStatuses := make(map[string]awsutil.InstanceStatus)
+	for _, status := range statuses {
+		runnerStatuses[status.InstanceID] = status
+	}
+
+	// Any instance that is still active in the database but no longer running
+	// died without pinging the /done endpoint, or was an interrupted spot
+	// instance. One that is still running but stopped reporting progress is
+	// stuck, and is terminated.
+	now := time.Now()
+	for i := range task.Instances {
+		instance := &task.Instances[i]
+		if instance.Status != db.InstanceStatusActive {
+			continue
+		}
+
+		var message string
+		runnerStatus, ok := runnerStatuses[instance.InstanceID]
+		switch {
+		case ok && runnerStatus.Interrupted:
+			err = r.InstanceInterrupted(task, instance)
+			if err == mgo.ErrNotFound {
+				return
+			}
+			if err != nil {
+				logger.Error(fmt.Sprintf("Failed to update instance %s: %s", instance.InstanceID, err))
+				return
+			}
+			continue
+		case ok && runnerStatus.Status == db.InstanceStatusActive:
+			if !stalled(instance, now, r.Config.StallTimeout) {
+				continue
+			}
+			message = fmt.Sprintf("Instance stalled, no progress reported since %s", instance.LastHeartbeat.Format(time.RFC3339))
+			err = r.Runner.TerminateInstances([]string{instance.InstanceID})
+			if err != nil {
+				return
+			}
+		case !ok || runnerStatus.Status == db.InstanceStatusDone:
+			message = "Instance terminated without reporting done"
+		default:
+			message = "Instance stopped unexpectedly"
+		}
+
+		err = r.InstanceFailed(task, instance, message)
+		if err == mgo.ErrNotFound {
+			// The instance reported done after this pass started,
+			// so check the task again on the next pass.
+			return
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to update instance %s: %s", instance.InstanceID, err))
+			return
+		}
+	}
+
+	// Relaunch failed shards that have attempts left, once they've backed off
+	for _, failed := range retryable(task, now) {
+		err = r.RetryShard(task, failed)
+		if err == mgo.ErrNotFound {
+			// The task ended after this pass started
+			return
+		}
+		if err != nil {
+			// Try again on the next pass
+			logger.Error(fmt.Sprintf("Failed to retry shard %d of task %s: %s", failed.Shard, task.ID, err))
+		}
+	}
+
+	status := TaskStatus(task)
+	if status == db.TaskStatusActive {
+		return
+	}
+
+	// Terminate any instances that are still running. Once a task
+	// has failed the rest of its output is of no use.
+	stragglers := runningInstances(statuses)
+	if len(stragglers) > 0 {
+		err = r.Runner.TerminateInstances(stragglers)
+		if err != nil {
+			return
+		}
+	}
+
+	r.EndTask(task, status)
+}
+
+// stalled returns true if an instance has reported progress before, but not
+// within the timeout. Instances that never reported progress are left alone,
+// since older Synthea images don't report progress at all.
+func stalled(instance *db.Instance, now time.Time, timeout time.Duration) bool {
+	if timeout <= 0 || instance.LastHeartbeat == nil {
+		return false
+	}
+	return now.Sub(*instance.LastHeartbeat) > timeout
+}
+
+// retryable returns the latest attempts at every shard of a task that
+// failed, have attempts left, and are due to be retried. Interrupted spot
+// instances are due right away.
+func retryable(task *db.Task, now time.Time) []db.Instance {
+	due := []db.Instance{}
+	for _, instance := range task.LatestInstances() {
+		if instance.Status != db.InstanceStatusError {
+			continue
+		}
+		if instance.Attempt >= task.Retry.MaxAttempts {
+			continue
+		}
+		if !instance.Interrupted && instance.DoneTime != nil && now.Before(instance.DoneTime.Add(task.Retry.Delay(instance.Attempt))) {
+			continue
+		}
+		due = append(due, *instance)
+	}
+	return due
+}
+
+// TaskStatus derives the status of a task from the statuses of the latest
+// attempt at each of its shards. A task is in error as soon as one shard
+// fails with no attempts left, and is completed once every shard is done.
+func TaskStatus(task *db.Task) string {
+	active := false
+	for _, instance := range task.LatestInstances() {
+		switch instance.Status {
+		case db.InstanceStatusError:
+			if instance.Attempt >= task.Retry.MaxAttempts {
+				return db.TaskStatusError
+			}
+			// Waiting to be retried
+			active = true
+		case db.InstanceStatusActive:
+			active = true
+		}
+	}
+
+	if active {
+		return db.TaskStatusActive
+	}
+	return db.TaskStatusCompleted
+}
+
+// runningInstances returns the IDs of all instances not yet terminated.
+func runningInstances(statuses []awsutil.InstanceStatus) []string {
+	running := []string{}
+	for _, status := range statuses {
+		if status.Status != db.InstanceStatusDone {
+			running = append(running, status.InstanceID)
+		}
+	}
+	return running
+}
@@ -0,0 +1,221 @@
+package lifecycle
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cjduffett/stork/awsutil"
+	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/db"
+	"github.com/cjduffett/stork/testutil"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/mgo.v2"
+)
+
+type ReconcilerTestSuite struct {
+	suite.Suite
+}
+
+func TestReconcilerTestSuite(t *testing.T) {
+	suite.Run(t, new(ReconcilerTestSuite))
+}
+
+func (r *ReconcilerTestSuite) TestTaskStatus() {
+	task := &db.Task{
+		Instances: []db.Instance{
+			db.Instance{InstanceID: "abc123", Shard: 0, Attempt: 1, Status: db.InstanceStatusDone},
+			db.Instance{InstanceID: "def456", Shard: 1, Attempt: 1, Status: db.InstanceStatusActive},
+		},
+		Retry: db.RetryPolicy{MaxAttempts: 1},
+	}
+
+	// One instance is still running
+	r.Equal(db.TaskStatusActive, TaskStatus(task))
+
+	// Both instances are done
+	task.Instances[1].Status = db.InstanceStatusDone
+	r.Equal(db.TaskStatusCompleted, TaskStatus(task))
+
+	// Without retries, a single failed instance fails the whole task
+	task.Instances = append(task.Instances, db.Instance{InstanceID: "ghi789", Shard: 2, Attempt: 1, Status: db.InstanceStatusError})
+	task.Instances[0].Status = db.InstanceStatusActive
+	r.Equal(db.TaskStatusError, TaskStatus(task))
+
+	// With retries left, the task waits for the shard to be retried
+	task.Retry.MaxAttempts = 2
+	r.Equal(db.TaskStatusActive, TaskStatus(task))
+
+	// Once the retry is done, so is the shard
+	task.Instances[0].Status = db.InstanceStatusDone
+	task.Instances = append(task.Instances, db.Instance{InstanceID: "jkl012", Shard: 2, Attempt: 2, Status: db.InstanceStatusDone})
+	r.Equal(db.TaskStatusCompleted, TaskStatus(task))
+
+	// Until it runs out of attempts
+	task.Instances[3].Status = db.InstanceStatusError
+	r.Equal(db.TaskStatusError, TaskStatus(task))
+}
+
+func (r *ReconcilerTestSuite) TestRetryable() {
+	now := time.Now()
+	failedAt := now.Add(-45 * time.Second)
+	task := &db.Task{
+		Instances: []db.Instance{
+			db.Instance{InstanceID: "abc123", Shard: 0, Attempt: 1, Status: db.InstanceStatusError, DoneTime: &failedAt},
+			db.Instance{InstanceID: "def456", Shard: 1, Attempt: 1, Status: db.InstanceStatusActive},
+		},
+		Retry: db.RetryPolicy{MaxAttempts: 3, BackoffSeconds: 30},
+	}
+
+	// The failed shard has backed off long enough
+	due := retryable(task, now)
+	r.Require().Len(due, 1)
+	r.Equal("abc123", due[0].InstanceID)
+
+	// The second attempt backs off for twice as long
+	task.Instances[0].Attempt = 2
+	r.Empty(retryable(task, now))
+	r.Len(retryable(task, now.Add(time.Minute)), 1)
+
+	// An interrupted spot instance is retried right away
+	task.Instances[0].Interrupted = true
+	r.Len(retryable(task, now), 1)
+
+	// The last attempt isn't retried at all, even if it was interrupted
+	task.Instances[0].Attempt = 3
+	r.Empty(retryable(task, now.Add(time.Hour)))
+	r.Equal(db.TaskStatusError, TaskStatus(task))
+}
+
+func (r *ReconcilerTestSuite) TestRunningInstances() {
+	statuses := []awsutil.InstanceStatus{
+		awsutil.InstanceStatus{InstanceID: "abc123", Status: db.InstanceStatusDone},
+		awsutil.InstanceStatus{InstanceID: "def456", Status: db.InstanceStatusActive},
+		awsutil.InstanceStatus{InstanceID: "ghi789", Status: db.InstanceStatusError},
+	}
+	r.Equal([]string{"def456", "ghi789"}, runningInstances(statuses))
+	r.Empty(runningInstances(statuses[:1]))
+}
+
+func (r *ReconcilerTestSuite) TestStalled() {
+	now := time.Now()
+	instance := &db.Instance{InstanceID: "abc123", Status: db.InstanceStatusActive}
+
+	// Instances that never reported progress aren't checked
+	r.False(stalled(instance, now, time.Minute))
+
+	heartbeat := now.Add(-30 * time.Second)
+	instance.LastHeartbeat = &heartbeat
+	r.False(stalled(instance, now, time.Minute))
+
+	heartbeat = now.Add(-2 * time.Minute)
+	r.True(stalled(instance, now, time.Minute))
+
+	// A zero timeout disables stall detection
+	r.False(stalled(instance, now, 0))
+}
+
+// ReconcileTaskTestSuite checks tasks against instances in a mock EC2
+type ReconcileTaskTestSuite struct {
+	testutil.MongoSuite
+	session    *mgo.Session
+	ec2        *awsutil.EC2Mock
+	reconciler *Reconciler
+}
+
+func TestReconcileTaskTestSuite(t *testing.T) {
+	suite.Run(t, new(ReconcileTaskTestSuite))
+}
+
+func (r *ReconcileTaskTestSuite) SetupSuite() {
+	r.session = r.DB().Session.Copy()
+}
+
+func (r *ReconcileTaskTestSuite) SetupTest() {
+	sConfig := *config.DefaultConfig
+	sConfig.DatabaseName = "stork-test"
+	dal := db.NewDataAccessLayer(r.session, sConfig.DatabaseName)
+
+	r.ec2 = awsutil.NewEC2Mock()
+	s3Mock := awsutil.NewS3Mock()
+	awsClient := &awsutil.AWSClient{
+		Config:   &sConfig,
+		S3:       s3Mock,
+		Uploader: awsutil.NewUploaderMock(s3Mock),
+		EC2:      r.ec2,
+	}
+	r.reconciler = NewReconciler(NewManager(dal, &sConfig, awsClient, awsClient, nil, nil), time.Minute)
+}
+
+func (r *ReconcileTaskTestSuite) TearDownTest() {
+	r.DB().C("tasks").DropCollection()
+}
+
+func (r *ReconcileTaskTestSuite) TearDownSuite() {
+	r.session.Close()
+	r.TearDownDBServer()
+}
+
+func (r *ReconcileTaskTestSuite) TestPurgedInstance() {
+	instanceIDs, err := r.reconciler.Runner.StartInstances(2, &awsutil.InstanceConfig{TaskID: "abc123"}, awsutil.LaunchOptions{})
+	r.Require().NoError(err)
+
+	task := &db.Task{
+		ID:         "abc123",
+		Status:     db.TaskStatusActive,
+		BucketName: "abc123-bucket",
+		Retry:      db.RetryPolicy{MaxAttempts: 1},
+	}
+	for shard, instanceID := range instanceIDs {
+		task.AddInstance(db.Instance{InstanceID: instanceID, Shard: shard, Attempt: 1, Status: db.InstanceStatusActive})
+	}
+	_, err = r.reconciler.DAL.CreateTask(task)
+	r.Require().NoError(err)
+
+	// The first instance died without reporting done, and EC2 has since
+	// forgotten about it
+	r.Require().NoError(r.reconciler.Runner.TerminateInstances(instanceIDs[:1]))
+	r.ec2.Purge(instanceIDs[0])
+
+	r.reconciler.reconcileTask(task)
+
+	saved, err := r.reconciler.DAL.GetTask(task.ID)
+	r.Require().NoError(err)
+	r.Equal(db.TaskStatusError, saved.Status)
+	r.Equal(db.InstanceStatusError, saved.Instances[0].Status)
+	r.Equal("Instance terminated without reporting done", saved.Instances[0].ErrorMessage)
+
+	// The rest of the task's instances are of no use anymore
+	statuses, err := r.reconciler.Runner.DescribeInstanceStatus(instanceIDs[1:])
+	r.NoError(err)
+	r.Require().Len(statuses, 1)
+	r.Equal(db.InstanceStatusDone, statuses[0].Status)
+}
+
+func (r *ReconcileTaskTestSuite) TestRetiredAttemptPurged() {
+	instanceIDs, err := r.reconciler.Runner.StartInstances(2, &awsutil.InstanceConfig{TaskID: "abc123"}, awsutil.LaunchOptions{})
+	r.Require().NoError(err)
+
+	// The first attempt failed and was retried, and EC2 has since
+	// forgotten about it
+	task := &db.Task{
+		ID:         "abc123",
+		Status:     db.TaskStatusActive,
+		BucketName: "abc123-bucket",
+		Retry:      db.RetryPolicy{MaxAttempts: 2},
+	}
+	task.AddInstance(db.Instance{InstanceID: instanceIDs[0], Shard: 0, Attempt: 1, Status: db.InstanceStatusError})
+	task.AddInstance(db.Instance{InstanceID: instanceIDs[1], Shard: 0, Attempt: 2, Status: db.InstanceStatusActive})
+	_, err = r.reconciler.DAL.CreateTask(task)
+	r.Require().NoError(err)
+
+	r.Require().NoError(r.reconciler.Runner.TerminateInstances(instanceIDs[:1]))
+	r.ec2.Purge(instanceIDs[0])
+
+	// The retry is still running, so the task is left alone
+	r.reconciler.reconcileTask(task)
+
+	saved, err := r.reconciler.DAL.GetTask(task.ID)
+	r.Require().NoError(err)
+	r.Equal(db.TaskStatusActive, saved.Status)
+	r.Equal(db.InstanceStatusActive, saved.Instances[1].Status)
+}
@@ -0,0 +1,272 @@
+package lifecycle
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cjduffett/stork/db"
+	"github.com/cjduffett/stork/logger"
+	"github.com/cjduffett/stork/planner"
+	"gopkg.in/mgo.v2"
+)
+
+// The orders queued tasks can be started in, selected by
+// StorkConfig.SchedulerOrder
+const (
+	OrderFIFO     = "fifo"
+	OrderPriority = "priority"
+)
+
+// IsValidOrder returns true if order is OrderFIFO or OrderPriority.
+func IsValidOrder(order string) bool {
+	return order == OrderFIFO || order == OrderPriority
+}
+
+// SubmitTask saves a new task as queued, then starts it right away if there
+// is capacity for all of its shards and no queued task is ahead of it.
+// Otherwise it's left queued, and started by Schedule once there is
+// capacity. A task that fails to start is ended with an error.
+func (m *Manager) SubmitTask(task *db.Task, shards []planner.Shard) error {
+	start, err := m.enqueue(task, shards)
+	if err != nil || !start {
+		return err
+	}
+	defer m.release(task.ID)
+
+	err = m.startQueuedTask(task, shards)
+	if err != nil {
+		m.EndTask(task, db.TaskStatusError)
+		return err
+	}
+	return nil
+}
+
+// Schedule starts as many queued tasks as there is capacity for, in order.
+// A task that doesn't fit holds up the tasks behind it, so large tasks
+// aren't starved by a stream of small ones.
+func (m *Manager) Schedule() {
+	starts := m.reserveQueued()
+	for i, start := range starts {
+		err := m.startQueuedTask(start.task, start.shards)
+		m.release(start.task.ID)
+		if err != nil {
+			// Try again on the next pass, along with the tasks behind it
+			logger.Error(fmt.Sprintf("Failed to start queued task %s: %s", start.task.ID, err))
+			for _, rest := range starts[i+1:] {
+				m.release(rest.task.ID)
+			}
+			return
+		}
+	}
+}
+
+// queuedStart is a queued task picked to be started, and its shards.
+type queuedStart struct {
+	task   *db.Task
+	shards []planner.Shard
+}
+
+// enqueue saves a new task as queued, and returns true if it can start
+// right away. If so, capacity is reserved for its shards until it's
+// released.
+func (m *Manager) enqueue(task *db.Task, shards []planner.Shard) (bool, error) {
+	m.scheduling.Lock()
+	defer m.scheduling.Unlock()
+
+	queue, err := m.queue()
+	if err != nil {
+		return false, err
+	}
+	capacity, err := m.capacity()
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	task.Status = db.TaskStatusQueued
+	task.QueuedTime = &now
+	task.ShardCount = len(shards)
+	_, err = m.DAL.CreateTask(task)
+	if err != nil {
+		return false, err
+	}
+	m.TaskCreated(task)
+
+	ahead := len(queue) > 0 && precedes(&queue[0], task, m.Config.SchedulerOrder)
+	if ahead || !fits(capacity, len(shards)) {
+		return false, nil
+	}
+	m.starting[task.ID] = len(shards)
+	return true, nil
+}
+
+// reserveQueued picks the queued tasks there is capacity for, in order,
+// and reserves capacity for their shards until they're released. Tasks
+// that are already being started are skipped.
+func (m *Manager) reserveQueued() []queuedStart {
+	m.scheduling.Lock()
+	defer m.scheduling.Unlock()
+
+	starts := []queuedStart{}
+	queue, err := m.queue()
+	if err != nil || len(queue) == 0 {
+		return starts
+	}
+	capacity, err := m.capacity()
+	if err != nil {
+		return starts
+	}
+
+	for i := range queue {
+		task := &queue[i]
+		if _, ok := m.starting[task.ID]; ok {
+			continue
+		}
+
+		shards, err := m.queuedShards(task)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to plan queued task %s: %s", task.ID, err))
+			m.EndTask(task, db.TaskStatusError)
+			continue
+		}
+
+		if !fits(capacity, len(shards)) {
+			return starts
+		}
+
+		m.starting[task.ID] = len(shards)
+		starts = append(starts, queuedStart{task: task, shards: shards})
+		if capacity >= 0 {
+			capacity -= len(shards)
+		}
+	}
+	return starts
+}
+
+// release gives back the capacity reserved for a task. By then its
+// instances are counted as running, or it failed to start.
+func (m *Manager) release(taskID string) {
+	m.scheduling.Lock()
+	defer m.scheduling.Unlock()
+
+	delete(m.starting, taskID)
+}
+
+// QueuePosition returns the position of a queued task in the queue,
+// starting from 1.
+func (m *Manager) QueuePosition(task *db.Task) (int, error) {
+	queue, err := m.queue()
+	if err != nil {
+		return 0, err
+	}
+	for i := range queue {
+		if queue[i].ID == task.ID {
+			return i + 1, nil
+		}
+	}
+	return 0, mgo.ErrNotFound
+}
+
+// queuedShards returns the shards of a queued task, as they were planned
+// when it was submitted. Tasks queued before recipes were recorded are
+// planned again, in case the config changed since.
+func (m *Manager) queuedShards(task *db.Task) ([]planner.Shard, error) {
+	if task.Recipe != nil {
+		return planner.RecipeShards(task.Recipe), nil
+	}
+
+	instanceType, ok := m.Config.GetInstanceType(task.InstanceType)
+	if !ok {
+		return nil, fmt.Errorf("instance type %s is no longer allowed", task.InstanceType)
+	}
+	return planner.Plan(task.Population, task.ShardCount, instanceType, m.Config)
+}
+
+// startQueuedTask starts a task that was queued. If it's no longer queued
+// in the database, because it was aborted in the meantime, it's rolled back.
+func (m *Manager) startQueuedTask(task *db.Task, shards []planner.Shard) error {
+	err := m.StartTask(task, shards)
+	if err != nil {
+		return err
+	}
+
+	task.Status = db.TaskStatusActive
+	err = m.DAL.StartQueuedTask(task)
+	if err == mgo.ErrNotFound {
+		m.rollback(task)
+		return nil
+	}
+	if err != nil {
+		m.rollback(task)
+		return err
+	}
+	m.TaskCreated(task)
+	return nil
+}
+
+// queue returns every queued task, in the order they should be started.
+func (m *Manager) queue() ([]db.Task, error) {
+	taskList, err := m.DAL.GetTasksByStatus(db.TaskStatusQueued)
+	if err != nil {
+		return nil, err
+	}
+
+	queue := taskList.Tasks
+	order := m.Config.SchedulerOrder
+	sort.SliceStable(queue, func(i, j int) bool {
+		return precedes(&queue[i], &queue[j], order)
+	})
+	return queue, nil
+}
+
+// capacity returns how many more instances can be started without going
+// over config.MaxRunningInstances, or -1 if there is no limit. It must be
+// called with the scheduling lock held.
+func (m *Manager) capacity() (int, error) {
+	if m.Config.MaxRunningInstances <= 0 {
+		return -1, nil
+	}
+
+	taskList, err := m.DAL.GetTasksByStatus(db.TaskStatusActive)
+	if err != nil {
+		return 0, err
+	}
+
+	// Tasks being started aren't counted as running yet
+	running := 0
+	for _, reserved := range m.starting {
+		running += reserved
+	}
+	for i := range taskList.Tasks {
+		for _, instance := range taskList.Tasks[i].Instances {
+			if instance.Status == db.InstanceStatusActive {
+				running++
+			}
+		}
+	}
+
+	capacity := m.Config.MaxRunningInstances - running
+	if capacity < 0 {
+		return 0, nil
+	}
+	return capacity, nil
+}
+
+// fits returns true if n more instances fit in the capacity.
+func fits(capacity, n int) bool {
+	return capacity < 0 || n <= capacity
+}
+
+// precedes returns true if task a should be started before task b. Tasks
+// are started in the order they were queued, and with OrderPriority higher
+// priority tasks are started first.
+func precedes(a, b *db.Task, order string) bool {
+	if order == OrderPriority && a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if a.QueuedTime == nil || b.QueuedTime == nil {
+		return a.QueuedTime != nil
+	}
+	return a.QueuedTime.Before(*b.QueuedTime)
+}
@@ -0,0 +1,58 @@
+package lifecycle
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/cjduffett/stork/db"
+	"github.com/stretchr/testify/suite"
+)
+
+type SchedulerTestSuite struct {
+	suite.Suite
+}
+
+func TestSchedulerTestSuite(t *testing.T) {
+	suite.Run(t, new(SchedulerTestSuite))
+}
+
+func (s *SchedulerTestSuite) TestPrecedes() {
+	now := time.Now()
+	later := now.Add(time.Minute)
+	first := &db.Task{ID: "first", QueuedTime: &now}
+	urgent := &db.Task{ID: "urgent", QueuedTime: &later, Priority: 5}
+
+	// First come, first served
+	s.True(precedes(first, urgent, OrderFIFO))
+	s.False(precedes(urgent, first, OrderFIFO))
+
+	// Unless priority comes first
+	s.True(precedes(urgent, first, OrderPriority))
+	s.False(precedes(first, urgent, OrderPriority))
+
+	// Tasks with the same priority are still first come, first served
+	urgent.Priority = 0
+	s.True(precedes(first, urgent, OrderPriority))
+
+	queue := []db.Task{*urgent, *first}
+	sort.SliceStable(queue, func(i, j int) bool {
+		return precedes(&queue[i], &queue[j], OrderFIFO)
+	})
+	s.Equal("first", queue[0].ID)
+}
+
+func (s *SchedulerTestSuite) TestFits() {
+	// Without a limit everything fits
+	s.True(fits(-1, 100))
+
+	s.True(fits(4, 4))
+	s.False(fits(4, 5))
+	s.False(fits(0, 1))
+}
+
+func (s *SchedulerTestSuite) TestIsValidOrder() {
+	s.True(IsValidOrder(OrderFIFO))
+	s.True(IsValidOrder(OrderPriority))
+	s.False(IsValidOrder("random"))
+}
@@ -0,0 +1,99 @@
+package notify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/logger"
+)
+
+const (
+	MailerSMTP = "smtp"
+	MailerLog  = "log"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      []string
+	Subject string
+	Body    string
+}
+
+// Bytes formats a message, including its headers, as sent by from.
+func (m *Message) Bytes(from string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.Replace(m.Body, "\n", "\r\n", -1))
+	return buf.Bytes()
+}
+
+// Mailer sends email.
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+// NewMailer returns the Mailer selected by config.Mailer.
+func NewMailer(config *config.StorkConfig) (Mailer, error) {
+	switch config.Mailer {
+	case MailerSMTP:
+		if config.SMTPHost == "" {
+			return nil, errors.New("The smtp mailer requires an SMTP host")
+		}
+		return NewSMTPMailer(config.SMTPHost, config.SMTPPort, config.SMTPUser, config.SMTPPassword, config.MailFrom), nil
+	case MailerLog:
+		return NewLogMailer(config.MailFile, config.MailFrom), nil
+	default:
+		return nil, errors.New("Unknown mailer " + config.Mailer)
+	}
+}
+
+// LogMailer is a Mailer for development that doesn't send anything. Each
+// message is appended to the file at Path, or logged if Path is empty.
+type LogMailer struct {
+	Path string
+	From string
+
+	mutex sync.Mutex
+}
+
+// NewLogMailer returns a pointer to an initialized LogMailer
+func NewLogMailer(path, from string) *LogMailer {
+	return &LogMailer{
+		Path: path,
+		From: from,
+	}
+}
+
+// Send writes a message to the log or file.
+func (l *LogMailer) Send(msg *Message) error {
+	data := msg.Bytes(l.From)
+	if l.Path == "" {
+		logger.Info(fmt.Sprintf("Email to %s:\n%s", strings.Join(msg.To, ", "), data))
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	f, err := os.OpenFile(l.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Separate messages the way an mbox file does
+	_, err = fmt.Fprintf(f, "From %s %s\n%s\n\n", l.From, time.Now().Format(time.ANSIC), data)
+	return err
+}
@@ -0,0 +1,160 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/db"
+	"github.com/cjduffett/stork/storage"
+)
+
+// The most download links included in an email. The rest of a large
+// task's files are listed by GET /task/:id/files.
+const maxLinks = 50
+
+var subjects = map[string]string{
+	db.TaskStatusCompleted: "Your Stork task %s is complete",
+	db.TaskStatusError:     "Your Stork task %s failed",
+	db.TaskStatusAborted:   "Your Stork task %s was aborted",
+}
+
+var bodyTemplate = template.Must(template.New("body").Parse(`Hello {{.Task.User}},
+
+{{if eq .Task.Status "completed" -}}
+Your Stork task {{.Task.ID}} is complete. {{.Patients}} patients were generated in {{.Elapsed}}.
+
+Download your newly generated records before the links expire at {{.Expires.Format "Jan 2, 2006 15:04 MST"}}:
+{{with .Archive}}
+  Every record, in a single archive
+  {{.URL}}
+{{end}}
+{{- range .Links}}
+  {{.Key}}
+  {{.URL}}
+{{end}}
+{{- if .More}}
+  ...and {{.More}} more files.
+{{end}}
+Every file is listed at {{.FilesURL}}
+{{- else if eq .Task.Status "error" -}}
+Your Stork task {{.Task.ID}} failed after {{.Elapsed}}.
+{{range .Task.Instances}}{{if .ErrorMessage}}
+  Shard {{.Shard}}: {{.ErrorMessage}}{{end}}{{end}}
+
+Please try again, or contact your Stork administrator.
+{{- else -}}
+Your Stork task {{.Task.ID}} was aborted after {{.Elapsed}}. No records were kept.
+{{- end}}
+
+Stork
+`))
+
+// Link is a download link for one generated file.
+type Link struct {
+	Key string
+	URL string
+}
+
+// emailData is everything the body template uses.
+type emailData struct {
+	Task     *db.Task
+	Elapsed  time.Duration
+	Patients int
+	Archive  *Link
+	Links    []Link
+	More     int
+	Expires  time.Time
+	FilesURL string
+}
+
+// Notifier emails a task's recipients when the task ends.
+type Notifier struct {
+	Mailer  Mailer
+	Config  *config.StorkConfig
+	Storage storage.Storage
+}
+
+// NewNotifier returns a pointer to an initialized Notifier
+func NewNotifier(mailer Mailer, config *config.StorkConfig, storage storage.Storage) *Notifier {
+	return &Notifier{
+		Mailer:  mailer,
+		Config:  config,
+		Storage: storage,
+	}
+}
+
+// TaskEnded emails the recipients of a task that completed, failed or
+// was aborted. Tasks without recipients are ignored.
+func (n *Notifier) TaskEnded(task *db.Task) error {
+	if len(task.Notify) == 0 {
+		return nil
+	}
+
+	msg, err := n.message(task)
+	if err != nil {
+		return err
+	}
+	return n.Mailer.Send(msg)
+}
+
+// message renders the email for a task that has ended.
+func (n *Notifier) message(task *db.Task) (*Message, error) {
+	subject, ok := subjects[task.Status]
+	if !ok {
+		return nil, fmt.Errorf("No email for a task that is %s", task.Status)
+	}
+
+	elapsed := task.ElapsedTime()
+	data := &emailData{
+		Task:     task,
+		Elapsed:  elapsed - elapsed%time.Second,
+		Expires:  time.Now().Add(n.Config.DownloadExpiry),
+		FilesURL: n.Config.BaseURL() + "/task/" + task.ID + "/files",
+	}
+
+	// Failed attempts may have reported progress before they failed
+	for _, instance := range task.Instances {
+		if instance.Status == db.InstanceStatusDone {
+			data.Patients += instance.PatientsGenerated
+		}
+	}
+
+	if task.Status == db.TaskStatusCompleted && task.Manifest != nil && task.Manifest.Archive != nil {
+		url, err := n.Storage.DownloadURL(task.BucketName, task.Manifest.Archive.Key, n.Config.DownloadExpiry)
+		if err != nil {
+			return nil, err
+		}
+		data.Archive = &Link{Key: task.Manifest.Archive.Key, URL: url}
+	}
+
+	if task.Status == db.TaskStatusCompleted && task.Manifest != nil {
+		for _, group := range task.Manifest.Groups {
+			for _, file := range group.Files {
+				if len(data.Links) == maxLinks {
+					data.More++
+					continue
+				}
+				url, err := n.Storage.DownloadURL(task.BucketName, file.Key, n.Config.DownloadExpiry)
+				if err != nil {
+					return nil, err
+				}
+				data.Links = append(data.Links, Link{Key: file.Key, URL: url})
+			}
+		}
+	}
+
+	var body bytes.Buffer
+	err := bodyTemplate.Execute(&body, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		To:      task.Notify,
+		Subject: fmt.Sprintf(subject, task.ID),
+		Body:    body.String(),
+	}, nil
+}
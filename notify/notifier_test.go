@@ -0,0 +1,203 @@
+package notify
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/db"
+	"github.com/cjduffett/stork/storage"
+	"github.com/stretchr/testify/suite"
+)
+
+type NotifierTestSuite struct {
+	suite.Suite
+	root     string
+	mailer   *mockMailer
+	notifier *Notifier
+}
+
+// mockMailer records every message instead of sending it.
+type mockMailer struct {
+	Sent []*Message
+	Err  error
+}
+
+func (m *mockMailer) Send(msg *Message) error {
+	if m.Err != nil {
+		return m.Err
+	}
+	m.Sent = append(m.Sent, msg)
+	return nil
+}
+
+func TestNotifierTestSuite(t *testing.T) {
+	suite.Run(t, new(NotifierTestSuite))
+}
+
+func (n *NotifierTestSuite) SetupTest() {
+	var err error
+	n.root, err = ioutil.TempDir("", "storktest")
+	n.Require().NoError(err)
+
+	store := storage.NewFileStorage(n.root, "http://localhost:8080", []byte("secret"))
+	n.mailer = &mockMailer{}
+	n.notifier = NewNotifier(n.mailer, config.DefaultConfig, store)
+}
+
+func (n *NotifierTestSuite) TearDownTest() {
+	os.RemoveAll(n.root)
+}
+
+func (n *NotifierTestSuite) TestTaskCompleted() {
+	task := endedTask(db.TaskStatusCompleted)
+	task.Manifest = storage.BuildManifest([]storage.Object{
+		storage.Object{Key: "shard-0/fhir/patient1.json", Size: 10},
+		storage.Object{Key: "shard-1/fhir/patient2.json", Size: 20},
+	})
+
+	n.NoError(n.notifier.TaskEnded(task))
+	n.Require().Len(n.mailer.Sent, 1)
+
+	msg := n.mailer.Sent[0]
+	n.Equal([]string{"jane@example.com"}, msg.To)
+	n.Equal("Your Stork task abc123 is complete", msg.Subject)
+	n.Contains(msg.Body, "1000 patients were generated in 1h30m0s")
+	n.Contains(msg.Body, "shard-1/fhir/patient2.json")
+	n.Contains(msg.Body, "http://localhost:8080/download/stork-abc123/shard-0/fhir/patient1.json?")
+	n.Contains(msg.Body, "http://localhost:8080/task/abc123/files")
+	n.NotContains(msg.Body, "more files")
+	n.NotContains(msg.Body, "single archive")
+}
+
+func (n *NotifierTestSuite) TestTaskCompletedWithArchive() {
+	task := endedTask(db.TaskStatusCompleted)
+	task.Manifest = storage.BuildManifest([]storage.Object{
+		storage.Object{Key: "shard-0/fhir/patient1.json", Size: 10},
+		storage.Object{Key: storage.ArchiveKey, Size: 10},
+	})
+
+	n.NoError(n.notifier.TaskEnded(task))
+	n.Require().Len(n.mailer.Sent, 1)
+
+	body := n.mailer.Sent[0].Body
+	n.Contains(body, "Every record, in a single archive")
+	n.Contains(body, "http://localhost:8080/download/stork-abc123/"+storage.ArchiveKey+"?")
+	n.Contains(body, "http://localhost:8080/download/stork-abc123/shard-0/fhir/patient1.json?")
+}
+
+func (n *NotifierTestSuite) TestTaskCompletedWithManyFiles() {
+	objects := []storage.Object{}
+	for i := 0; i < maxLinks+5; i++ {
+		objects = append(objects, storage.Object{Key: "shard-0/csv/file" + strings.Repeat("x", i) + ".csv"})
+	}
+	task := endedTask(db.TaskStatusCompleted)
+	task.Manifest = storage.BuildManifest(objects)
+
+	n.NoError(n.notifier.TaskEnded(task))
+	n.Require().Len(n.mailer.Sent, 1)
+
+	body := n.mailer.Sent[0].Body
+	n.Equal(maxLinks, strings.Count(body, "/download/"))
+	n.Contains(body, "...and 5 more files.")
+}
+
+func (n *NotifierTestSuite) TestTaskFailed() {
+	task := endedTask(db.TaskStatusError)
+	task.Instances[1].Status = db.InstanceStatusError
+	task.Instances[1].ErrorMessage = "Instance stopped unexpectedly"
+
+	n.NoError(n.notifier.TaskEnded(task))
+	n.Require().Len(n.mailer.Sent, 1)
+
+	msg := n.mailer.Sent[0]
+	n.Equal("Your Stork task abc123 failed", msg.Subject)
+	n.Contains(msg.Body, "failed after 1h30m0s")
+	n.Contains(msg.Body, "Shard 1: Instance stopped unexpectedly")
+	n.NotContains(msg.Body, "/download/")
+}
+
+func (n *NotifierTestSuite) TestTaskAborted() {
+	n.NoError(n.notifier.TaskEnded(endedTask(db.TaskStatusAborted)))
+	n.Require().Len(n.mailer.Sent, 1)
+	n.Equal("Your Stork task abc123 was aborted", n.mailer.Sent[0].Subject)
+}
+
+func (n *NotifierTestSuite) TestNoRecipients() {
+	task := endedTask(db.TaskStatusCompleted)
+	task.Notify = nil
+	n.NoError(n.notifier.TaskEnded(task))
+	n.Empty(n.mailer.Sent)
+}
+
+func (n *NotifierTestSuite) TestActiveTask() {
+	n.Error(n.notifier.TaskEnded(endedTask(db.TaskStatusActive)))
+	n.Empty(n.mailer.Sent)
+}
+
+func (n *NotifierTestSuite) TestMailerError() {
+	n.mailer.Err = errors.New("connection refused")
+	n.Error(n.notifier.TaskEnded(endedTask(db.TaskStatusAborted)))
+}
+
+func (n *NotifierTestSuite) TestLogMailer() {
+	path := filepath.Join(n.root, "mail.txt")
+	mailer := NewLogMailer(path, "stork@localhost")
+
+	n.NoError(mailer.Send(&Message{To: []string{"jane@example.com"}, Subject: "First", Body: "Hello\nJane"}))
+	n.NoError(mailer.Send(&Message{To: []string{"john@example.com"}, Subject: "Second", Body: "Hello John"}))
+
+	data, err := ioutil.ReadFile(path)
+	n.NoError(err)
+	contents := string(data)
+	n.Equal(2, strings.Count(contents, "From stork@localhost "))
+	n.Contains(contents, "To: jane@example.com\r\nSubject: First\r\n")
+	n.Contains(contents, "Hello\r\nJane")
+	n.Contains(contents, "Subject: Second")
+}
+
+func (n *NotifierTestSuite) TestNewMailer() {
+	conf := *config.DefaultConfig
+
+	mailer, err := NewMailer(&conf)
+	n.NoError(err)
+	n.IsType(&LogMailer{}, mailer)
+
+	// SMTP requires a host
+	conf.Mailer = MailerSMTP
+	_, err = NewMailer(&conf)
+	n.Error(err)
+
+	conf.SMTPHost = "smtp.example.com"
+	mailer, err = NewMailer(&conf)
+	n.NoError(err)
+	n.Equal("smtp.example.com:587", mailer.(*SMTPMailer).Addr)
+
+	conf.Mailer = "pigeon"
+	_, err = NewMailer(&conf)
+	n.Error(err)
+}
+
+// endedTask returns a task that ran for 90 minutes on two instances.
+func endedTask(status string) *db.Task {
+	end := time.Now()
+	start := end.Add(-90 * time.Minute)
+	return &db.Task{
+		ID:         "abc123",
+		Status:     status,
+		StartTime:  &start,
+		EndTime:    &end,
+		BucketName: "stork-abc123",
+		User:       "jane",
+		Notify:     []string{"jane@example.com"},
+		Instances: []db.Instance{
+			db.Instance{InstanceID: "i-1", Shard: 0, Status: db.InstanceStatusDone, PatientsGenerated: 500},
+			db.Instance{InstanceID: "i-2", Shard: 1, Status: db.InstanceStatusDone, PatientsGenerated: 500},
+		},
+	}
+}
@@ -0,0 +1,33 @@
+package notify
+
+import (
+	"net"
+	"net/smtp"
+)
+
+// SMTPMailer sends email through an SMTP server. If a username is
+// configured it authenticates with PLAIN auth, which net/smtp only
+// allows over TLS or to localhost.
+type SMTPMailer struct {
+	Addr string
+	From string
+
+	auth smtp.Auth
+}
+
+// NewSMTPMailer returns a pointer to an initialized SMTPMailer
+func NewSMTPMailer(host, port, username, password, from string) *SMTPMailer {
+	mailer := &SMTPMailer{
+		Addr: net.JoinHostPort(host, port),
+		From: from,
+	}
+	if username != "" {
+		mailer.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return mailer
+}
+
+// Send sends a message to all of its recipients.
+func (s *SMTPMailer) Send(msg *Message) error {
+	return smtp.SendMail(s.Addr, s.auth, s.From, msg.To, msg.Bytes(s.From))
+}
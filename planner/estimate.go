@@ -0,0 +1,104 @@
+package planner
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/db"
+)
+
+// Estimate is what a planned task is expected to cost, and how long it's
+// expected to take. Costs are in USD, and assume on-demand instances.
+type Estimate struct {
+	Shards       []Shard             `json:"shards"`
+	Instances    int                 `json:"instances"`
+	InstanceType config.InstanceType `json:"instanceType"`
+
+	// Patients a single instance generates per hour, learned from the
+	// given number of past tasks. Without any, it's the instance type's
+	// own estimate.
+	PatientsPerHour float64 `json:"patientsPerHour"`
+	SampleTasks     int     `json:"sampleTasks"`
+
+	Duration time.Duration `json:"-"`
+	EC2Cost  float64       `json:"ec2Cost"`
+	S3Cost   float64       `json:"s3Cost"`
+	Cost     float64       `json:"cost"`
+}
+
+// Throughput returns the average number of patients a single instance
+// generated per hour in past completed tasks, and how many tasks that's
+// based on. Tasks that didn't take any time are skipped.
+func Throughput(tasks []db.Task) (float64, int) {
+	total := 0.0
+	samples := 0
+	for i := range tasks {
+		task := &tasks[i]
+		hours := task.ElapsedTime().Hours()
+		shards := len(task.LatestInstances())
+		if hours <= 0 || shards == 0 {
+			continue
+		}
+
+		patients := 0
+		for _, instance := range task.LatestInstances() {
+			patients += instance.PatientsGenerated
+		}
+		if patients == 0 {
+			patients = task.Population
+		}
+
+		total += float64(patients) / float64(shards) / hours
+		samples++
+	}
+
+	if samples == 0 {
+		return 0, 0
+	}
+	return total / float64(samples), samples
+}
+
+// NewEstimate estimates the wall-clock time and cost of running shards on
+// instanceType at patientsPerHour per instance. Instances are billed per
+// second, and the output is stored for a month. An error is returned if
+// there's no price for instanceType.
+func NewEstimate(shards []Shard, instanceType config.InstanceType, patientsPerHour float64, formats []string, prices *config.Prices) (*Estimate, error) {
+	hourlyPrice, ok := prices.InstanceHourly[instanceType.Name]
+	if !ok {
+		return nil, fmt.Errorf("No hourly price for instance type %s", instanceType.Name)
+	}
+
+	estimate := &Estimate{
+		Shards:          shards,
+		Instances:       len(shards),
+		InstanceType:    instanceType,
+		PatientsPerHour: patientsPerHour,
+	}
+
+	population := 0
+	instanceHours := 0.0
+	for _, shard := range shards {
+		population += shard.Population
+		hours := float64(shard.Population) / patientsPerHour
+		instanceHours += hours
+
+		// Shards run in parallel, so the task takes as long as the largest
+		duration := time.Duration(hours * float64(time.Hour))
+		if duration > estimate.Duration {
+			estimate.Duration = duration
+		}
+	}
+	estimate.EC2Cost = instanceHours * hourlyPrice
+
+	// Every format is at least one file per patient
+	var bytes int64
+	for _, format := range formats {
+		bytes += prices.BytesPerPatient[format] * int64(population)
+	}
+	puts := float64(population * len(formats))
+	estimate.S3Cost = float64(bytes)/1e9*prices.S3GBMonth + puts/1000*prices.S3PutPer1000
+
+	estimate.Cost = estimate.EC2Cost + estimate.S3Cost
+	return estimate, nil
+}
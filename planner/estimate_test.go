@@ -0,0 +1,88 @@
+package planner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/db"
+	"github.com/stretchr/testify/suite"
+)
+
+type EstimateTestSuite struct {
+	suite.Suite
+}
+
+func TestEstimateTestSuite(t *testing.T) {
+	suite.Run(t, new(EstimateTestSuite))
+}
+
+func (e *EstimateTestSuite) TestThroughput() {
+	// Without past tasks there's nothing to learn from
+	rate, samples := Throughput(nil)
+	e.Equal(0.0, rate)
+	e.Equal(0, samples)
+
+	start := time.Now().Add(-2 * time.Hour)
+	end := time.Now()
+	tasks := []db.Task{
+		// 2 instances generated 4000 patients in 2 hours
+		db.Task{
+			StartTime:  &start,
+			EndTime:    &end,
+			Population: 4000,
+			Instances: []db.Instance{
+				db.Instance{Shard: 0, Attempt: 1, PatientsGenerated: 2000},
+				db.Instance{Shard: 1, Attempt: 1, PatientsGenerated: 2000},
+			},
+		},
+		// 1 instance generated 6000 patients in 2 hours, on its second attempt
+		db.Task{
+			StartTime:  &start,
+			EndTime:    &end,
+			Population: 6000,
+			Instances: []db.Instance{
+				db.Instance{Shard: 0, Attempt: 1, Status: db.InstanceStatusError},
+				db.Instance{Shard: 0, Attempt: 2, PatientsGenerated: 6000},
+			},
+		},
+		// Tasks that never started are skipped
+		db.Task{Population: 1000},
+	}
+
+	rate, samples = Throughput(tasks)
+	e.Equal(2, samples)
+	e.InDelta(2000.0, rate, 1)
+}
+
+func (e *EstimateTestSuite) TestNewEstimate() {
+	instanceType := config.InstanceType{Name: "c4.large", VCPUs: 2, MemoryGiB: 3.75, PatientsPerHour: 1000}
+	prices := &config.Prices{
+		InstanceHourly:  map[string]float64{"c4.large": 0.1},
+		S3GBMonth:       0.02,
+		S3PutPer1000:    0.005,
+		BytesPerPatient: map[string]int64{db.FormatFHIR: 1000000},
+	}
+	shards := []Shard{
+		Shard{Index: 0, Count: 2, Population: 1500},
+		Shard{Index: 1, Count: 2, Population: 1000},
+	}
+
+	estimate, err := NewEstimate(shards, instanceType, 1000, []string{db.FormatFHIR}, prices)
+	e.Require().NoError(err)
+	e.Equal(2, estimate.Instances)
+	e.Equal("c4.large", estimate.InstanceType.Name)
+
+	// The largest shard takes an hour and a half
+	e.Equal(90*time.Minute, estimate.Duration)
+
+	// 2.5 instance hours, 2.5GB stored and 2500 PUTs
+	e.InDelta(0.25, estimate.EC2Cost, 0.0001)
+	e.InDelta(0.0625, estimate.S3Cost, 0.0001)
+	e.InDelta(0.3125, estimate.Cost, 0.0001)
+
+	// Instance types without a price can't be estimated
+	instanceType.Name = "c4.xlarge"
+	_, err = NewEstimate(shards, instanceType, 1000, []string{db.FormatFHIR}, prices)
+	e.Error(err)
+}
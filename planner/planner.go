@@ -0,0 +1,103 @@
+package planner
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/cjduffett/stork/awsutil"
+	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/storage"
+)
+
+// Shard describes one instance's share of a task's total population.
+type Shard struct {
+	Index      int `json:"index"`
+	Count      int `json:"count"`
+	Population int `json:"population"`
+}
+
+// Plan splits a task's total population into at most maxInstances shards.
+// Every shard generates at least config.MinPopulationSize patients, so fewer
+// than maxInstances shards are planned for small populations. Any remainder
+// is handed out one patient at a time, starting with the first shard, so no
+// two shards differ by more than 1 patient. No shard may generate more patients
+// than an instance of instanceType can within config.MaxShardDuration, so
+// large populations need enough instances.
+func Plan(population int, maxInstances int, instanceType config.InstanceType, config *config.StorkConfig) ([]Shard, error) {
+	if maxInstances < 1 {
+		return nil, errors.New("at least 1 instance is required")
+	}
+
+	if population < config.MinPopulationSize {
+		return nil, fmt.Errorf("population must be at least %d", config.MinPopulationSize)
+	}
+
+	// Use as many instances as possible without any of them
+	// dropping below the minimum population size.
+	count := population / config.MinPopulationSize
+	if count > maxInstances {
+		count = maxInstances
+	}
+
+	base := population / count
+	remainder := population % count
+
+	ceiling := instanceType.MaxPopulation(config.MaxShardDuration, config.MinPopulationSize)
+	if base > ceiling || (base == ceiling && remainder > 0) {
+		needed := (population + ceiling - 1) / ceiling
+		return nil, fmt.Errorf("a population of %d needs at least %d %s instances", population, needed, instanceType.Name)
+	}
+
+	shards := make([]Shard, count)
+	for i := range shards {
+		shards[i] = Shard{
+			Index:      i,
+			Count:      count,
+			Population: base,
+		}
+		if i < remainder {
+			shards[i].Population++
+		}
+	}
+	return shards, nil
+}
+
+// InstanceConfig returns a copy of base configured to generate only
+// this shard's slice of the dataset, with this shard's own seed derived
+// from the task's seed in base.
+func (s Shard) InstanceConfig(base awsutil.InstanceConfig) *awsutil.InstanceConfig {
+	iConfig := base
+	iConfig.ShardIndex = s.Index
+	iConfig.ShardCount = s.Count
+	iConfig.Population = s.Population
+	iConfig.OutputPrefix = storage.ShardPrefix(s.Index)
+	iConfig.Synthea.Seed = ShardSeed(base.Synthea.Seed, s.Index)
+	return &iConfig
+}
+
+// NewSeed returns a random, non-zero seed for a task.
+func NewSeed() (int64, error) {
+	for {
+		var seed int64
+		err := binary.Read(rand.Reader, binary.BigEndian, &seed)
+		if err != nil {
+			return 0, err
+		}
+		if seed != 0 {
+			return seed, nil
+		}
+	}
+}
+
+// ShardSeed derives the seed of a single shard from the seed of its task.
+// Shards of the same task get unrelated seeds, and a retried shard gets the
+// same seed as the attempt before it. This is the SplitMix64 mixing function,
+// applied to the task's seed offset by the shard index.
+func ShardSeed(taskSeed int64, index int) int64 {
+	z := uint64(taskSeed) + uint64(index+1)*0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return int64(z ^ (z >> 31))
+}
@@ -0,0 +1,145 @@
+package planner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cjduffett/stork/awsutil"
+	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/db"
+	"github.com/stretchr/testify/suite"
+)
+
+type PlannerTestSuite struct {
+	suite.Suite
+}
+
+func TestPlannerTestSuite(t *testing.T) {
+	suite.Run(t, new(PlannerTestSuite))
+}
+
+func (p *PlannerTestSuite) TestPlanEvenSplit() {
+	sConfig := config.DefaultConfig
+	defaultType, _ := sConfig.GetInstanceType("")
+
+	shards, err := Plan(sConfig.MinPopulationSize*4, 4, defaultType, sConfig)
+	p.NoError(err)
+	p.Len(shards, 4)
+
+	for i, shard := range shards {
+		p.Equal(i, shard.Index)
+		p.Equal(4, shard.Count)
+		p.Equal(sConfig.MinPopulationSize, shard.Population)
+	}
+}
+
+func (p *PlannerTestSuite) TestPlanRemainder() {
+	sConfig := config.DefaultConfig
+	defaultType, _ := sConfig.GetInstanceType("")
+
+	// 3 patients left over should go to the first 3 shards
+	population := sConfig.MinPopulationSize*4 + 3
+	shards, err := Plan(population, 4, defaultType, sConfig)
+	p.NoError(err)
+	p.Len(shards, 4)
+
+	total := 0
+	for _, shard := range shards {
+		total += shard.Population
+	}
+	p.Equal(population, total)
+	p.Equal(sConfig.MinPopulationSize+1, shards[0].Population)
+	p.Equal(sConfig.MinPopulationSize+1, shards[2].Population)
+	p.Equal(sConfig.MinPopulationSize, shards[3].Population)
+}
+
+func (p *PlannerTestSuite) TestPlanRespectsMinPopulationSize() {
+	sConfig := config.DefaultConfig
+	defaultType, _ := sConfig.GetInstanceType("")
+
+	// Only 2 instances can be used without dropping below the minimum
+	shards, err := Plan(sConfig.MinPopulationSize*2+10, 10, defaultType, sConfig)
+	p.NoError(err)
+	p.Len(shards, 2)
+	for _, shard := range shards {
+		p.True(shard.Population >= sConfig.MinPopulationSize)
+	}
+
+	// A population that's too small can't be planned at all
+	_, err = Plan(sConfig.MinPopulationSize-1, 1, defaultType, sConfig)
+	p.Error(err)
+
+	// Neither can a plan without instances
+	_, err = Plan(sConfig.MinPopulationSize, 0, defaultType, sConfig)
+	p.Error(err)
+}
+
+func (p *PlannerTestSuite) TestPlanRespectsInstanceThroughput() {
+	sConfig := *config.DefaultConfig
+	sConfig.MaxShardDuration = 2 * time.Hour
+	instanceType := config.InstanceType{Name: "c4.large", VCPUs: 2, MemoryGiB: 3.75, PatientsPerHour: 1000}
+
+	// Each instance can generate at most 2000 patients
+	shards, err := Plan(4000, 2, instanceType, &sConfig)
+	p.NoError(err)
+	p.Len(shards, 2)
+
+	// So 4001 patients need a third instance
+	_, err = Plan(4001, 2, instanceType, &sConfig)
+	p.Error(err)
+	p.Contains(err.Error(), "at least 3 c4.large instances")
+
+	shards, err = Plan(4001, 3, instanceType, &sConfig)
+	p.NoError(err)
+	p.Len(shards, 3)
+
+	// A slow instance type can still generate the minimum population
+	instanceType.PatientsPerHour = 1
+	shards, err = Plan(sConfig.MinPopulationSize, 1, instanceType, &sConfig)
+	p.NoError(err)
+	p.Len(shards, 1)
+}
+
+func (p *PlannerTestSuite) TestShardInstanceConfig() {
+	base := awsutil.InstanceConfig{
+		TaskID:           "123abc",
+		BucketName:       "123abc-bucket",
+		BucketRegion:     "us-east-1",
+		DoneEndpoint:     "https://stork.com/tasks/123abc/done",
+		ProgressEndpoint: "https://stork.com/tasks/123abc/progress",
+		Synthea:          db.SyntheaOptions{State: "Massachusetts", Seed: 42},
+	}
+
+	shard := Shard{Index: 1, Count: 3, Population: 600}
+	iConfig := shard.InstanceConfig(base)
+	p.Equal("123abc", iConfig.TaskID)
+	p.Equal(1, iConfig.ShardIndex)
+	p.Equal(3, iConfig.ShardCount)
+	p.Equal(600, iConfig.Population)
+	p.Equal("shard-1/", iConfig.OutputPrefix)
+	p.Equal("Massachusetts", iConfig.Synthea.State)
+	p.Equal(ShardSeed(42, 1), iConfig.Synthea.Seed)
+
+	// The base config must not be modified
+	p.Equal(0, base.Population)
+	p.Equal(0, base.ShardCount)
+	p.Equal(int64(42), base.Synthea.Seed)
+}
+
+func (p *PlannerTestSuite) TestShardSeed() {
+	// Seeds are reproducible
+	p.Equal(ShardSeed(42, 0), ShardSeed(42, 0))
+
+	// But differ between shards and tasks
+	seeds := make(map[int64]bool)
+	for _, taskSeed := range []int64{1, 2, 42, -7} {
+		for index := 0; index < 100; index++ {
+			seeds[ShardSeed(taskSeed, index)] = true
+		}
+	}
+	p.Len(seeds, 400)
+
+	seed, err := NewSeed()
+	p.NoError(err)
+	p.NotEqual(int64(0), seed)
+}
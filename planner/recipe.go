@@ -0,0 +1,85 @@
+package planner
+
+import (
+	"sort"
+
+	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/db"
+	"github.com/cjduffett/stork/runner"
+)
+
+// NewRecipe returns the recipe of a task that's about to be generated with
+// the given shards, on the given Synthea image. If the image is empty, it's
+// the image the configured runner uses.
+func NewRecipe(task *db.Task, shards []Shard, imageID string, sConfig *config.StorkConfig) *db.Recipe {
+	if imageID == "" {
+		imageID = sConfig.SyntheaImageID
+		if sConfig.Runner == runner.RunnerLocal {
+			imageID = sConfig.LocalImage
+		}
+	}
+
+	synthea := task.Synthea
+	synthea.Modules = normalize(synthea.Modules)
+	synthea.ExcludeModules = normalize(synthea.ExcludeModules)
+
+	recipe := &db.Recipe{
+		Population:   task.Population,
+		Formats:      sortedFormats(task.Formats),
+		Synthea:      synthea,
+		Modules:      task.Modules,
+		Shards:       make([]db.RecipeShard, len(shards)),
+		Runner:       sConfig.Runner,
+		ImageID:      imageID,
+		InstanceType: task.InstanceType,
+		StorkVersion: config.Version,
+	}
+	for i, shard := range shards {
+		recipe.Shards[i] = db.RecipeShard{
+			Index:      shard.Index,
+			Population: shard.Population,
+			Seed:       ShardSeed(task.Synthea.Seed, shard.Index),
+		}
+	}
+	return recipe
+}
+
+// RecipeShards returns the exact shard layout of a recipe.
+func RecipeShards(recipe *db.Recipe) []Shard {
+	shards := make([]Shard, len(recipe.Shards))
+	for i, shard := range recipe.Shards {
+		shards[i] = Shard{
+			Index:      shard.Index,
+			Count:      len(recipe.Shards),
+			Population: shard.Population,
+		}
+	}
+	return shards
+}
+
+// sortedFormats returns a copy of a task's export specs, sorted by format.
+func sortedFormats(specs []db.ExportSpec) []db.ExportSpec {
+	sorted := append([]db.ExportSpec{}, specs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Format < sorted[j].Format
+	})
+	return sorted
+}
+
+// normalize returns a sorted copy of values without duplicates.
+func normalize(values []string) []string {
+	if len(values) == 0 {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	normalized := []string{}
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			normalized = append(normalized, value)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized
+}
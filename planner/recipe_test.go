@@ -0,0 +1,76 @@
+package planner
+
+import (
+	"testing"
+
+	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/db"
+	"github.com/stretchr/testify/suite"
+)
+
+type RecipeTestSuite struct {
+	suite.Suite
+}
+
+func TestRecipeTestSuite(t *testing.T) {
+	suite.Run(t, new(RecipeTestSuite))
+}
+
+func (r *RecipeTestSuite) TestNewRecipe() {
+	sConfig := config.DefaultConfig
+	defaultType, _ := sConfig.GetInstanceType("")
+
+	task := &db.Task{
+		Population:   sConfig.MinPopulationSize*3 + 1,
+		InstanceType: defaultType.Name,
+		Formats: []db.ExportSpec{
+			db.ExportSpec{Format: db.FormatFHIR, FHIRVersion: db.FHIRVersionR4},
+			db.ExportSpec{Format: db.FormatCSV},
+		},
+		Synthea: db.SyntheaOptions{
+			State:   "Massachusetts",
+			Modules: []string{"diabetes", "asthma"},
+			Seed:    42,
+		},
+	}
+	shards, err := Plan(task.Population, 3, defaultType, sConfig)
+	r.Require().NoError(err)
+
+	recipe := NewRecipe(task, shards, "", sConfig)
+	r.Equal(task.Population, recipe.Population)
+	r.Equal([]string{db.FormatCSV, db.FormatFHIR}, db.FormatNames(recipe.Formats))
+	r.Equal(db.FHIRVersionR4, recipe.Formats[1].FHIRVersion)
+	r.Equal([]string{"asthma", "diabetes"}, recipe.Synthea.Modules)
+	r.Nil(recipe.Synthea.ExcludeModules)
+	r.Equal(int64(42), recipe.Synthea.Seed)
+	r.Equal(sConfig.Runner, recipe.Runner)
+	r.Equal(sConfig.SyntheaImageID, recipe.ImageID)
+	r.Equal(defaultType.Name, recipe.InstanceType)
+	r.Equal(config.Version, recipe.StorkVersion)
+
+	r.Require().Len(recipe.Shards, 3)
+	for i, shard := range recipe.Shards {
+		r.Equal(i, shard.Index)
+		r.Equal(shards[i].Population, shard.Population)
+		r.Equal(ShardSeed(42, i), shard.Seed)
+	}
+
+	// The task itself isn't normalized
+	r.Equal([]string{"diabetes", "asthma"}, task.Synthea.Modules)
+	r.Equal(db.FormatFHIR, task.Formats[0].Format)
+
+	// Reruns keep the image of the original task
+	recipe = NewRecipe(task, shards, "ami-12345678", sConfig)
+	r.Equal("ami-12345678", recipe.ImageID)
+}
+
+func (r *RecipeTestSuite) TestRecipeShards() {
+	sConfig := config.DefaultConfig
+	defaultType, _ := sConfig.GetInstanceType("")
+
+	task := &db.Task{Population: sConfig.MinPopulationSize*4 + 3, Synthea: db.SyntheaOptions{Seed: 7}}
+	shards, err := Plan(task.Population, 4, defaultType, sConfig)
+	r.Require().NoError(err)
+
+	r.Equal(shards, RecipeShards(NewRecipe(task, shards, "", sConfig)))
+}
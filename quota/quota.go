@@ -0,0 +1,132 @@
+package quota
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/db"
+)
+
+// The limits a quota enforces
+const (
+	LimitActiveTasks      = "activeTasks"
+	LimitInstances        = "instances"
+	LimitPatientsPerMonth = "patientsPerMonth"
+	LimitStorageBytes     = "storageBytes"
+)
+
+// Usage is how much of their quota a user is currently using. Queued tasks
+// count as active. Instances counts every shard of the user's active tasks,
+// whether or not it's running right now, since each one will be.
+type Usage struct {
+	ActiveTasks       int64
+	Instances         int64
+	PatientsThisMonth int64
+	StorageBytes      int64
+}
+
+// Line is the usage of a single limit. A Max of 0 is unlimited.
+type Line struct {
+	Max  int64 `json:"max"`
+	Used int64 `json:"used"`
+}
+
+// Error is returned when a new task would go over one of the user's
+// limits. Status is the HTTP status to reject the task with: 429 if the
+// task can be retried once other tasks end, or 403 if it can't until the
+// month is over or some of the user's files are deleted.
+type Error struct {
+	Status    int    `json:"-"`
+	Limit     string `json:"limit"`
+	Max       int64  `json:"max"`
+	Used      int64  `json:"used"`
+	Requested int64  `json:"requested"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Quota exceeded: %s limit is %d, %d used and %d requested", e.Limit, e.Max, e.Used, e.Requested)
+}
+
+// Default returns the default quota from the config, for a user without
+// their own.
+func Default(user string, config *config.StorkConfig) *db.Quota {
+	return &db.Quota{
+		User:                user,
+		MaxActiveTasks:      config.QuotaMaxActiveTasks,
+		MaxInstances:        config.QuotaMaxInstances,
+		MaxPatientsPerMonth: config.QuotaMaxPatientsPerMonth,
+		MaxStorageBytes:     config.QuotaMaxStorageBytes,
+	}
+}
+
+// MonthStart returns the start of the calendar month, in UTC, that
+// monthly limits are counted from.
+func MonthStart(now time.Time) time.Time {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// NewUsage adds up a user's usage from their tasks (see
+// DataAccessLayer.GetQuotaTasks). Only completed tasks retain storage.
+func NewUsage(tasks []db.Task, now time.Time) *Usage {
+	usage := &Usage{}
+	monthStart := MonthStart(now)
+	for i := range tasks {
+		task := &tasks[i]
+		switch task.Status {
+		case db.TaskStatusActive:
+			usage.ActiveTasks++
+			usage.Instances += int64(len(task.LatestInstances()))
+		case db.TaskStatusQueued:
+			usage.ActiveTasks++
+			usage.Instances += int64(task.ShardCount)
+		}
+		// Queued tasks count towards the month they were queued in
+		started := task.StartTime
+		if started == nil {
+			started = task.QueuedTime
+		}
+		if started != nil && !started.Before(monthStart) {
+			usage.PatientsThisMonth += int64(task.Population)
+		}
+		if task.Status == db.TaskStatusCompleted && task.Manifest != nil {
+			usage.StorageBytes += task.Manifest.TotalSize
+		}
+	}
+	return usage
+}
+
+// Report returns the usage of every limit, keyed by limit.
+func Report(quota *db.Quota, usage *Usage) map[string]Line {
+	return map[string]Line{
+		LimitActiveTasks:      Line{Max: int64(quota.MaxActiveTasks), Used: usage.ActiveTasks},
+		LimitInstances:        Line{Max: int64(quota.MaxInstances), Used: usage.Instances},
+		LimitPatientsPerMonth: Line{Max: int64(quota.MaxPatientsPerMonth), Used: usage.PatientsThisMonth},
+		LimitStorageBytes:     Line{Max: quota.MaxStorageBytes, Used: usage.StorageBytes},
+	}
+}
+
+// Check returns an Error if a new task with the given number of instances
+// and population would go over any of the user's limits. Storage can't be
+// known until the task is done, so no new tasks are allowed once the user
+// is already at their storage limit.
+func Check(quota *db.Quota, usage *Usage, instances, population int) *Error {
+	checks := []Error{
+		Error{Status: http.StatusTooManyRequests, Limit: LimitActiveTasks, Max: int64(quota.MaxActiveTasks), Used: usage.ActiveTasks, Requested: 1},
+		Error{Status: http.StatusTooManyRequests, Limit: LimitInstances, Max: int64(quota.MaxInstances), Used: usage.Instances, Requested: int64(instances)},
+		Error{Status: http.StatusForbidden, Limit: LimitPatientsPerMonth, Max: int64(quota.MaxPatientsPerMonth), Used: usage.PatientsThisMonth, Requested: int64(population)},
+	}
+	for i := range checks {
+		check := &checks[i]
+		if check.Max > 0 && check.Used+check.Requested > check.Max {
+			return check
+		}
+	}
+
+	if quota.MaxStorageBytes > 0 && usage.StorageBytes >= quota.MaxStorageBytes {
+		return &Error{Status: http.StatusForbidden, Limit: LimitStorageBytes, Max: quota.MaxStorageBytes, Used: usage.StorageBytes}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package quota
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/db"
+	"github.com/stretchr/testify/suite"
+)
+
+type QuotaTestSuite struct {
+	suite.Suite
+}
+
+func TestQuotaTestSuite(t *testing.T) {
+	suite.Run(t, new(QuotaTestSuite))
+}
+
+func (q *QuotaTestSuite) TestMonthStart() {
+	now := time.Date(2017, time.June, 14, 9, 30, 0, 0, time.UTC)
+	q.Equal(time.Date(2017, time.June, 1, 0, 0, 0, 0, time.UTC), MonthStart(now))
+}
+
+func (q *QuotaTestSuite) TestNewUsage() {
+	now := time.Now()
+	lastMonth := MonthStart(now).Add(-time.Hour)
+
+	tasks := []db.Task{
+		// An active task with 2 shards, one of them on its second attempt
+		db.Task{
+			Status:     db.TaskStatusActive,
+			StartTime:  &now,
+			Population: 1000,
+			Instances: []db.Instance{
+				db.Instance{Shard: 0, Attempt: 1, Status: db.InstanceStatusError},
+				db.Instance{Shard: 0, Attempt: 2, Status: db.InstanceStatusActive},
+				db.Instance{Shard: 1, Attempt: 1, Status: db.InstanceStatusDone},
+			},
+		},
+		// A queued task will run all of its shards
+		db.Task{
+			Status:     db.TaskStatusQueued,
+			QueuedTime: &now,
+			Population: 2000,
+			ShardCount: 3,
+		},
+		// A task completed last month still retains its files
+		db.Task{
+			Status:     db.TaskStatusCompleted,
+			StartTime:  &lastMonth,
+			Population: 5000,
+			Manifest:   &db.Manifest{TotalSize: 2048},
+		},
+		// A deleted task started this month still counts towards the month
+		db.Task{
+			Status:     db.TaskStatusDeleted,
+			StartTime:  &now,
+			Population: 500,
+			Manifest:   &db.Manifest{TotalSize: 4096},
+		},
+	}
+
+	usage := NewUsage(tasks, now)
+	q.Equal(int64(2), usage.ActiveTasks)
+	q.Equal(int64(5), usage.Instances)
+	q.Equal(int64(3500), usage.PatientsThisMonth)
+	q.Equal(int64(2048), usage.StorageBytes)
+}
+
+func (q *QuotaTestSuite) TestCheck() {
+	quota := Default("bob", config.DefaultConfig)
+	quota.MaxActiveTasks = 2
+	quota.MaxInstances = 4
+	quota.MaxPatientsPerMonth = 10000
+	quota.MaxStorageBytes = 1000
+
+	usage := &Usage{ActiveTasks: 1, Instances: 2, PatientsThisMonth: 5000, StorageBytes: 500}
+	q.Nil(Check(quota, usage, 2, 5000))
+
+	// Too many instances at once
+	err := Check(quota, usage, 3, 1000)
+	q.Require().NotNil(err)
+	q.Equal(LimitInstances, err.Limit)
+	q.Equal(http.StatusTooManyRequests, err.Status)
+	q.Equal(int64(3), err.Requested)
+
+	// Too many patients this month
+	err = Check(quota, usage, 1, 5001)
+	q.Require().NotNil(err)
+	q.Equal(LimitPatientsPerMonth, err.Limit)
+	q.Equal(http.StatusForbidden, err.Status)
+
+	// Too many tasks at once
+	usage.ActiveTasks = 2
+	err = Check(quota, usage, 1, 1000)
+	q.Require().NotNil(err)
+	q.Equal(LimitActiveTasks, err.Limit)
+
+	// Out of storage
+	usage.ActiveTasks = 0
+	usage.StorageBytes = 1000
+	err = Check(quota, usage, 1, 1000)
+	q.Require().NotNil(err)
+	q.Equal(LimitStorageBytes, err.Limit)
+	q.Equal(http.StatusForbidden, err.Status)
+
+	// A limit of 0 is unlimited
+	quota.MaxStorageBytes = 0
+	q.Nil(Check(quota, usage, 1, 1000))
+}
+
+func (q *QuotaTestSuite) TestReport() {
+	quota := &db.Quota{User: "bob", MaxActiveTasks: 2}
+	report := Report(quota, &Usage{ActiveTasks: 1, Instances: 3})
+	q.Len(report, 4)
+	q.Equal(Line{Max: 2, Used: 1}, report[LimitActiveTasks])
+	q.Equal(Line{Max: 0, Used: 3}, report[LimitInstances])
+}
@@ -0,0 +1,223 @@
+package runner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cjduffett/stork/awsutil"
+	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/db"
+	"github.com/cjduffett/stork/logger"
+	"github.com/cjduffett/stork/storage"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// InstanceConfigEnvVar is the environment variable that holds the serialized
+// InstanceConfig for a local instance, in place of EC2 user data.
+const InstanceConfigEnvVar = "STORK_INSTANCE_CONFIG"
+
+// StorageRootEnvVar is the environment variable that holds the fs storage
+// root directory, when Stork uses the fs storage. A local instance writes
+// its output to the BucketName directory under it.
+const StorageRootEnvVar = "STORK_STORAGE_ROOT"
+
+// Where the fs storage root is mounted in local Docker containers
+const containerStorageRoot = "/stork-data"
+
+// How long a local instance is still described after it exits. Like EC2
+// does with terminated instances, it's forgotten after that.
+const finishedRetention = time.Hour
+
+// LocalRunner runs Synthea on the same machine as Stork, either as a
+// subprocess (config.LocalCommand) or in a Docker container (config.LocalImage).
+// It's meant for development, where starting EC2 instances for every run
+// isn't practical.
+type LocalRunner struct {
+	Config *config.StorkConfig
+
+	mutex     sync.Mutex
+	instances map[string]*localInstance
+}
+
+type localInstance struct {
+	cmd        *exec.Cmd
+	status     string
+	terminated bool
+	finished   time.Time
+}
+
+// NewLocalRunner returns a pointer to an initialized LocalRunner
+func NewLocalRunner(config *config.StorkConfig) *LocalRunner {
+	return &LocalRunner{
+		Config:    config,
+		instances: make(map[string]*localInstance),
+	}
+}
+
+// StartInstances starts n new local Synthea processes or containers with the
+// same configuration. There are no spot instances or instance types locally,
+// and the image is always config.LocalImage, so options are ignored.
+func (l *LocalRunner) StartInstances(n int64, iConfig *awsutil.InstanceConfig, options awsutil.LaunchOptions) ([]string, error) {
+	logger.Debug(fmt.Sprintf("Starting %d local instances of Synthea for task %s", n, iConfig.TaskID))
+
+	// The InstanceConfig must be validated before doing anything.
+	if !awsutil.ValidateConfig(iConfig, l.Config) {
+		return nil, errors.New("Invalid InstanceConfig")
+	}
+
+	rawConfig, err := json.Marshal(iConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	instanceIDs := []string{}
+	for i := int64(0); i < n; i++ {
+		instanceID := "local-" + bson.NewObjectId().Hex()
+
+		cmd, err := l.command(instanceID, string(rawConfig))
+		if err != nil {
+			return instanceIDs, err
+		}
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		err = cmd.Start()
+		if err != nil {
+			logger.Error("Failed to start local instance for task " + iConfig.TaskID)
+			return instanceIDs, err
+		}
+
+		instance := &localInstance{cmd: cmd, status: db.InstanceStatusActive}
+		l.mutex.Lock()
+		l.purge(time.Now())
+		l.instances[instanceID] = instance
+		l.mutex.Unlock()
+		instanceIDs = append(instanceIDs, instanceID)
+
+		go l.wait(instanceID, instance)
+	}
+
+	logger.Debug(fmt.Sprintf("Started %d local instances: %v", n, instanceIDs))
+	return instanceIDs, nil
+}
+
+// TerminateInstances stops one or more local instances.
+func (l *LocalRunner) TerminateInstances(instanceIDs []string) error {
+	logger.Debug(fmt.Sprintf("Terminating local instances %v", instanceIDs))
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, instanceID := range instanceIDs {
+		instance, ok := l.instances[instanceID]
+		if !ok || instance.status != db.InstanceStatusActive {
+			continue
+		}
+		instance.terminated = true
+
+		var err error
+		if l.Config.LocalImage != "" {
+			err = exec.Command("docker", "kill", instanceID).Run()
+		} else {
+			err = instance.cmd.Process.Kill()
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to terminate local instance %s", instanceID))
+			return err
+		}
+	}
+	return nil
+}
+
+// DescribeInstanceStatus returns the status of one or more local instances.
+// A process that exited cleanly, or was terminated, is done. Any other exit
+// is an error. Instances that exited more than finishedRetention ago are
+// left out.
+func (l *LocalRunner) DescribeInstanceStatus(instanceIDs []string) ([]awsutil.InstanceStatus, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.purge(time.Now())
+	statuses := []awsutil.InstanceStatus{}
+	for _, instanceID := range instanceIDs {
+		instance, ok := l.instances[instanceID]
+		if !ok {
+			continue
+		}
+		statuses = append(statuses, awsutil.InstanceStatus{
+			InstanceID: instanceID,
+			Status:     instance.status,
+		})
+	}
+	return statuses, nil
+}
+
+// command builds the command for a local instance. The InstanceConfig is
+// passed through the environment, never as an argument, since arguments
+// are visible to every user on the machine and it holds the instance's
+// token. Docker copies it into the container from its own environment.
+func (l *LocalRunner) command(instanceID string, rawConfig string) (*exec.Cmd, error) {
+	if l.Config.LocalImage != "" {
+		args := []string{
+			"run", "--rm",
+			"--name", instanceID,
+			"-e", InstanceConfigEnvVar,
+		}
+
+		// Mount the storage root so the container can write to it
+		if l.Config.Storage == storage.StorageFS {
+			root, err := filepath.Abs(l.Config.StorageRoot)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, "-v", root+":"+containerStorageRoot, "-e", StorageRootEnvVar+"="+containerStorageRoot)
+		}
+		cmd := exec.Command("docker", append(args, l.Config.LocalImage)...)
+		cmd.Env = append(os.Environ(), InstanceConfigEnvVar+"="+rawConfig)
+		return cmd, nil
+	}
+
+	args := strings.Fields(l.Config.LocalCommand)
+	if len(args) == 0 {
+		return nil, errors.New("No local command or image configured")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), InstanceConfigEnvVar+"="+rawConfig)
+	if l.Config.Storage == storage.StorageFS {
+		cmd.Env = append(cmd.Env, StorageRootEnvVar+"="+l.Config.StorageRoot)
+	}
+	return cmd, nil
+}
+
+// wait records the status of a local instance once it exits.
+func (l *LocalRunner) wait(instanceID string, instance *localInstance) {
+	err := instance.cmd.Wait()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	instance.finished = time.Now()
+	if err != nil && !instance.terminated {
+		logger.Warning(fmt.Sprintf("Local instance %s failed: %s", instanceID, err))
+		instance.status = db.InstanceStatusError
+		return
+	}
+	instance.status = db.InstanceStatusDone
+}
+
+// purge forgets instances that exited more than finishedRetention before
+// now. It must be called with the mutex held.
+func (l *LocalRunner) purge(now time.Time) {
+	for instanceID, instance := range l.instances {
+		if !instance.finished.IsZero() && now.Sub(instance.finished) > finishedRetention {
+			delete(l.instances, instanceID)
+		}
+	}
+}
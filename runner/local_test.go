@@ -0,0 +1,157 @@
+package runner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cjduffett/stork/awsutil"
+	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/db"
+	"github.com/cjduffett/stork/logger"
+	"github.com/stretchr/testify/suite"
+)
+
+type LocalRunnerTestSuite struct {
+	suite.Suite
+}
+
+func TestLocalRunnerTestSuite(t *testing.T) {
+	suite.Run(t, new(LocalRunnerTestSuite))
+}
+
+func (l *LocalRunnerTestSuite) SetupSuite() {
+	// verbose logging
+	logger.LogLevel = logger.DebugLevel
+}
+
+func (l *LocalRunnerTestSuite) TestStartInstances() {
+	runner := newLocalRunner("true")
+
+	instanceIDs, err := runner.StartInstances(2, newInstanceConfig(), awsutil.LaunchOptions{})
+	l.NoError(err)
+	l.Len(instanceIDs, 2)
+	l.NotEqual(instanceIDs[0], instanceIDs[1])
+
+	// Both processes exit cleanly
+	statuses := l.waitForStatus(runner, instanceIDs, db.InstanceStatusDone)
+	l.Len(statuses, 2)
+
+	// An invalid InstanceConfig is rejected
+	iConfig := newInstanceConfig()
+	iConfig.TaskID = ""
+	_, err = runner.StartInstances(1, iConfig, awsutil.LaunchOptions{})
+	l.Error(err)
+}
+
+func (l *LocalRunnerTestSuite) TestInstanceConfigIsPassed() {
+	// printenv fails unless the InstanceConfig is in its environment
+	runner := newLocalRunner("printenv " + InstanceConfigEnvVar)
+
+	instanceIDs, err := runner.StartInstances(1, newInstanceConfig(), awsutil.LaunchOptions{})
+	l.NoError(err)
+	l.waitForStatus(runner, instanceIDs, db.InstanceStatusDone)
+}
+
+func (l *LocalRunnerTestSuite) TestFailedInstance() {
+	runner := newLocalRunner("false")
+
+	instanceIDs, err := runner.StartInstances(1, newInstanceConfig(), awsutil.LaunchOptions{})
+	l.NoError(err)
+	l.waitForStatus(runner, instanceIDs, db.InstanceStatusError)
+}
+
+func (l *LocalRunnerTestSuite) TestTerminateInstances() {
+	runner := newLocalRunner("sleep 30")
+
+	instanceIDs, err := runner.StartInstances(1, newInstanceConfig(), awsutil.LaunchOptions{})
+	l.NoError(err)
+
+	statuses, err := runner.DescribeInstanceStatus(instanceIDs)
+	l.NoError(err)
+	l.Equal(db.InstanceStatusActive, statuses[0].Status)
+
+	// A terminated instance is done, not failed
+	err = runner.TerminateInstances(instanceIDs)
+	l.NoError(err)
+	l.waitForStatus(runner, instanceIDs, db.InstanceStatusDone)
+
+	// Unknown instances are left out
+	statuses, err = runner.DescribeInstanceStatus([]string{"local-unknown"})
+	l.NoError(err)
+	l.Empty(statuses)
+}
+
+func (l *LocalRunnerTestSuite) TestFinishedInstancesArePurged() {
+	runner := newLocalRunner("true")
+
+	instanceIDs, err := runner.StartInstances(1, newInstanceConfig(), awsutil.LaunchOptions{})
+	l.NoError(err)
+	l.waitForStatus(runner, instanceIDs, db.InstanceStatusDone)
+
+	// Finished instances are still described for a while
+	runner.mutex.Lock()
+	runner.purge(time.Now().Add(finishedRetention / 2))
+	l.Len(runner.instances, 1)
+
+	// But are forgotten after that
+	runner.purge(time.Now().Add(finishedRetention * 2))
+	l.Empty(runner.instances)
+	runner.mutex.Unlock()
+}
+
+func (l *LocalRunnerTestSuite) TestDockerCommand() {
+	runner := newLocalRunner("")
+	runner.Config.LocalImage = "synthea"
+
+	// The InstanceConfig is passed through the environment, so it
+	// doesn't show up in the process list
+	cmd, err := runner.command("local-abc123", `{"doneToken":"0.abc.def"}`)
+	l.NoError(err)
+	l.Equal([]string{"docker", "run", "--rm", "--name", "local-abc123", "-e", InstanceConfigEnvVar, "synthea"}, cmd.Args)
+	l.Contains(cmd.Env, InstanceConfigEnvVar+`={"doneToken":"0.abc.def"}`)
+}
+
+// waitForStatus waits up to 5 seconds for every instance to reach status.
+func (l *LocalRunnerTestSuite) waitForStatus(runner *LocalRunner, instanceIDs []string, status string) []awsutil.InstanceStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		statuses, err := runner.DescribeInstanceStatus(instanceIDs)
+		l.Require().NoError(err)
+
+		reached := true
+		for _, s := range statuses {
+			if s.Status != status {
+				reached = false
+			}
+		}
+		if reached {
+			return statuses
+		}
+
+		if time.Now().After(deadline) {
+			l.FailNow("Timed out waiting for instances to be " + status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newLocalRunner(command string) *LocalRunner {
+	sConfig := *config.DefaultConfig
+	sConfig.LocalCommand = command
+	return NewLocalRunner(&sConfig)
+}
+
+func newInstanceConfig() *awsutil.InstanceConfig {
+	return &awsutil.InstanceConfig{
+		TaskID:           "123abc",
+		Population:       config.DefaultConfig.MinPopulationSize,
+		BucketName:       "123abc-bucket",
+		BucketRegion:     "us-east-1",
+		DoneEndpoint:     "https://stork.com/tasks/123abc/done",
+		ProgressEndpoint: "https://stork.com/tasks/123abc/progress",
+		DoneToken:        "0.abc.def",
+		ShardIndex:       0,
+		ShardCount:       1,
+		OutputPrefix:     "shard-0/",
+	}
+}
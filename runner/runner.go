@@ -0,0 +1,45 @@
+package runner
+
+import (
+	"fmt"
+
+	"github.com/cjduffett/stork/awsutil"
+	"github.com/cjduffett/stork/config"
+)
+
+// The runners Stork knows how to use, selected by StorkConfig.Runner
+const (
+	RunnerEC2   = "ec2"
+	RunnerLocal = "local"
+)
+
+// Runner starts, stops, and checks on the instances that run Synthea. Every
+// instance is passed its InstanceConfig, serialized as JSON.
+type Runner interface {
+	// StartInstances starts n new Synthea instances with the same
+	// configuration, returning their IDs.
+	StartInstances(n int64, iConfig *awsutil.InstanceConfig, options awsutil.LaunchOptions) ([]string, error)
+
+	// TerminateInstances stops one or more Synthea instances.
+	TerminateInstances(instanceIDs []string) error
+
+	// DescribeInstanceStatus returns the status of one or more Synthea
+	// instances. Instances that no longer exist are left out. Runners without
+	// spot instances never report an instance as interrupted.
+	DescribeInstanceStatus(instanceIDs []string) ([]awsutil.InstanceStatus, error)
+}
+
+// The AWSClient runs Synthea on EC2
+var _ Runner = (*awsutil.AWSClient)(nil)
+
+// NewRunner returns the Runner selected by config.Runner.
+func NewRunner(config *config.StorkConfig, awsClient *awsutil.AWSClient) (Runner, error) {
+	switch config.Runner {
+	case RunnerEC2:
+		return awsClient, nil
+	case RunnerLocal:
+		return NewLocalRunner(config), nil
+	default:
+		return nil, fmt.Errorf("Unknown runner %s", config.Runner)
+	}
+}
@@ -1,22 +1,68 @@
 package server
 
 import (
+	"net/http"
 	"time"
 
+	"github.com/cjduffett/stork/auth"
+	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/db"
+	"github.com/cjduffett/stork/logger"
 	"github.com/gin-gonic/gin"
 	cors "github.com/itsjamie/gin-cors"
+	"gopkg.in/mgo.v2"
 )
 
 // RegisterMiddleware registers all Stork middleware.
-func RegisterMiddleware(router *gin.Engine) {
-	// CORS middleware
+func RegisterMiddleware(router *gin.Engine, config *config.StorkConfig) {
+	// CORS middleware. Browsers refuse credentialed requests to a wildcard
+	// origin, so credentials are only allowed for explicit origins.
 	router.Use(cors.Middleware(cors.Config{
-		Origins:         "*",
+		Origins:         config.CORSOrigins,
 		Methods:         "GET, PUT, POST, DELETE",
 		RequestHeaders:  "Origin, Authorization, Content-Type, If-Match, If-None-Exist",
 		ExposedHeaders:  "Location, ETag, Last-Modified",
 		MaxAge:          86400 * time.Second, // Preflight expires after 1 day
-		Credentials:     true,
+		Credentials:     config.CORSOrigins != "*",
 		ValidateHeaders: false,
 	}))
 }
+
+// Authenticate returns middleware that requires a valid API key, passed
+// either as a bearer token or in the X-API-Key header. The authenticated
+// auth.Principal is stored in the request context under auth.PrincipalKey.
+func Authenticate(dal *db.DataAccessLayer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := auth.BearerToken(c.Request)
+		if key == "" {
+			key = c.Request.Header.Get("X-API-Key")
+		}
+		if key == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "An API key is required"})
+			c.Abort()
+			return
+		}
+
+		apiKey, err := dal.GetAPIKey(auth.HashToken(key))
+		if err == mgo.ErrNotFound {
+			logger.Warning("Rejected request from ", c.ClientIP(), ": unknown API key")
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+			c.Abort()
+			return
+		}
+		if err != nil {
+			// The key may well be valid, so don't tell the client otherwise
+			logger.Error("Failed to look up API key: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check API key"})
+			c.Abort()
+			return
+		}
+
+		c.Set(auth.PrincipalKey, &auth.Principal{
+			User:  apiKey.User,
+			Role:  apiKey.Role,
+			Email: apiKey.Email,
+		})
+		c.Next()
+	}
+}
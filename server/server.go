@@ -1,19 +1,33 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/cjduffett/stork/api"
+	"github.com/cjduffett/stork/auth"
 	"github.com/cjduffett/stork/awsutil"
 	"github.com/cjduffett/stork/config"
 	"github.com/cjduffett/stork/db"
+	"github.com/cjduffett/stork/lifecycle"
 	"github.com/cjduffett/stork/logger"
+	"github.com/cjduffett/stork/notify"
+	"github.com/cjduffett/stork/runner"
+	"github.com/cjduffett/stork/storage"
+	"github.com/cjduffett/stork/webhook"
 	"github.com/gin-gonic/gin"
 	"gopkg.in/mgo.v2"
 )
 
+// How long to wait for in-flight requests when shutting down.
+const shutdownTimeout = 10 * time.Second
+
 // StorkServer servers the Stork service.
 type StorkServer struct {
 	Engine  *gin.Engine
@@ -39,7 +53,7 @@ func NewServer(config *config.StorkConfig) *StorkServer {
 	}
 }
 
-// Run starts the StorkServer.
+// Run starts the StorkServer and blocks until it is interrupted.
 func (s *StorkServer) Run() {
 	// Connect to MongoDB
 	session, err := mgo.Dial(s.Config.DatabaseHost)
@@ -55,22 +69,150 @@ func (s *StorkServer) Run() {
 	logger.Info("Connected to MongoDB at " + s.Config.DatabaseHost)
 
 	// Register middleware (CORS, etc.)
-	RegisterMiddleware(s.Engine)
+	RegisterMiddleware(s.Engine, s.Config)
+
+	// Synthea callbacks can't be verified without a secret
+	if s.Config.CallbackSecret == "" {
+		logger.Warning("No callback secret set, generating a random one. Tasks started before a restart will not be able to report back")
+		s.Config.CallbackSecret, err = auth.NewSecret()
+		if err != nil {
+			logger.Error("Failed to generate a callback secret")
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
 
 	// Create a new Data Access Layer
 	dal := db.NewDataAccessLayer(s.Session, s.Config.DatabaseName)
 
+	// Make sure the bootstrap admin key exists
+	if s.Config.AdminAPIKey != "" {
+		now := time.Now()
+		err = dal.SaveAPIKey(&db.APIKey{
+			KeyHash: auth.HashToken(s.Config.AdminAPIKey),
+			User:    "admin",
+			Role:    db.RoleAdmin,
+			Created: &now,
+		})
+		if err != nil {
+			logger.Error("Failed to save the admin API key")
+			os.Exit(1)
+		}
+	}
+
 	// Create a new AWSClient
 	awsClient := awsutil.NewAWSClient(s.Config)
 
+	// Select where Synthea runs
+	synthea, err := runner.NewRunner(s.Config, awsClient)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	logger.Info("Running Synthea with the " + s.Config.Runner + " runner")
+
+	// Select where Synthea output is stored
+	var store storage.Storage
+	switch s.Config.Storage {
+	case storage.StorageS3:
+		store = awsClient
+	case storage.StorageFS:
+		// Download links can't be verified without a secret either
+		if s.Config.DownloadSecret == "" {
+			logger.Warning("No download secret set, generating a random one. Download links handed out before a restart will stop working")
+			s.Config.DownloadSecret, err = auth.NewSecret()
+			if err != nil {
+				logger.Error("Failed to generate a download secret")
+				logger.Error(err.Error())
+				os.Exit(1)
+			}
+		}
+		store = storage.NewFileStorage(s.Config.StorageRoot, s.Config.BaseURL(), []byte(s.Config.DownloadSecret))
+	default:
+		logger.Error("Unknown storage " + s.Config.Storage)
+		os.Exit(1)
+	}
+	logger.Info("Storing Synthea output with the " + s.Config.Storage + " storage")
+
+	// Select how users are emailed
+	mailer, err := notify.NewMailer(s.Config)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	notifier := notify.NewNotifier(mailer, s.Config, store)
+	logger.Info("Emailing users with the " + s.Config.Mailer + " mailer")
+
+	// Send task status changes to webhooks, including any that
+	// were still being retried when Stork last shut down
+	webhooks := webhook.NewDispatcher(dal, s.Config)
+	err = webhooks.Resume()
+	if err != nil {
+		logger.Error("Failed to resume webhook deliveries: " + err.Error())
+	}
+
+	if !lifecycle.IsValidOrder(s.Config.SchedulerOrder) {
+		logger.Error("Unknown scheduler order " + s.Config.SchedulerOrder)
+		os.Exit(1)
+	}
+
+	// Task state is changed through the lifecycle manager
+	manager := lifecycle.NewManager(dal, s.Config, synthea, store, notifier, webhooks)
+
+	// Finish aggregating the output of tasks that completed just before
+	// Stork last shut down
+	err = manager.ResumeAggregations()
+	if err != nil {
+		logger.Error("Failed to resume aggregations: " + err.Error())
+	}
+
 	// Register API routes and setup controllers
-	api.RegisterRoutes(s.Engine, dal, awsClient)
+	api.RegisterRoutes(s.Engine, manager, Authenticate(dal))
+
+	// Keep the state of active tasks in sync with their instances
+	reconciler := lifecycle.NewReconciler(manager, s.Config.ReconcileInterval)
+	reconciler.Start()
 
 	// Start Stork
 	logger.Info("Starting Stork on port " + strings.TrimPrefix(s.Config.ServerPort, ":"))
 	printStork()
 
-	s.Engine.Run(":" + s.Config.ServerPort)
+	httpServer := &http.Server{
+		Addr:    ":" + strings.TrimPrefix(s.Config.ServerPort, ":"),
+		Handler: s.Engine,
+	}
+	go func() {
+		err := httpServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}()
+
+	// Run until interrupted, then shut down cleanly
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	logger.Info("Shutting down Stork")
+	reconciler.Stop()
+
+	// End event streams, or they'd hold up the shutdown
+	manager.Events.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = httpServer.Shutdown(ctx)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+
+	// Tasks ended above may still be emailing or aggregating, which needs
+	// the database
+	manager.Wait()
+
+	// Requests finishing above may still have sent events
+	webhooks.Stop()
 }
 
 func printStork() {
@@ -8,6 +8,7 @@ import (
 	"github.com/cjduffett/stork/awsutil"
 	"github.com/cjduffett/stork/config"
 	"github.com/cjduffett/stork/db"
+	"github.com/cjduffett/stork/lifecycle"
 	"github.com/cjduffett/stork/testutil"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/suite"
@@ -35,7 +36,7 @@ func (s *ServerTestSuite) SetupSuite() {
 	storkServer.Session = s.DB().Session
 
 	// Register middleware (CORS, etc.)
-	RegisterMiddleware(storkServer.Engine)
+	RegisterMiddleware(storkServer.Engine, config)
 
 	// Create a new Data Access Layer
 	dal := db.NewDataAccessLayer(storkServer.Session, config.DatabaseName)
@@ -44,7 +45,8 @@ func (s *ServerTestSuite) SetupSuite() {
 	awsClient := awsutil.NewAWSClient(config)
 
 	// Register API routes and setup controllers
-	api.RegisterRoutes(storkServer.Engine, dal, awsClient)
+	manager := lifecycle.NewManager(dal, config, awsClient, awsClient, nil, nil)
+	api.RegisterRoutes(storkServer.Engine, manager, Authenticate(dal))
 
 	// Start the httptest server
 	s.StorkServer = httptest.NewServer(storkServer.Engine)
@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cjduffett/stork/logger"
+)
+
+// FileStorage stores namespaces as directories under a root directory on the
+// local filesystem. Objects are downloaded through Stork itself, with links
+// signed so they can be shared without an API key.
+type FileStorage struct {
+	Root    string
+	BaseURL string
+	secret  []byte
+}
+
+// DownloadEndpoint is the Stork route FileStorage objects are served from.
+const DownloadEndpoint = "/download"
+
+// NewFileStorage returns a pointer to an initialized FileStorage. Download
+// links are served from baseURL, and signed with secret.
+func NewFileStorage(root, baseURL string, secret []byte) *FileStorage {
+	return &FileStorage{
+		Root:    root,
+		BaseURL: baseURL,
+		secret:  secret,
+	}
+}
+
+// CreateNamespace creates a new directory for a namespace
+func (f *FileStorage) CreateNamespace(name string) error {
+	logger.Debug("Creating directory for namespace " + name)
+
+	dir, err := f.path(name, "")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(f.Root, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.Mkdir(dir, 0755)
+	if err != nil {
+		logger.Error("Failed to create namespace " + name)
+		return err
+	}
+	return nil
+}
+
+// DeleteNamespace deletes the directory for a namespace and its contents
+func (f *FileStorage) DeleteNamespace(name string) error {
+	logger.Debug("Deleting namespace " + name + " and its contents")
+
+	dir, err := f.path(name, "")
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(dir)
+	if err != nil {
+		logger.Error("Failed to delete namespace " + name)
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// ListObjects lists every file in a namespace. The checksum of each
+// object is the hex encoded MD5 of its contents, like an S3 ETag.
+func (f *FileStorage) ListObjects(name string) ([]Object, error) {
+	dir, err := f.path(name, "")
+	if err != nil {
+		return nil, err
+	}
+
+	objects := []Object{}
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		checksum, err := md5File(path)
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, Object{
+			Key:      filepath.ToSlash(rel),
+			Size:     info.Size(),
+			Checksum: checksum,
+		})
+		return nil
+	})
+	if err != nil {
+		logger.Error("Failed to list objects in namespace " + name)
+		return nil, err
+	}
+	return objects, nil
+}
+
+// GetObject opens a file in a namespace.
+func (f *FileStorage) GetObject(name, key string) (io.ReadCloser, error) {
+	path, err := f.path(name, key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// PutObject writes a file to a namespace, creating any directories
+// in its key.
+func (f *FileStorage) PutObject(name, key string, body io.ReadSeeker) error {
+	path, err := f.path(name, key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = writeFile(path, body)
+	}
+	if err != nil {
+		logger.Error("Failed to write " + key + " to namespace " + name)
+		return err
+	}
+	return nil
+}
+
+// DownloadURL returns a signed link to an object, served by Stork.
+func (f *FileStorage) DownloadURL(name, key string, expires time.Duration) (string, error) {
+	_, err := f.path(name, key)
+	if err != nil {
+		return "", err
+	}
+
+	expiry := strconv.FormatInt(time.Now().Add(expires).Unix(), 10)
+	query := url.Values{}
+	query.Set("expires", expiry)
+	query.Set("signature", f.sign(name, key, expiry))
+
+	// Each segment of the key is escaped, but not the slashes between them
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return fmt.Sprintf("%s%s/%s/%s?%s", f.BaseURL, DownloadEndpoint, url.PathEscape(name), strings.Join(segments, "/"), query.Encode()), nil
+}
+
+// Region returns "local", since namespaces are on Stork's own filesystem.
+func (f *FileStorage) Region() string {
+	return "local"
+}
+
+// Open verifies a signed download link and opens the object it points to.
+func (f *FileStorage) Open(name, key, expiry, signature string) (*os.File, error) {
+	if !hmac.Equal([]byte(signature), []byte(f.sign(name, key, expiry))) {
+		return nil, errors.New("Invalid signature")
+	}
+
+	expiresAt, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return nil, errors.New("Download link expired")
+	}
+
+	path, err := f.path(name, key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// path returns the location of an object on disk, making sure it
+// can't escape the root directory.
+func (f *FileStorage) path(name, key string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return "", errors.New("Invalid namespace " + name)
+	}
+
+	dir := filepath.Join(f.Root, name)
+	path := filepath.Join(dir, filepath.FromSlash(key))
+	if path != dir && !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+		return "", errors.New("Invalid key " + key)
+	}
+	return path, nil
+}
+
+// sign returns the hex encoded HMAC-SHA256 of a download link.
+func (f *FileStorage) sign(name, key, expiry string) string {
+	mac := hmac.New(sha256.New, f.secret)
+	mac.Write([]byte(name + "/" + key + "?" + expiry))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// writeFile writes the contents of a reader to a file, replacing the file
+// if it already exists.
+func writeFile(path string, body io.Reader) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, body)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// md5File returns the hex encoded MD5 of a file's contents.
+func md5File(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
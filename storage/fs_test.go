@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cjduffett/stork/logger"
+	"github.com/stretchr/testify/suite"
+)
+
+type FileStorageTestSuite struct {
+	suite.Suite
+	root    string
+	storage *FileStorage
+}
+
+func TestFileStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(FileStorageTestSuite))
+}
+
+func (f *FileStorageTestSuite) SetupSuite() {
+	// verbose logging
+	logger.LogLevel = logger.DebugLevel
+}
+
+func (f *FileStorageTestSuite) SetupTest() {
+	var err error
+	f.root, err = ioutil.TempDir("", "storktest")
+	f.Require().NoError(err)
+	f.storage = NewFileStorage(filepath.Join(f.root, "data"), "http://localhost:8080", []byte("secret"))
+}
+
+func (f *FileStorageTestSuite) TearDownTest() {
+	os.RemoveAll(f.root)
+}
+
+func (f *FileStorageTestSuite) TestCreateNamespace() {
+	var err error
+
+	err = f.storage.CreateNamespace("test-bucket")
+	f.NoError(err)
+
+	// Creating a namespace that already exists should fail
+	err = f.storage.CreateNamespace("test-bucket")
+	f.Error(err)
+
+	// Namespaces can't escape the root directory
+	err = f.storage.CreateNamespace("..")
+	f.Error(err)
+	err = f.storage.CreateNamespace("foo/bar")
+	f.Error(err)
+}
+
+func (f *FileStorageTestSuite) TestDeleteNamespace() {
+	var err error
+
+	err = f.storage.CreateNamespace("test-bucket")
+	f.NoError(err)
+	f.writeObject("test-bucket", "shard-0/fhir/patient.json", "{}")
+
+	// Deleting a namespace also deletes its contents
+	err = f.storage.DeleteNamespace("test-bucket")
+	f.NoError(err)
+
+	_, err = os.Stat(filepath.Join(f.storage.Root, "test-bucket"))
+	f.True(os.IsNotExist(err))
+
+	// Trying to delete a namespace that doesn't exist should fail
+	err = f.storage.DeleteNamespace("foo-bucket")
+	f.Error(err)
+}
+
+func (f *FileStorageTestSuite) TestListObjects() {
+	err := f.storage.CreateNamespace("test-bucket")
+	f.NoError(err)
+	f.writeObject("test-bucket", "shard-0/fhir/patient.json", "{}")
+	f.writeObject("test-bucket", "shard-1/csv/patients.csv", "id,name\n")
+
+	objects, err := f.storage.ListObjects("test-bucket")
+	f.NoError(err)
+	f.Len(objects, 2)
+
+	f.Equal("shard-0/fhir/patient.json", objects[0].Key)
+	f.Equal(int64(2), objects[0].Size)
+	f.Equal("99914b932bd37a50b983c5e7c90ae93b", objects[0].Checksum) // md5 of "{}"
+	f.Equal("shard-1/csv/patients.csv", objects[1].Key)
+}
+
+func (f *FileStorageTestSuite) TestPutObject() {
+	err := f.storage.CreateNamespace("test-bucket")
+	f.NoError(err)
+
+	err = f.storage.PutObject("test-bucket", "modules/custom.json", strings.NewReader("{}"))
+	f.NoError(err)
+
+	objects, err := f.storage.ListObjects("test-bucket")
+	f.NoError(err)
+	f.Require().Len(objects, 1)
+	f.Equal("modules/custom.json", objects[0].Key)
+	f.Equal(int64(2), objects[0].Size)
+
+	body, err := f.storage.GetObject("test-bucket", "modules/custom.json")
+	f.Require().NoError(err)
+	contents, err := ioutil.ReadAll(body)
+	body.Close()
+	f.NoError(err)
+	f.Equal("{}", string(contents))
+
+	// Keys can't escape the namespace
+	err = f.storage.PutObject("test-bucket", "../escaped.json", strings.NewReader("{}"))
+	f.Error(err)
+	_, err = f.storage.GetObject("test-bucket", "../escaped.json")
+	f.Error(err)
+}
+
+func (f *FileStorageTestSuite) TestDownloadURL() {
+	err := f.storage.CreateNamespace("test-bucket")
+	f.NoError(err)
+	f.writeObject("test-bucket", "shard-0/fhir/patient.json", "{}")
+
+	link, err := f.storage.DownloadURL("test-bucket", "shard-0/fhir/patient.json", time.Hour)
+	f.NoError(err)
+	f.True(strings.HasPrefix(link, "http://localhost:8080/download/test-bucket/shard-0/fhir/patient.json?"))
+
+	parsed, err := url.Parse(link)
+	f.NoError(err)
+	expiry := parsed.Query().Get("expires")
+	signature := parsed.Query().Get("signature")
+
+	// A valid link opens the object
+	file, err := f.storage.Open("test-bucket", "shard-0/fhir/patient.json", expiry, signature)
+	f.NoError(err)
+	file.Close()
+
+	// The signature only covers the linked object
+	_, err = f.storage.Open("test-bucket", "shard-1/csv/patients.csv", expiry, signature)
+	f.Error(err)
+
+	// Expired links are rejected
+	link, err = f.storage.DownloadURL("test-bucket", "shard-0/fhir/patient.json", -time.Hour)
+	f.NoError(err)
+	parsed, err = url.Parse(link)
+	f.NoError(err)
+	_, err = f.storage.Open("test-bucket", "shard-0/fhir/patient.json", parsed.Query().Get("expires"), parsed.Query().Get("signature"))
+	f.Error(err)
+
+	// Keys can't escape the namespace
+	_, err = f.storage.DownloadURL("test-bucket", "../../etc/passwd", time.Hour)
+	f.Error(err)
+
+	// Names that aren't valid in a URL path are escaped
+	link, err = f.storage.DownloadURL("test-bucket", "merged/100% sample#1.csv", time.Hour)
+	f.NoError(err)
+	f.True(strings.HasPrefix(link, "http://localhost:8080/download/test-bucket/merged/100%25%20sample%231.csv?"))
+	parsed, err = url.Parse(link)
+	f.NoError(err)
+	f.Equal("/download/test-bucket/merged/100% sample#1.csv", parsed.Path)
+}
+
+func (f *FileStorageTestSuite) writeObject(name, key, contents string) {
+	path := filepath.Join(f.storage.Root, name, filepath.FromSlash(key))
+	f.Require().NoError(os.MkdirAll(filepath.Dir(path), 0755))
+	f.Require().NoError(ioutil.WriteFile(path, []byte(contents), 0644))
+}
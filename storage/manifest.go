@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cjduffett/stork/db"
+)
+
+// Synthea instances write their output under a prefix for their shard, with
+// a directory for each format:
+//
+//     shard-<index>/<format>/<file>
+//
+// where format is the lower case name of a db.Format* constant. Custom
+// modules uploaded with a task are stored under ModulesPrefix, and the
+// output of every shard is aggregated under MergedPrefix (see package
+// aggregate).
+
+// The prefixes of custom Synthea modules and aggregated output, and the key
+// of the archive of a whole dataset
+const (
+	ModulesPrefix = "modules/"
+	MergedPrefix  = "merged/"
+	ArchiveKey    = MergedPrefix + "dataset.zip"
+)
+
+// ShardPrefix returns the prefix a shard's output is written under.
+func ShardPrefix(shard int) string {
+	return fmt.Sprintf("shard-%d/", shard)
+}
+
+// ParseKey returns the shard and format of an object, from its key. If the
+// key doesn't follow the expected layout, ok is false.
+func ParseKey(key string) (shard int, format string, ok bool) {
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) < 3 || !strings.HasPrefix(parts[0], "shard-") {
+		return -1, "", false
+	}
+
+	shard, err := strconv.Atoi(strings.TrimPrefix(parts[0], "shard-"))
+	if err != nil || shard < 0 {
+		return -1, "", false
+	}
+
+	for _, f := range db.ValidFormats {
+		if strings.EqualFold(f, parts[1]) {
+			return shard, f, true
+		}
+	}
+	return -1, "", false
+}
+
+// BuildManifest groups the objects in a namespace by format and shard.
+// Groups are sorted by format, then shard, and files by key. Aggregated
+// output is listed separately, as the manifest's Merged files and Archive.
+func BuildManifest(objects []Object) *db.Manifest {
+	type groupKey struct {
+		format string
+		shard  int
+	}
+	groups := make(map[groupKey]*db.ManifestGroup)
+	manifest := &db.Manifest{Groups: []db.ManifestGroup{}}
+
+	for _, object := range objects {
+		manifest.FileCount++
+		manifest.TotalSize += object.Size
+
+		file := db.ManifestFile{
+			Key:      object.Key,
+			Size:     object.Size,
+			Checksum: object.Checksum,
+		}
+		if object.Key == ArchiveKey {
+			manifest.Archive = &file
+			continue
+		}
+		if strings.HasPrefix(object.Key, MergedPrefix) {
+			manifest.Merged = append(manifest.Merged, file)
+			continue
+		}
+
+		shard, format, _ := ParseKey(object.Key)
+		key := groupKey{format, shard}
+
+		group, ok := groups[key]
+		if !ok {
+			group = &db.ManifestGroup{Format: format, Shard: shard}
+			groups[key] = group
+		}
+		group.Files = append(group.Files, file)
+		group.Size += object.Size
+	}
+
+	sort.Slice(manifest.Merged, func(i, j int) bool {
+		return manifest.Merged[i].Key < manifest.Merged[j].Key
+	})
+
+	for _, group := range groups {
+		sort.Slice(group.Files, func(i, j int) bool {
+			return group.Files[i].Key < group.Files[j].Key
+		})
+		manifest.Groups = append(manifest.Groups, *group)
+	}
+	sort.Slice(manifest.Groups, func(i, j int) bool {
+		a, b := manifest.Groups[i], manifest.Groups[j]
+		if a.Format != b.Format {
+			return a.Format < b.Format
+		}
+		return a.Shard < b.Shard
+	})
+	return manifest
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/cjduffett/stork/db"
+	"github.com/stretchr/testify/suite"
+)
+
+type ManifestTestSuite struct {
+	suite.Suite
+}
+
+func TestManifestTestSuite(t *testing.T) {
+	suite.Run(t, new(ManifestTestSuite))
+}
+
+func (m *ManifestTestSuite) TestParseKey() {
+	shard, format, ok := ParseKey(ShardPrefix(3) + "fhir/patient.json")
+	m.True(ok)
+	m.Equal(3, shard)
+	m.Equal(db.FormatFHIR, format)
+
+	shard, format, ok = ParseKey("shard-0/text/nested/patient.txt")
+	m.True(ok)
+	m.Equal(0, shard)
+	m.Equal(db.FormatText, format)
+
+	// Keys that don't follow the layout aren't parsed
+	_, _, ok = ParseKey("patient.json")
+	m.False(ok)
+	_, _, ok = ParseKey("shard-x/fhir/patient.json")
+	m.False(ok)
+	_, _, ok = ParseKey("shard-0/pdf/patient.pdf")
+	m.False(ok)
+}
+
+func (m *ManifestTestSuite) TestBuildManifest() {
+	objects := []Object{
+		Object{Key: "shard-1/fhir/b.json", Size: 10, Checksum: "abc"},
+		Object{Key: "shard-0/fhir/a.json", Size: 20, Checksum: "def"},
+		Object{Key: "shard-0/csv/patients.csv", Size: 5, Checksum: "ghi"},
+		Object{Key: "shard-0/fhir/c.json", Size: 1, Checksum: "jkl"},
+		Object{Key: "README", Size: 3, Checksum: "mno"},
+	}
+
+	manifest := BuildManifest(objects)
+	m.Equal(5, manifest.FileCount)
+	m.Equal(int64(39), manifest.TotalSize)
+	m.Len(manifest.Groups, 4)
+
+	// Unrecognized files come first, then CSV, then FHIR by shard
+	m.Equal("", manifest.Groups[0].Format)
+	m.Equal(-1, manifest.Groups[0].Shard)
+
+	m.Equal(db.FormatCSV, manifest.Groups[1].Format)
+
+	fhir := manifest.Groups[2]
+	m.Equal(db.FormatFHIR, fhir.Format)
+	m.Equal(0, fhir.Shard)
+	m.Equal(int64(21), fhir.Size)
+	m.Len(fhir.Files, 2)
+	m.Equal("shard-0/fhir/a.json", fhir.Files[0].Key)
+	m.Equal("def", fhir.Files[0].Checksum)
+
+	m.Equal(1, manifest.Groups[3].Shard)
+
+	// Aggregated output is listed on its own
+	manifest = BuildManifest(append(objects,
+		Object{Key: MergedPrefix + "fhir/Patient.ndjson", Size: 4},
+		Object{Key: MergedPrefix + "csv/patients.csv", Size: 2},
+		Object{Key: ArchiveKey, Size: 8},
+	))
+	m.Equal(8, manifest.FileCount)
+	m.Equal(int64(53), manifest.TotalSize)
+	m.Len(manifest.Groups, 4)
+	m.Require().Len(manifest.Merged, 2)
+	m.Equal(MergedPrefix+"csv/patients.csv", manifest.Merged[0].Key)
+	m.Require().NotNil(manifest.Archive)
+	m.Equal(int64(8), manifest.Archive.Size)
+
+	// An empty namespace has an empty manifest
+	empty := BuildManifest([]Object{})
+	m.Equal(0, empty.FileCount)
+	m.Empty(empty.Groups)
+}
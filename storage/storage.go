@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"io"
+	"time"
+)
+
+// The storage backends Stork knows how to use, selected by StorkConfig.Storage
+const (
+	StorageS3 = "s3"
+	StorageFS = "fs"
+)
+
+// Storage holds the output of Synthea instances. Every task gets its own
+// namespace, an S3 bucket or a directory, that its instances write to.
+type Storage interface {
+	// CreateNamespace creates a new, empty namespace.
+	CreateNamespace(name string) error
+
+	// DeleteNamespace deletes a namespace and all of its contents.
+	DeleteNamespace(name string) error
+
+	// ListObjects lists every object in a namespace.
+	ListObjects(name string) ([]Object, error)
+
+	// GetObject opens an object in a namespace for reading. It's up to the
+	// caller to close it.
+	GetObject(name, key string) (io.ReadCloser, error)
+
+	// PutObject writes an object to a namespace, replacing any object
+	// already at that key.
+	PutObject(name, key string, body io.ReadSeeker) error
+
+	// DownloadURL returns a URL anyone can download an object from,
+	// valid for the given duration.
+	DownloadURL(name, key string, expires time.Duration) (string, error)
+
+	// Region returns the region namespaces are created in. It's passed
+	// to Synthea instances along with the namespace name.
+	Region() string
+}
+
+// Object is a single file in a namespace.
+type Object struct {
+	Key      string `json:"key"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
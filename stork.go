@@ -2,8 +2,10 @@ package main
 
 import (
 	"flag"
+	"os"
 
 	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/logger"
 	"github.com/cjduffett/stork/server"
 )
 
@@ -13,30 +15,151 @@ func main() {
 	// Server options
 	host := flag.String("host", config.DefaultConfig.ServerHost, "StorkServer host")
 	port := flag.String("port", config.DefaultConfig.ServerPort, "StorkServer port")
+	publicURL := flag.String("public-url", config.DefaultConfig.PublicURL, "The URL Synthea instances use to reach Stork")
+	corsOrigins := flag.String("cors-origins", config.DefaultConfig.CORSOrigins, "Comma separated origins allowed to make cross-origin requests")
+	adminAPIKey := flag.String("admin-api-key", config.DefaultConfig.AdminAPIKey, "An API key with the admin role to create at startup")
 	debug := flag.Bool("debug", config.DefaultConfig.Debug, "Enable debug level logging")
+	callbackSecret := flag.String("callback-secret", config.DefaultConfig.CallbackSecret, "The secret used to sign Synthea callback tokens")
+	maxRunningInstances := flag.Int("max-running-instances", config.DefaultConfig.MaxRunningInstances, "The most Synthea instances that can run at once, across all tasks")
+	schedulerOrder := flag.String("scheduler-order", config.DefaultConfig.SchedulerOrder, "The order queued tasks are started in: fifo or priority")
+	reconcileInterval := flag.Duration("reconcile-interval", config.DefaultConfig.ReconcileInterval, "How often to check active tasks against their instances")
+	maxShardDuration := flag.Duration("max-shard-duration", config.DefaultConfig.MaxShardDuration, "How long a single instance should take to generate its share of a task, at most")
+	prices := flag.String("prices", "", "A JSON file with the prices task estimates are based on, instead of the defaults")
+	estimateSampleSize := flag.Int("estimate-sample-size", config.DefaultConfig.EstimateSampleSize, "How many recent tasks to learn instance throughput from")
+	stallTimeout := flag.Duration("stall-timeout", config.DefaultConfig.StallTimeout, "How long an instance can go without reporting progress before it's failed")
+
+	// Retry options - all retry options begin with "retry."
+	retryMaxAttempts := flag.Int("retry.max-attempts", config.DefaultConfig.DefaultMaxAttempts, "How many instances each shard of a task gets, by default")
+	retryBackoff := flag.Duration("retry.backoff", config.DefaultConfig.DefaultRetryBackoff, "How long to wait before retrying a failed shard, by default")
+	retryMaxAttemptsLimit := flag.Int("retry.max-attempts-limit", config.DefaultConfig.MaxAttemptsLimit, "The most instances a task can ask for per shard")
+
+	// Quota options - all quota options begin with "quota."
+	quotaMaxActiveTasks := flag.Int("quota.max-active-tasks", config.DefaultConfig.QuotaMaxActiveTasks, "How many tasks a user can run at once, by default")
+	quotaMaxInstances := flag.Int("quota.max-instances", config.DefaultConfig.QuotaMaxInstances, "How many instances a user can run at once, by default")
+	quotaMaxPatientsPerMonth := flag.Int("quota.max-patients-per-month", config.DefaultConfig.QuotaMaxPatientsPerMonth, "How many patients a user can generate per month, by default")
+	quotaMaxStorageBytes := flag.Int64("quota.max-storage-bytes", config.DefaultConfig.QuotaMaxStorageBytes, "How many bytes of output a user can keep, by default")
 
 	// Database options - all database options begin with "db."
 	dbhost := flag.String("db.host", config.DefaultConfig.DatabaseHost, "Database host")
 	dbname := flag.String("db.name", config.DefaultConfig.DatabaseName, "Database name")
 
+	// Storage options - all storage options begin with "storage."
+	storageBackend := flag.String("storage", config.DefaultConfig.Storage, "Where to store Synthea output: s3 or fs")
+	storageRoot := flag.String("storage.root", config.DefaultConfig.StorageRoot, "The directory the fs storage stores Synthea output in")
+	downloadExpiry := flag.Duration("storage.download-expiry", config.DefaultConfig.DownloadExpiry, "How long download links are valid")
+	downloadSecret := flag.String("storage.download-secret", config.DefaultConfig.DownloadSecret, "The secret used to sign download links served by the fs storage. If unset, links stop working when Stork restarts")
+	aggregate := flag.Bool("storage.aggregate", config.DefaultConfig.Aggregate, "Merge the output of a completed task's shards into a single dataset and archive")
+
+	// Mail options - all mail options begin with "mail."
+	mailer := flag.String("mailer", config.DefaultConfig.Mailer, "How to email users: smtp or log")
+	mailFrom := flag.String("mail.from", config.DefaultConfig.MailFrom, "The address emails are sent from")
+	mailFile := flag.String("mail.file", config.DefaultConfig.MailFile, "The file the log mailer appends emails to, instead of logging them")
+	smtpHost := flag.String("mail.smtp-host", config.DefaultConfig.SMTPHost, "The SMTP server host")
+	smtpPort := flag.String("mail.smtp-port", config.DefaultConfig.SMTPPort, "The SMTP server port")
+	smtpUser := flag.String("mail.smtp-user", config.DefaultConfig.SMTPUser, "The SMTP username")
+	smtpPassword := flag.String("mail.smtp-password", config.DefaultConfig.SMTPPassword, "The SMTP password")
+
+	// Webhook options - all webhook options begin with "webhook."
+	webhookMaxAttempts := flag.Int("webhook.max-attempts", config.DefaultConfig.WebhookMaxAttempts, "How many times to try delivering a webhook event")
+	webhookRetryDelay := flag.Duration("webhook.retry-delay", config.DefaultConfig.WebhookRetryDelay, "How long to wait before retrying a webhook event, doubled after each attempt")
+	webhookTimeout := flag.Duration("webhook.timeout", config.DefaultConfig.WebhookTimeout, "How long to wait for a webhook to respond")
+	webhookAllowPrivate := flag.Bool("webhook.allow-private", config.DefaultConfig.WebhookAllowPrivate, "Allow webhooks to loopback, link-local and private addresses, for development")
+
+	// Runner options - all local runner options begin with "local."
+	runner := flag.String("runner", config.DefaultConfig.Runner, "Where to run Synthea: ec2 or local")
+	localCommand := flag.String("local.command", config.DefaultConfig.LocalCommand, "The command the local runner uses to start Synthea")
+	localImage := flag.String("local.image", config.DefaultConfig.LocalImage, "The Docker image the local runner runs, instead of a command")
+
 	// AWS options - all aws options begin with "aws."
 	syntheaImageID := flag.String("aws.synthea-image-id", config.DefaultConfig.SyntheaImageID, "The Synthea AMI ID to run")
 	syntheaInstanceType := flag.String("aws.synthea-instance-type", config.DefaultConfig.SyntheaInstanceType, "The type of EC2 instance to run Synthea on")
+	syntheaInstanceTypes := flag.String("aws.synthea-instance-types", "", "A JSON file listing the instance types tasks may run Synthea on, instead of the defaults")
 	syntheaSecurityGroupID := flag.String("aws.synthea-security-group-id", config.DefaultConfig.SyntheaSecurityGroupID, "The security group associated with a Synthea instance")
+	syntheaSpot := flag.Bool("aws.synthea-spot", config.DefaultConfig.SyntheaSpot, "Run Synthea on spot instances unless a task says otherwise")
+	syntheaSpotMaxPrice := flag.String("aws.synthea-spot-max-price", config.DefaultConfig.SyntheaSpotMaxPrice, "The most to pay per hour for a spot instance, in USD")
 	syntheaRoleArn := flag.String("aws.synthea-role-arn", config.DefaultConfig.SyntheaRoleArn, "The role associated with a Synthea instance")
 
 	flag.Parse()
 	conf.ServerHost = *host
 	conf.ServerPort = *port
+	conf.PublicURL = *publicURL
+	conf.CORSOrigins = *corsOrigins
+	conf.AdminAPIKey = *adminAPIKey
 	conf.Debug = *debug
+	conf.CallbackSecret = *callbackSecret
+	conf.ReconcileInterval = *reconcileInterval
+	conf.MaxRunningInstances = *maxRunningInstances
+	conf.SchedulerOrder = *schedulerOrder
+	conf.StallTimeout = *stallTimeout
+	conf.MaxShardDuration = *maxShardDuration
+	conf.EstimateSampleSize = *estimateSampleSize
+	if *prices != "" {
+		priceTable, err := config.LoadPrices(*prices)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		conf.Prices = priceTable
+	}
+
+	conf.DefaultMaxAttempts = *retryMaxAttempts
+	conf.DefaultRetryBackoff = *retryBackoff
+	conf.MaxAttemptsLimit = *retryMaxAttemptsLimit
+
+	conf.QuotaMaxActiveTasks = *quotaMaxActiveTasks
+	conf.QuotaMaxInstances = *quotaMaxInstances
+	conf.QuotaMaxPatientsPerMonth = *quotaMaxPatientsPerMonth
+	conf.QuotaMaxStorageBytes = *quotaMaxStorageBytes
 
 	conf.DatabaseHost = *dbhost
 	conf.DatabaseName = *dbname
 
+	conf.Storage = *storageBackend
+	conf.StorageRoot = *storageRoot
+	conf.DownloadExpiry = *downloadExpiry
+	conf.DownloadSecret = *downloadSecret
+	conf.Aggregate = *aggregate
+
+	conf.Mailer = *mailer
+	conf.MailFrom = *mailFrom
+	conf.MailFile = *mailFile
+	conf.SMTPHost = *smtpHost
+	conf.SMTPPort = *smtpPort
+	conf.SMTPUser = *smtpUser
+	conf.SMTPPassword = *smtpPassword
+
+	conf.WebhookMaxAttempts = *webhookMaxAttempts
+	conf.WebhookRetryDelay = *webhookRetryDelay
+	conf.WebhookTimeout = *webhookTimeout
+	conf.WebhookAllowPrivate = *webhookAllowPrivate
+
+	conf.Runner = *runner
+	conf.LocalCommand = *localCommand
+	conf.LocalImage = *localImage
+
 	conf.SyntheaImageID = *syntheaImageID
 	conf.SyntheaInstanceType = *syntheaInstanceType
+	if *syntheaInstanceTypes != "" {
+		instanceTypes, err := config.LoadInstanceTypes(*syntheaInstanceTypes)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		conf.SyntheaInstanceTypes = instanceTypes
+	}
+	if _, ok := conf.GetInstanceType(""); !ok {
+		logger.Error("The default instance type " + conf.SyntheaInstanceType + " isn't an allowed instance type")
+		os.Exit(1)
+	}
+	err := conf.Prices.CheckInstanceTypes(conf.SyntheaInstanceTypes)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
 	conf.SyntheaSecurityGroupID = *syntheaSecurityGroupID
 	conf.SyntheaRoleArn = *syntheaRoleArn
+	conf.SyntheaSpot = *syntheaSpot
+	conf.SyntheaSpotMaxPrice = *syntheaSpotMaxPrice
 
 	s := server.NewServer(conf)
 	s.Run()
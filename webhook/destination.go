@@ -0,0 +1,100 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Webhook URLs are chosen by whoever submits a task, so without these
+// checks Stork could be made to POST to services that are only reachable
+// from where it runs, like the EC2 instance metadata service.
+
+// The address ranges events are never sent to, besides loopback,
+// link-local, multicast and unspecified addresses
+var privateNetworks = mustParseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10", // Carrier-grade NAT
+	"fc00::/7",      // Unique local
+)
+
+// CheckURL returns an error if a webhook URL names a host that events may
+// not be sent to. Only literal addresses and localhost are caught here,
+// since what a name resolves to can change. The Dispatcher checks the
+// address it actually connects to as well.
+func CheckURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("webhook host %s is not allowed", host)
+	}
+	if ip := net.ParseIP(host); ip != nil && !allowedIP(ip) {
+		return fmt.Errorf("webhook address %s is not allowed", ip)
+	}
+	return nil
+}
+
+// allowedIP returns true if events may be sent to an IP address.
+func allowedIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// newRestrictedClient returns an http.Client that refuses to connect to
+// any address allowedIP rejects. The check is made on the address being
+// dialed, after any DNS lookup or redirect. Events are never sent through
+// a proxy, since the address dialed would then be the proxy's, and the
+// proxy would connect to the webhook host unchecked.
+func newRestrictedClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !allowedIP(ip) {
+				return errors.New("webhook address " + host + " is not allowed")
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: dialer.DialContext,
+		},
+	}
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
@@ -0,0 +1,70 @@
+package webhook
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/db"
+	"github.com/stretchr/testify/suite"
+)
+
+type DestinationTestSuite struct {
+	suite.Suite
+}
+
+func TestDestinationTestSuite(t *testing.T) {
+	suite.Run(t, new(DestinationTestSuite))
+}
+
+func (d *DestinationTestSuite) TestCheckURL() {
+	d.NoError(CheckURL("https://example.com/stork"))
+	d.NoError(CheckURL("https://93.184.216.34/stork"))
+
+	for _, rawURL := range []string{
+		"http://localhost:8080/stork",
+		"http://api.localhost/stork",
+		"http://127.0.0.1/stork",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://10.0.0.5/stork",
+		"http://172.16.0.1/stork",
+		"http://192.168.1.1/stork",
+		"http://0.0.0.0/stork",
+		"http://[::1]/stork",
+		"http://[fe80::1]/stork",
+		"http://[fd00::1]/stork",
+	} {
+		d.Error(CheckURL(rawURL), rawURL)
+	}
+}
+
+func (d *DestinationTestSuite) TestAllowedIP() {
+	d.True(allowedIP(net.ParseIP("8.8.8.8")))
+	d.True(allowedIP(net.ParseIP("2001:4860:4860::8888")))
+	d.False(allowedIP(net.ParseIP("127.0.0.2")))
+	d.False(allowedIP(net.ParseIP("100.64.0.1")))
+	d.False(allowedIP(net.ParseIP("224.0.0.1")))
+}
+
+func (d *DestinationTestSuite) TestRestrictedClient() {
+	posted := false
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		posted = true
+	}))
+	defer server.Close()
+
+	// By default the Dispatcher won't connect to loopback, even if the
+	// URL passed validation
+	dispatcher := NewDispatcher(nil, config.DefaultConfig)
+	attempt := dispatcher.post(&db.WebhookDelivery{ID: "abc123", URL: server.URL})
+	d.Contains(attempt.Error, "not allowed")
+	d.False(posted)
+
+	// Proxies from the environment are ignored, since the address checked
+	// would be the proxy's rather than the webhook host's
+	transport := newRestrictedClient(time.Second).Transport.(*http.Transport)
+	d.Nil(transport.Proxy)
+}
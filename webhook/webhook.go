@@ -0,0 +1,248 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/db"
+	"github.com/cjduffett/stork/logger"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// SignatureHeader carries the HMAC-SHA256 of the request body, keyed
+	// with the task's webhook secret: "sha256=<hex digest>"
+	SignatureHeader = "X-Stork-Signature"
+
+	// DeliveryHeader carries the delivery ID, which is the same for every
+	// attempt, so receivers can ignore duplicates.
+	DeliveryHeader = "X-Stork-Delivery"
+
+	// The longest Stork waits between two attempts
+	maxRetryDelay = time.Hour
+)
+
+// Event is the JSON body POSTed to a task's webhook when its status changes.
+type Event struct {
+	ID        string    `json:"id"`
+	TaskID    string    `json:"taskId"`
+	Status    string    `json:"status"`
+	Timestamp time.Time `json:"timestamp"`
+	Task      *db.Task  `json:"task"`
+}
+
+// Sign returns the signature of a payload, as sent in the SignatureHeader.
+func Sign(secret, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher POSTs events to task webhooks. Every event is stored as a
+// db.WebhookDelivery before it's sent, and failed deliveries are retried
+// with exponential backoff, up to MaxAttempts times. Deliveries for the
+// same task are independent, so a retried event may arrive after a later
+// one. Receivers should order events by Timestamp.
+type Dispatcher struct {
+	DAL         *db.DataAccessLayer
+	Client      *http.Client
+	MaxAttempts int
+	RetryDelay  time.Duration
+
+	mutex   sync.Mutex
+	stopped bool
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewDispatcher returns a pointer to an initialized Dispatcher. Unless
+// config.WebhookAllowPrivate is set, it refuses to send events to loopback,
+// link-local or private addresses.
+func NewDispatcher(dal *db.DataAccessLayer, config *config.StorkConfig) *Dispatcher {
+	client := &http.Client{Timeout: config.WebhookTimeout}
+	if !config.WebhookAllowPrivate {
+		client = newRestrictedClient(config.WebhookTimeout)
+	}
+
+	return &Dispatcher{
+		DAL:         dal,
+		Client:      client,
+		MaxAttempts: config.WebhookMaxAttempts,
+		RetryDelay:  config.WebhookRetryDelay,
+		stop:        make(chan struct{}),
+	}
+}
+
+// TaskStatusChanged stores an event for a task's new status and starts
+// delivering it. Tasks without a webhook are ignored.
+func (d *Dispatcher) TaskStatusChanged(task *db.Task) error {
+	if task.Webhook == nil {
+		return nil
+	}
+
+	now := time.Now()
+	event := &Event{
+		ID:        bson.NewObjectId().Hex(),
+		TaskID:    task.ID,
+		Status:    task.Status,
+		Timestamp: now,
+		Task:      task,
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	delivery := &db.WebhookDelivery{
+		ID:          event.ID,
+		TaskID:      task.ID,
+		TaskStatus:  task.Status,
+		URL:         task.Webhook.URL,
+		Payload:     string(payload),
+		Signature:   Sign([]byte(task.Webhook.Secret), payload),
+		Status:      db.DeliveryStatusPending,
+		Attempts:    []db.WebhookAttempt{},
+		Created:     &now,
+		NextAttempt: &now,
+	}
+	err = d.DAL.CreateWebhookDelivery(delivery)
+	if err != nil {
+		return err
+	}
+
+	d.schedule(delivery)
+	return nil
+}
+
+// Resume restarts delivery of every pending event, for example events that
+// were still being retried when Stork last shut down.
+func (d *Dispatcher) Resume() error {
+	list, err := d.DAL.GetPendingWebhookDeliveries()
+	if err != nil {
+		return err
+	}
+
+	if len(list.Deliveries) > 0 {
+		logger.Info(fmt.Sprintf("Resuming %d pending webhook deliveries", len(list.Deliveries)))
+	}
+	for i := range list.Deliveries {
+		d.schedule(&list.Deliveries[i])
+	}
+	return nil
+}
+
+// Stop abandons all retries, waiting for any attempt in progress to finish.
+// Events stored after Stop aren't sent at all. Pending deliveries are resumed
+// by Resume the next time Stork starts.
+func (d *Dispatcher) Stop() {
+	d.mutex.Lock()
+	d.stopped = true
+	close(d.stop)
+	d.mutex.Unlock()
+
+	d.wg.Wait()
+}
+
+// schedule delivers an event in a new goroutine, unless the Dispatcher
+// was stopped.
+func (d *Dispatcher) schedule(delivery *db.WebhookDelivery) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.stopped {
+		return
+	}
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.deliver(delivery)
+	}()
+}
+
+// deliver attempts to send an event until it succeeds, runs out of
+// attempts, or the Dispatcher is stopped.
+func (d *Dispatcher) deliver(delivery *db.WebhookDelivery) {
+	for delivery.Status == db.DeliveryStatusPending {
+		if delivery.NextAttempt != nil {
+			timer := time.NewTimer(delivery.NextAttempt.Sub(time.Now()))
+			select {
+			case <-timer.C:
+			case <-d.stop:
+				timer.Stop()
+				return
+			}
+		}
+
+		attempt := d.post(delivery)
+		delivery.Attempts = append(delivery.Attempts, attempt)
+		delivery.NextAttempt = nil
+
+		switch {
+		case attempt.Error == "":
+			delivery.Status = db.DeliveryStatusDelivered
+		case len(delivery.Attempts) >= d.MaxAttempts:
+			logger.Warning(fmt.Sprintf("Giving up on webhook delivery %s for task %s: %s", delivery.ID, delivery.TaskID, attempt.Error))
+			delivery.Status = db.DeliveryStatusFailed
+		default:
+			next := time.Now().Add(backoff(d.RetryDelay, len(delivery.Attempts)))
+			delivery.NextAttempt = &next
+		}
+
+		err := d.DAL.UpdateWebhookDelivery(delivery)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to update webhook delivery %s: %s", delivery.ID, err))
+		}
+	}
+}
+
+// post makes a single attempt to send an event. Any 2xx response is a success.
+func (d *Dispatcher) post(delivery *db.WebhookDelivery) db.WebhookAttempt {
+	now := time.Now()
+	attempt := db.WebhookAttempt{Time: &now}
+
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewBufferString(delivery.Payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, delivery.Signature)
+	req.Header.Set(DeliveryHeader, delivery.ID)
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	// Drain the body so the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = "Unexpected response " + resp.Status
+	}
+	return attempt
+}
+
+// backoff returns how long to wait after a number of failed attempts,
+// doubling the delay after each one.
+func backoff(delay time.Duration, attempts int) time.Duration {
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		return maxRetryDelay
+	}
+	return delay
+}
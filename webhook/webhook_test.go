@@ -0,0 +1,111 @@
+package webhook
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cjduffett/stork/config"
+	"github.com/cjduffett/stork/db"
+	"github.com/stretchr/testify/suite"
+)
+
+type WebhookTestSuite struct {
+	suite.Suite
+}
+
+func TestWebhookTestSuite(t *testing.T) {
+	suite.Run(t, new(WebhookTestSuite))
+}
+
+func (w *WebhookTestSuite) TestSign() {
+	payload := []byte(`{"id":"abc123"}`)
+	signature := Sign([]byte("secret"), payload)
+	w.Regexp("^sha256=[0-9a-f]{64}$", signature)
+
+	// Signatures depend on both the secret and the payload
+	w.Equal(signature, Sign([]byte("secret"), payload))
+	w.NotEqual(signature, Sign([]byte("other"), payload))
+	w.NotEqual(signature, Sign([]byte("secret"), []byte(`{"id":"def456"}`)))
+}
+
+func (w *WebhookTestSuite) TestPost() {
+	var gotHeaders http.Header
+	var gotBody string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		gotHeaders = r.Header
+		body, _ := ioutil.ReadAll(r.Body)
+		gotBody = string(body)
+		rw.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	// The test server listens on loopback
+	sConfig := *config.DefaultConfig
+	sConfig.WebhookAllowPrivate = true
+	d := NewDispatcher(nil, &sConfig)
+	delivery := &db.WebhookDelivery{
+		ID:        "abc123",
+		URL:       server.URL,
+		Payload:   `{"status":"completed"}`,
+		Signature: "sha256=deadbeef",
+	}
+
+	attempt := d.post(delivery)
+	w.Empty(attempt.Error)
+	w.Equal(http.StatusOK, attempt.StatusCode)
+	w.NotNil(attempt.Time)
+	w.Equal(`{"status":"completed"}`, gotBody)
+	w.Equal("application/json", gotHeaders.Get("Content-Type"))
+	w.Equal("sha256=deadbeef", gotHeaders.Get(SignatureHeader))
+	w.Equal("abc123", gotHeaders.Get(DeliveryHeader))
+
+	// Anything but a 2xx response fails
+	status = http.StatusInternalServerError
+	attempt = d.post(delivery)
+	w.NotEmpty(attempt.Error)
+	w.Equal(http.StatusInternalServerError, attempt.StatusCode)
+
+	// So does an unreachable receiver
+	server.Close()
+	attempt = d.post(delivery)
+	w.NotEmpty(attempt.Error)
+	w.Zero(attempt.StatusCode)
+}
+
+func (w *WebhookTestSuite) TestBackoff() {
+	w.Equal(30*time.Second, backoff(30*time.Second, 1))
+	w.Equal(60*time.Second, backoff(30*time.Second, 2))
+	w.Equal(4*time.Minute, backoff(30*time.Second, 4))
+
+	// The delay is capped
+	w.Equal(maxRetryDelay, backoff(30*time.Second, 20))
+	w.Equal(maxRetryDelay, backoff(2*time.Hour, 1))
+}
+
+func (w *WebhookTestSuite) TestNoWebhook() {
+	// Tasks without a webhook never touch the database
+	d := NewDispatcher(nil, config.DefaultConfig)
+	w.NoError(d.TaskStatusChanged(&db.Task{ID: "abc123", Status: db.TaskStatusActive}))
+}
+
+func (w *WebhookTestSuite) TestStop() {
+	posted := false
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		posted = true
+	}))
+	defer server.Close()
+
+	sConfig := *config.DefaultConfig
+	sConfig.WebhookAllowPrivate = true
+	d := NewDispatcher(nil, &sConfig)
+	d.Stop()
+
+	// Nothing is delivered once the Dispatcher is stopped
+	d.schedule(&db.WebhookDelivery{ID: "abc123", URL: server.URL, Status: db.DeliveryStatusPending})
+	d.wg.Wait()
+	w.False(posted)
+}